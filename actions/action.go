@@ -0,0 +1,121 @@
+// Copyright 2020-2021 The Datafuse Authors.
+//
+// SPDX-License-Identifier: Apache-2.0.
+
+package actions
+
+import (
+	"bots/common"
+	"bots/config"
+	"bots/store"
+	"context"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Action is a bot capability driven by webhook events and/or its own cron.
+type Action interface {
+	Name() string
+	Start()
+	// Stop waits for the running work until ctx is done.
+	Stop(ctx context.Context)
+	// DoAction handles a webhook event, ctx is cancelled on shutdown.
+	DoAction(ctx context.Context, event interface{}) error
+}
+
+// BotEventsHandler is implemented by the actions which also handle the events
+// the bot caused itself, e.g. the merge reacting to its own approvals. The
+// other actions never see them, so the bot does not answer itself.
+type BotEventsHandler interface {
+	HandlesBotEvents() bool
+}
+
+type actionFactory struct {
+	name    string
+	enabled func(cfg *config.Config) bool
+	new     func(cfg *config.Config, st store.Store, client common.GitHubAPI) Action
+}
+
+func always(cfg *config.Config) bool {
+	return true
+}
+
+// factories is the list of all built-in actions, registering a new action here
+// is all it takes to have it started, dispatched and stopped.
+var factories = []actionFactory{
+	{
+		name:    "labeler",
+		enabled: func(cfg *config.Config) bool { return !cfg.Disables.DisableLabel },
+		new: func(cfg *config.Config, st store.Store, client common.GitHubAPI) Action {
+			return NewLabelerAction(cfg, st, client)
+		},
+	},
+	{
+		name:    "release",
+		enabled: always,
+		new: func(cfg *config.Config, st store.Store, client common.GitHubAPI) Action {
+			return NewReleaseAction(cfg, client)
+		},
+	},
+	{
+		name:    "auto-merge",
+		enabled: func(cfg *config.Config) bool { return !cfg.Disables.DisableAutoMerge },
+		new: func(cfg *config.Config, st store.Store, client common.GitHubAPI) Action {
+			return NewAutoMergeAction(cfg, st, client)
+		},
+	},
+	{
+		name:    "issue",
+		enabled: always,
+		new: func(cfg *config.Config, st store.Store, client common.GitHubAPI) Action {
+			return NewIssueAction(cfg, st, client)
+		},
+	},
+	{
+		name:    "pull-request-check",
+		enabled: always,
+		new: func(cfg *config.Config, st store.Store, client common.GitHubAPI) Action {
+			return NewPullRequestCheckAction(cfg, st, client)
+		},
+	},
+}
+
+// Registry holds the enabled actions.
+type Registry struct {
+	client  common.GitHubAPI
+	actions []Action
+}
+
+// NewRegistry creates the enabled actions of the repository of cfg, all
+// sharing the client.
+func NewRegistry(cfg *config.Config, st store.Store, client common.GitHubAPI) *Registry {
+	r := &Registry{client: client}
+	for _, f := range factories {
+		if !f.enabled(cfg) {
+			log.Infof("Action %v disabled", f.name)
+			continue
+		}
+		r.Register(f.new(cfg, st, client))
+	}
+	return r
+}
+
+func (r *Registry) Register(action Action) {
+	r.actions = append(r.actions, action)
+}
+
+func (r *Registry) Actions() []Action {
+	return r.actions
+}
+
+func (r *Registry) Start() {
+	for _, action := range r.actions {
+		action.Start()
+	}
+}
+
+func (r *Registry) Stop(ctx context.Context) {
+	for _, action := range r.actions {
+		action.Stop(ctx)
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2020-2021 The Datafuse Authors.
+//
+// SPDX-License-Identifier: Apache-2.0.
+
+package actions
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/v35/github"
+)
+
+const (
+	ciPending = "pending"
+	ciFailure = "failure"
+	ciSuccess = "success"
+
+	requiredChecksTTL = 5 * time.Minute
+)
+
+// CheckReport combines the check runs and the commit statuses of a head.
+type CheckReport struct {
+	State string
+	// Pending and Failed are the names of the checks in that state.
+	Pending []string
+	Failed  []string
+}
+
+// Summary tells what the report waits on or why it failed.
+func (r *CheckReport) Summary() string {
+	switch r.State {
+	case ciPending:
+		return "waiting for " + strings.Join(r.Pending, ", ")
+	case ciFailure:
+		return "failed " + strings.Join(r.Failed, ", ")
+	}
+	return "all checks passed"
+}
+
+// summarizeChecks evaluates the latest result of every check context. With
+// required contexts only those decide, a missing one is pending, otherwise
+// every reported check must pass. The ignore contexts, e.g. the merge queue
+// status, never count.
+func summarizeChecks(runs []*github.CheckRun, statuses []*github.RepoStatus, required []string, ignore ...string) *CheckReport {
+	allowedCheckConclusions := map[string]bool{
+		"success": true,
+		"neutral": true,
+		"skipped": true,
+	}
+
+	states := map[string]string{}
+	latest := map[string]*github.CheckRun{}
+	for _, run := range runs {
+		// Re-runs share the name, the latest one wins.
+		if prev, ok := latest[run.GetName()]; ok && prev.GetID() > run.GetID() {
+			continue
+		}
+		latest[run.GetName()] = run
+		switch {
+		case run.GetStatus() != "completed":
+			states[run.GetName()] = ciPending
+		case allowedCheckConclusions[run.GetConclusion()]:
+			states[run.GetName()] = ciSuccess
+		default:
+			states[run.GetName()] = ciFailure
+		}
+	}
+	for _, status := range statuses {
+		switch status.GetState() {
+		case "success":
+			states[status.GetContext()] = ciSuccess
+		case "pending":
+			states[status.GetContext()] = ciPending
+		default:
+			states[status.GetContext()] = ciFailure
+		}
+	}
+	for _, context := range ignore {
+		delete(states, context)
+	}
+
+	names := required
+	if len(names) == 0 {
+		for name := range states {
+			names = append(names, name)
+		}
+	}
+
+	report := &CheckReport{}
+	for _, name := range names {
+		switch states[name] {
+		case ciSuccess:
+		case ciFailure:
+			report.Failed = append(report.Failed, name)
+		default:
+			report.Pending = append(report.Pending, name)
+		}
+	}
+	sort.Strings(report.Pending)
+	sort.Strings(report.Failed)
+
+	switch {
+	case len(report.Failed) > 0:
+		report.State = ciFailure
+	case len(report.Pending) > 0:
+		report.State = ciPending
+	default:
+		report.State = ciSuccess
+	}
+	return report
+}
+
+type requiredChecks struct {
+	contexts []string
+	fetched  time.Time
+}
+
+// requiredChecksCache keeps the branch protection contexts for a while, they
+// are needed for every pull request on every run.
+type requiredChecksCache struct {
+	mu       sync.Mutex
+	branches map[string]*requiredChecks
+}
+
+func (c *requiredChecksCache) get(branch string, fetch func(branch string) ([]string, error)) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.branches == nil {
+		c.branches = make(map[string]*requiredChecks)
+	}
+	if cached, ok := c.branches[branch]; ok && time.Since(cached.fetched) < requiredChecksTTL {
+		return cached.contexts, nil
+	}
+	contexts, err := fetch(branch)
+	if err != nil {
+		return nil, err
+	}
+	c.branches[branch] = &requiredChecks{contexts: contexts, fetched: time.Now()}
+	return contexts, nil
+}
@@ -0,0 +1,91 @@
+// Copyright 2020-2021 The Datafuse Authors.
+//
+// SPDX-License-Identifier: Apache-2.0.
+
+package actions
+
+import (
+	"testing"
+
+	"github.com/google/go-github/v35/github"
+)
+
+func run(id int64, name string, status string, conclusion string) *github.CheckRun {
+	return &github.CheckRun{
+		ID:         github.Int64(id),
+		Name:       github.String(name),
+		Status:     github.String(status),
+		Conclusion: github.String(conclusion),
+	}
+}
+
+func repoStatus(context string, state string) *github.RepoStatus {
+	return &github.RepoStatus{
+		Context: github.String(context),
+		State:   github.String(state),
+	}
+}
+
+func TestSummarizeChecks(t *testing.T) {
+	tests := []struct {
+		name     string
+		runs     []*github.CheckRun
+		statuses []*github.RepoStatus
+		required []string
+		state    string
+		summary  string
+	}{
+		{
+			name:    "nothing reported",
+			state:   ciSuccess,
+			summary: "all checks passed",
+		},
+		{
+			name:     "all passed",
+			runs:     []*github.CheckRun{run(1, "build", "completed", "success"), run(2, "lint", "completed", "skipped")},
+			statuses: []*github.RepoStatus{repoStatus("ci/docs", "success")},
+			state:    ciSuccess,
+			summary:  "all checks passed",
+		},
+		{
+			name:    "re-run wins",
+			runs:    []*github.CheckRun{run(2, "build", "completed", "success"), run(1, "build", "completed", "failure")},
+			state:   ciSuccess,
+			summary: "all checks passed",
+		},
+		{
+			name:    "running",
+			runs:    []*github.CheckRun{run(1, "build", "in_progress", ""), run(2, "lint", "completed", "success")},
+			state:   ciPending,
+			summary: "waiting for build",
+		},
+		{
+			name:     "failed",
+			runs:     []*github.CheckRun{run(1, "build", "completed", "failure")},
+			statuses: []*github.RepoStatus{repoStatus("ci/docs", "error")},
+			state:    ciFailure,
+			summary:  "failed build, ci/docs",
+		},
+		{
+			name:     "required missing",
+			runs:     []*github.CheckRun{run(1, "lint", "completed", "failure")},
+			required: []string{"build"},
+			state:    ciPending,
+			summary:  "waiting for build",
+		},
+		{
+			name:     "merge queue ignored",
+			statuses: []*github.RepoStatus{repoStatus(mergeQueueContext, "error")},
+			state:    ciSuccess,
+			summary:  "all checks passed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report := summarizeChecks(tt.runs, tt.statuses, tt.required, mergeQueueContext)
+			if report.State != tt.state || report.Summary() != tt.summary {
+				t.Errorf("got %v %q, want %v %q", report.State, report.Summary(), tt.state, tt.summary)
+			}
+		})
+	}
+}
@@ -0,0 +1,281 @@
+// Copyright 2020-2021 The Datafuse Authors.
+//
+// SPDX-License-Identifier: Apache-2.0.
+
+package actions
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/go-playground/webhooks/v6/github"
+)
+
+var (
+	commandNameRegexp = regexp.MustCompile(`^/([A-Za-z][A-Za-z0-9-]*)$`)
+	loginRegexp       = regexp.MustCompile(`^[A-Za-z0-9](?:[A-Za-z0-9-]*[A-Za-z0-9])?(?:\[bot\])?$`)
+)
+
+// commandLine is a line of a comment starting with /name, the name lower
+// cased and the fields after it as typed.
+type commandLine struct {
+	name   string
+	fields []string
+	text   string
+}
+
+// parseCommandLines scans every line of the comment body for commands, the
+// quoted lines and the fenced code blocks are skipped.
+func parseCommandLines(body string) []commandLine {
+	var lines []commandLine
+	fence := ""
+	for _, line := range strings.Split(body, "\n") {
+		text := strings.TrimSpace(line)
+		if fence != "" {
+			if strings.HasPrefix(text, fence) {
+				fence = ""
+			}
+			continue
+		}
+		if strings.HasPrefix(text, "```") || strings.HasPrefix(text, "~~~") {
+			fence = text[:3]
+			continue
+		}
+		if strings.HasPrefix(text, ">") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		match := commandNameRegexp.FindStringSubmatch(fields[0])
+		if match == nil {
+			continue
+		}
+		lines = append(lines, commandLine{
+			name:   strings.ToLower(match[1]),
+			fields: fields[1:],
+			text:   text,
+		})
+	}
+	return lines
+}
+
+type argKind int
+
+const (
+	// argUser is a GitHub login, the @ is optional.
+	argUser argKind = iota
+	// argChoice is one of the choices, matched case insensitively.
+	argChoice
+)
+
+// commandArg is a typed positional argument.
+type commandArg struct {
+	name    string
+	kind    argKind
+	choices []string
+	// optional may be left out, variadic takes all the values left.
+	optional bool
+	variadic bool
+}
+
+func (a commandArg) usage() string {
+	usage := a.name
+	switch a.kind {
+	case argUser:
+		usage = "@" + a.name
+	case argChoice:
+		usage = strings.Join(a.choices, "|")
+	}
+	if a.variadic {
+		usage += "..."
+	}
+	if a.optional {
+		usage = "[" + usage + "]"
+	}
+	return usage
+}
+
+// value checks and normalizes one value of the argument.
+func (a commandArg) value(s string) (string, error) {
+	switch a.kind {
+	case argUser:
+		login := strings.TrimPrefix(s, "@")
+		if !loginRegexp.MatchString(login) {
+			return "", fmt.Errorf("Invalid %s %s", a.name, s)
+		}
+		return login, nil
+	case argChoice:
+		for _, choice := range a.choices {
+			if strings.EqualFold(s, choice) {
+				return choice, nil
+			}
+		}
+		return "", fmt.Errorf("Unknown %s %s, use %s", a.name, s, orList(a.choices))
+	}
+	return s, nil
+}
+
+// commandFlag is a --name switch, or --name=value when it takes a value.
+type commandFlag struct {
+	name  string
+	value string
+	help  string
+}
+
+func (f commandFlag) usage() string {
+	if f.value != "" {
+		return "[--" + f.name + "=" + f.value + "]"
+	}
+	return "[--" + f.name + "]"
+}
+
+// invocation is a command line bound to the arguments of its command.
+type invocation struct {
+	// name is the command or alias typed.
+	name  string
+	text  string
+	args  map[string][]string
+	flags map[string]string
+}
+
+func (i *invocation) arg(name string) string {
+	if values := i.args[name]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func (i *invocation) flag(name string) bool {
+	_, ok := i.flags[name]
+	return ok
+}
+
+// command is a slash command of the issue and pull request comments.
+type command struct {
+	name    string
+	aliases []string
+	args    []commandArg
+	flags   []commandFlag
+	help    string
+	// permission is the config.CommandsConfig level the invocation needs.
+	permission func(event github.IssueCommentPayload, inv *invocation) string
+	run        func(ctx context.Context, event github.IssueCommentPayload, inv *invocation) error
+}
+
+func (c *command) usage() string {
+	parts := []string{"/" + c.name}
+	for _, arg := range c.args {
+		parts = append(parts, arg.usage())
+	}
+	for _, flag := range c.flags {
+		parts = append(parts, flag.usage())
+	}
+	return strings.Join(parts, " ")
+}
+
+// bind checks the fields of line against the arguments and flags, the errors
+// are meant to be answered to the commenter.
+func (c *command) bind(line commandLine) (*invocation, error) {
+	inv := &invocation{
+		name:  line.name,
+		text:  line.text,
+		args:  make(map[string][]string),
+		flags: make(map[string]string),
+	}
+	var values []string
+	for _, field := range line.fields {
+		if !strings.HasPrefix(field, "--") {
+			values = append(values, field)
+			continue
+		}
+		name, value, hasValue := strings.Cut(strings.TrimPrefix(field, "--"), "=")
+		flag, ok := c.flag(name)
+		if !ok {
+			return nil, fmt.Errorf("Unknown flag --%s", name)
+		}
+		if hasValue != (flag.value != "") {
+			return nil, fmt.Errorf("Invalid flag %s", field)
+		}
+		inv.flags[name] = value
+	}
+
+	for _, arg := range c.args {
+		if len(values) == 0 {
+			if !arg.optional {
+				return nil, fmt.Errorf("Missing %s", arg.name)
+			}
+			continue
+		}
+		n := 1
+		if arg.variadic {
+			n = len(values)
+		}
+		for _, s := range values[:n] {
+			value, err := arg.value(s)
+			if err != nil {
+				return nil, err
+			}
+			inv.args[arg.name] = append(inv.args[arg.name], value)
+		}
+		values = values[n:]
+	}
+	if len(values) > 0 {
+		return nil, fmt.Errorf("Unexpected %s", strings.Join(values, " "))
+	}
+	return inv, nil
+}
+
+func (c *command) flag(name string) (commandFlag, bool) {
+	for _, flag := range c.flags {
+		if flag.name == name {
+			return flag, true
+		}
+	}
+	return commandFlag{}, false
+}
+
+// commands is a set of slash commands looked up by name or alias.
+type commands []*command
+
+func (cs commands) lookup(name string) *command {
+	for _, c := range cs {
+		if c.name == name {
+			return c
+		}
+		for _, alias := range c.aliases {
+			if alias == name {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+// help lists the commands with their usage, one per line.
+func (cs commands) help() string {
+	lines := make([]string, 0, len(cs))
+	for _, c := range cs {
+		line := c.usage()
+		for _, alias := range c.aliases {
+			line += ", /" + alias
+		}
+		line += " -- " + c.help
+		for _, flag := range c.flags {
+			line += fmt.Sprintf(", --%s %s", flag.name, flag.help)
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// orList words the values as "a, b or c".
+func orList(values []string) string {
+	if len(values) < 2 {
+		return strings.Join(values, "")
+	}
+	return strings.Join(values[:len(values)-1], ", ") + " or " + values[len(values)-1]
+}
@@ -0,0 +1,82 @@
+// Copyright 2020-2021 The Datafuse Authors.
+//
+// SPDX-License-Identifier: Apache-2.0.
+
+package actions
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCommandLines(t *testing.T) {
+	body := "/LGTM\r\n" +
+		"  /review @Alice bob  \n" +
+		"> /approve\n" +
+		"~~~\n/merge squash\n```\n/assign\n~~~\n" +
+		"text /help\n" +
+		"/usr/bin/env\n" +
+		"/merge Squash"
+	var got [][]string
+	for _, line := range parseCommandLines(body) {
+		got = append(got, append([]string{line.name}, line.fields...))
+	}
+	want := [][]string{{"lgtm"}, {"review", "@Alice", "bob"}, {"merge", "Squash"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("commands: %v, want %v", got, want)
+	}
+}
+
+func TestCommandBind(t *testing.T) {
+	cmd := &command{
+		name: "test",
+		args: []commandArg{
+			{name: "mode", kind: argChoice, choices: []string{"fast", "slow"}},
+			{name: "user", kind: argUser, optional: true, variadic: true},
+		},
+		flags: []commandFlag{{name: "dry"}, {name: "reason", value: "text"}},
+	}
+	if usage := cmd.usage(); usage != "/test fast|slow [@user...] [--dry] [--reason=text]" {
+		t.Errorf("usage: %v", usage)
+	}
+
+	tests := []struct {
+		fields []string
+		args   map[string][]string
+		flags  map[string]string
+		err    string
+	}{
+		{
+			fields: []string{"FAST"},
+			args:   map[string][]string{"mode": {"fast"}},
+			flags:  map[string]string{},
+		},
+		{
+			fields: []string{"slow", "@Alice", "--dry", "dependabot[bot]", "--reason=flaky"},
+			args:   map[string][]string{"mode": {"slow"}, "user": {"Alice", "dependabot[bot]"}},
+			flags:  map[string]string{"dry": "", "reason": "flaky"},
+		},
+		{err: "Missing mode"},
+		{fields: []string{"medium"}, err: "Unknown mode medium, use fast or slow"},
+		{fields: []string{"fast", "@-alice"}, err: "Invalid user @-alice"},
+		{fields: []string{"fast", "--verbose"}, err: "Unknown flag --verbose"},
+		{fields: []string{"fast", "--dry=yes"}, err: "Invalid flag --dry=yes"},
+		{fields: []string{"fast", "--reason"}, err: "Invalid flag --reason"},
+	}
+	for _, tt := range tests {
+		inv, err := cmd.bind(commandLine{name: "test", fields: tt.fields})
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%v: error %v, want %v", tt.fields, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", tt.fields, err)
+			continue
+		}
+		if !reflect.DeepEqual(inv.args, tt.args) || !reflect.DeepEqual(inv.flags, tt.flags) {
+			t.Errorf("%v: args %v, flags %v", tt.fields, inv.args, inv.flags)
+		}
+	}
+}
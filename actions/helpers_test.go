@@ -0,0 +1,102 @@
+// Copyright 2020-2021 The Datafuse Authors.
+//
+// SPDX-License-Identifier: Apache-2.0.
+
+package actions
+
+import (
+	"bots/config"
+	"bots/store"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+const testRepo = "datafuselabs/databend"
+
+func testConfig() *config.Config {
+	return &config.Config{
+		Github: &config.GithubConfig{
+			RepoOwner:  "datafuselabs",
+			RepoName:   "databend",
+			BaseBranch: "main",
+		},
+		PRDescriptionAction: &config.PRDescriptionActionConfig{
+			Title: "Description check",
+		},
+		Hints: &config.HintConfig{
+			IssueFirstTimeComment: "Hi @%s, thanks for the issue",
+			PRNeedReviewComment:   "Hi @%s, a reviewer is on the way",
+		},
+		Disables:         &config.DisablesConfig{},
+		NightReleaseCron: "@daily",
+		MergeCheckCron:   "@every 10m",
+		Rule: &config.RuleConfig{
+			ApprovedRule:            "most",
+			RequiredApprovals:       2,
+			BlockOnChangesRequested: true,
+			MergeMethod:             "merge",
+			SquashSections:          []string{"Summary"},
+			MergeQueueTimeout:       time.Hour,
+		},
+		Commands: &config.CommandsConfig{
+			AssignMe: config.PermissionAnyone,
+			Assign:   config.PermissionTriage,
+			Review:   config.PermissionAuthor,
+			Approve:  config.PermissionWrite,
+			Merge:    config.PermissionAuthor,
+			Help:     config.PermissionAnyone,
+		},
+	}
+}
+
+func testStore() store.Store {
+	return store.NewMemoryStore()
+}
+
+// payload decodes the webhook payload from its JSON fields.
+func payload(t *testing.T, v interface{}, fields map[string]interface{}) {
+	t.Helper()
+	if _, ok := fields["repository"]; !ok {
+		fields["repository"] = map[string]interface{}{"full_name": testRepo}
+	}
+	data, err := json.Marshal(fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func labelsJSON(labels ...string) []map[string]interface{} {
+	list := []map[string]interface{}{}
+	for _, l := range labels {
+		list = append(list, map[string]interface{}{"name": l})
+	}
+	return list
+}
+
+// waitFor polls cond, for the work the actions do in the background.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func equalStrings(a []string, b ...string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
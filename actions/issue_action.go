@@ -5,8 +5,13 @@
 package actions
 
 import (
+	"bots/audit"
 	"bots/common"
 	"bots/config"
+	"bots/logging"
+	"bots/store"
+	"context"
+	"errors"
 	"fmt"
 	"strings"
 
@@ -15,89 +20,65 @@ import (
 )
 
 type IssueAction struct {
-	cfg    *config.Config
-	client *common.Client
+	cfg       *config.Config
+	client    common.GitHubAPI
+	decisions *store.Decisions
+	commands  commands
 }
 
-func NewIssueAction(cfg *config.Config) *IssueAction {
-	client := common.NewClient(cfg)
-
-	return &IssueAction{
-		cfg:    cfg,
-		client: client,
+func NewIssueAction(cfg *config.Config, st store.Store, client common.GitHubAPI) *IssueAction {
+	s := &IssueAction{
+		cfg:       cfg,
+		client:    client,
+		decisions: store.NewDecisions(st, cfg.Github.FullName()),
 	}
+	s.commands = s.newCommands()
+	return s
+}
+
+func (s *IssueAction) Name() string {
+	return "issue"
 }
 
 func (s *IssueAction) Start() {
-	log.Infof("Issue action start...")
+	log.WithField("repo", s.cfg.Github.FullName()).Infof("Issue action start...")
 }
 
-func (s *IssueAction) Stop() {
+func (s *IssueAction) Stop(ctx context.Context) {
 }
 
-func (s *IssueAction) DoAction(event interface{}) error {
+func (s *IssueAction) DoAction(ctx context.Context, event interface{}) error {
 	switch event := event.(type) {
 	case github.IssueCommentPayload:
-		body := event.Comment.Body
-		log.Infof("Issue comments: %+v , %+v coming", event.Sender.Login, body)
-		switch body := strings.ToLower(body); {
-		case strings.HasPrefix(body, "/assign"):
-			{
-				var user string
-				if body == "/assign" || body == "/assignme" {
-					user = event.Sender.Login
-				} else {
-					user = strings.TrimSpace(strings.TrimPrefix(body, "/assign @"))
-				}
-				if err := s.client.IssueAssignTo(int(event.Issue.Number), user); err != nil {
-					return err
-				}
-				s.client.AddLabelToIssue(int(event.Issue.Number), "community-take")
-			}
-		case strings.HasPrefix(body, "/review "):
-			{
-				user := strings.TrimSpace(strings.TrimPrefix(body, "/review @"))
-				if err := s.client.PullRequestRequestReviewer(int(event.Issue.Number), user); err != nil {
-					return err
-				}
-				msg := "Take the reviewer to " + user
-				s.client.CreateComment(int(event.Issue.Number), &msg)
-			}
-
-		case strings.HasPrefix(body, "/approve"), strings.HasPrefix(body, "/lgtm"):
-			{
-				if err := s.client.PullRequestReview(int(event.Issue.Number), "APPROVE"); err != nil {
-					return err
-				}
-				labels := make([]string, len(event.Issue.Labels))
-				for _, l := range event.Issue.Labels {
-					labels = append(labels, l.Name)
-				}
-				if err := s.prMergeStateChange(int(event.Issue.Number), labels); err != nil {
-					return err
-				}
-
-				msg := fmt.Sprintf("Approved by %s!", event.Comment.User.Login)
-				s.client.CreateComment(int(event.Issue.Number), &msg)
-
-			}
-		case strings.HasPrefix(body, "/help"):
-			{
-				help := common.HelpMessage()
-				s.client.CreateComment(int(event.Issue.Number), &help)
-			}
-
+		logging.From(ctx).Infof("Issue comments: %+v , %+v coming", event.Sender.Login, event.Comment.Body)
+		// The done lines are keyed by their index, an edit must not run the
+		// commands again nor the ones shifted to a done index.
+		if event.Action != "created" {
+			return nil
 		}
+		return s.runCommands(ctx, event)
 
 	case github.IssuesPayload:
 		if event.Issue.State == "open" {
-			first, err := s.client.IssuesForFirstTime(event.Issue.User.Login)
+			number := int(event.Issue.Number)
+			done, err := s.decisions.Done(store.Commented, number, "first-time", "")
+			if err != nil {
+				return err
+			}
+			if done {
+				return nil
+			}
+			first, err := s.client.IssuesForFirstTime(ctx, event.Issue.User.Login)
 			if err != nil {
 				return err
 			}
 			if first {
+				ctx := audit.WithRule(ctx, fmt.Sprintf("first issue of @%v", event.Issue.User.Login))
 				comments := fmt.Sprintf(s.cfg.Hints.IssueFirstTimeComment, event.Issue.User.Login)
-				s.client.CreateComment(int(event.Issue.Number), &comments)
+				if err := s.client.CreateComment(ctx, number, &comments); err != nil {
+					return err
+				}
+				return s.decisions.Record(store.Commented, number, "first-time", "")
 			}
 		}
 
@@ -105,8 +86,71 @@ func (s *IssueAction) DoAction(event interface{}) error {
 	return nil
 }
 
-func (s *IssueAction) prMergeStateChange(number int, labels []string) error {
-	newLabels := make([]string, len(labels))
+// runCommands runs every command line of the comment, one failing does not
+// stop the next ones. The lines done are recorded so a retry of the event
+// only runs the failed ones again.
+func (s *IssueAction) runCommands(ctx context.Context, event github.IssueCommentPayload) error {
+	number := int(event.Issue.Number)
+	var errs []string
+	for i, line := range parseCommandLines(event.Comment.Body) {
+		what := fmt.Sprintf("comment-%d/%d", event.Comment.ID, i)
+		done, err := s.decisions.Done(store.Commanded, number, what, "")
+		if err != nil {
+			return err
+		}
+		if done {
+			logging.From(ctx).Infof("Command %v of comment %v already done", line.text, event.Comment.ID)
+			continue
+		}
+		if err := s.runCommand(ctx, event, line); err != nil {
+			logging.From(ctx).Errorf("Command %v error: %v", line.text, err)
+			errs = append(errs, fmt.Sprintf("%v: %v", line.text, err))
+			continue
+		}
+		if err := s.decisions.Record(store.Commanded, number, what, ""); err != nil {
+			return err
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// runCommand runs a command line of the comment, the unknown commands are
+// ignored and the misused ones answered with their usage.
+func (s *IssueAction) runCommand(ctx context.Context, event github.IssueCommentPayload, line commandLine) error {
+	cmd := s.commands.lookup(line.name)
+	if cmd == nil {
+		return nil
+	}
+	ctx = audit.WithRule(ctx, fmt.Sprintf("comment of @%v: %v", event.Sender.Login, line.text))
+	inv, err := cmd.bind(line)
+	if err != nil {
+		msg := fmt.Sprintf("%v. Usage: `%v`", err, cmd.usage())
+		return s.client.CreateComment(ctx, int(event.Issue.Number), &msg)
+	}
+	if ok, err := s.authorize(ctx, event, inv.name, cmd.permission(event, inv)); !ok {
+		return err
+	}
+	return cmd.run(ctx, event, inv)
+}
+
+// authorize tells whether the commenter may run the command, politely
+// answering them when they may not.
+func (s *IssueAction) authorize(ctx context.Context, event github.IssueCommentPayload, command string, level string) (bool, error) {
+	user := event.Sender.Login
+	ok, err := hasPermission(ctx, s.client, level, user, event.Issue.User.Login)
+	if err != nil || ok {
+		return ok, err
+	}
+	logging.From(ctx).Infof("Command /%v of %v denied, it needs %v", command, user, level)
+	msg := fmt.Sprintf("Sorry @%s, `/%s` needs you %s. A maintainer can run it for you.", user, command, describePermission(level))
+	return false, s.client.CreateComment(ctx, int(event.Issue.Number), &msg)
+}
+
+func (s *IssueAction) prMergeStateChange(ctx context.Context, number int, labels []string) error {
+	newLabels := make([]string, 0, len(labels))
 	for _, l := range labels {
 		switch l {
 		case "need-review":
@@ -124,5 +168,5 @@ func (s *IssueAction) prMergeStateChange(number int, labels []string) error {
 		}
 	}
 
-	return s.client.ReplaceLabelsForIssue(number, newLabels)
+	return s.client.ReplaceLabelsForIssue(ctx, number, newLabels)
 }
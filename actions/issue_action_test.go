@@ -0,0 +1,309 @@
+// Copyright 2020-2021 The Datafuse Authors.
+//
+// SPDX-License-Identifier: Apache-2.0.
+
+package actions
+
+import (
+	"bots/common/githubtest"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/go-playground/webhooks/v6/github"
+)
+
+// commentID numbers the comments, GitHub ids are unique.
+var commentID int64
+
+// issueComment is a comment of sender on the issue number opened by alice.
+func issueComment(t *testing.T, number int, sender string, body string, labels ...string) github.IssueCommentPayload {
+	commentID++
+	var event github.IssueCommentPayload
+	payload(t, &event, map[string]interface{}{
+		"action": "created",
+		"issue": map[string]interface{}{
+			"number": number,
+			"labels": labelsJSON(labels...),
+			"user":   map[string]interface{}{"login": "alice"},
+		},
+		"comment": map[string]interface{}{"id": commentID, "body": body, "user": map[string]interface{}{"login": sender}},
+		"sender":  map[string]interface{}{"login": sender},
+	})
+	return event
+}
+
+func TestIssueActionAssign(t *testing.T) {
+	repo := githubtest.NewRepo()
+	repo.Permissions["alice"] = "triage"
+	action := NewIssueAction(testConfig(), testStore(), repo)
+
+	if err := action.DoAction(context.Background(), issueComment(t, 7, "alice", "/assignme")); err != nil {
+		t.Fatal(err)
+	}
+	if err := action.DoAction(context.Background(), issueComment(t, 8, "alice", "/assign @Bob")); err != nil {
+		t.Fatal(err)
+	}
+
+	if !equalStrings(repo.Assignees[7], "alice") {
+		t.Errorf("assignees of #7: %v", repo.Assignees[7])
+	}
+	// The logins keep their case.
+	if !equalStrings(repo.Assignees[8], "Bob") {
+		t.Errorf("assignees of #8: %v", repo.Assignees[8])
+	}
+	if !equalStrings(repo.Labels[7], "community-take") {
+		t.Errorf("labels of #7: %v", repo.Labels[7])
+	}
+}
+
+func TestIssueActionAssignError(t *testing.T) {
+	repo := githubtest.NewRepo()
+	repo.Errors["AddLabelToIssue"] = errors.New("boom")
+	action := NewIssueAction(testConfig(), testStore(), repo)
+
+	if err := action.DoAction(context.Background(), issueComment(t, 7, "alice", "/assign")); err == nil {
+		t.Fatal("expected the label error")
+	}
+}
+
+func TestIssueActionApprove(t *testing.T) {
+	repo := githubtest.NewRepo()
+	repo.AddPullRequest(9, "alice", "main", "a1")
+	repo.Permissions["bob"] = "maintain"
+	action := NewIssueAction(testConfig(), testStore(), repo)
+
+	if err := action.DoAction(context.Background(), issueComment(t, 9, "bob", "/lgtm", "need-review", "pr-feature")); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(repo.Reviews[9]) != 1 || repo.Reviews[9][0].GetState() != "APPROVED" {
+		t.Errorf("reviews of #9: %v", repo.Reviews[9])
+	}
+	if !equalStrings(repo.Labels[9], "lgtm1", "pr-feature") {
+		t.Errorf("labels of #9: %v", repo.Labels[9])
+	}
+	if !equalStrings(repo.Comments[9], "Approved by bob!") {
+		t.Errorf("comments of #9: %v", repo.Comments[9])
+	}
+}
+
+func TestIssueActionMergeMethod(t *testing.T) {
+	repo := githubtest.NewRepo()
+	repo.Labels[9] = []string{"merge-rebase", "merge-conflict", "pr-feature"}
+	action := NewIssueAction(testConfig(), testStore(), repo)
+
+	if err := action.DoAction(context.Background(), issueComment(t, 9, "alice", "/merge squash", "merge-rebase", "merge-conflict", "pr-feature")); err != nil {
+		t.Fatal(err)
+	}
+	if !equalStrings(repo.Labels[9], "merge-conflict", "pr-feature", "merge-squash") {
+		t.Errorf("labels of #9: %v", repo.Labels[9])
+	}
+
+	if err := action.DoAction(context.Background(), issueComment(t, 9, "alice", "/merge octopus")); err != nil {
+		t.Fatal(err)
+	}
+	comments := repo.Comments[9]
+	if len(comments) != 2 || !strings.HasPrefix(comments[1], "Unknown merge method octopus") {
+		t.Errorf("comments of #9: %v", comments)
+	}
+}
+
+func TestIssueActionFirstTimeComment(t *testing.T) {
+	repo := githubtest.NewRepo()
+	action := NewIssueAction(testConfig(), testStore(), repo)
+
+	var event github.IssuesPayload
+	payload(t, &event, map[string]interface{}{
+		"action": "opened",
+		"issue":  map[string]interface{}{"number": 3, "state": "open", "user": map[string]interface{}{"login": "carol"}},
+	})
+	// A redelivery must not comment twice.
+	for i := 0; i < 2; i++ {
+		if err := action.DoAction(context.Background(), event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !equalStrings(repo.Comments[3], "Hi @carol, thanks for the issue") {
+		t.Errorf("comments of #3: %v", repo.Comments[3])
+	}
+}
+
+func TestIssueActionPermissions(t *testing.T) {
+	tests := []struct {
+		sender string
+		body   string
+		// allowed is false when the command is denied with a comment.
+		allowed bool
+	}{
+		{sender: "carol", body: "/assignme", allowed: true},
+		{sender: "carol", body: "/assign @dave"},
+		{sender: "triager", body: "/assign @dave", allowed: true},
+		{sender: "alice", body: "/review @bob", allowed: true},
+		{sender: "carol", body: "/review @bob"},
+		{sender: "writer", body: "/review @bob", allowed: true},
+		{sender: "carol", body: "/lgtm"},
+		{sender: "triager", body: "/approve"},
+		{sender: "writer", body: "/lgtm", allowed: true},
+		{sender: "admin", body: "/approve", allowed: true},
+		{sender: "alice", body: "/merge squash", allowed: true},
+		{sender: "carol", body: "/merge squash"},
+		{sender: "carol", body: "/help", allowed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sender+" "+tt.body, func(t *testing.T) {
+			repo := githubtest.NewRepo()
+			repo.AddPullRequest(9, "alice", "main", "a1")
+			repo.Permissions["triager"] = "triage"
+			repo.Permissions["writer"] = "write"
+			repo.Permissions["admin"] = "admin"
+			action := NewIssueAction(testConfig(), testStore(), repo)
+
+			if err := action.DoAction(context.Background(), issueComment(t, 9, tt.sender, tt.body, "need-review")); err != nil {
+				t.Fatal(err)
+			}
+			comments := repo.Comments[9]
+			denied := len(comments) == 1 && strings.HasPrefix(comments[0], "Sorry @"+tt.sender+", `/")
+			if denied == tt.allowed {
+				t.Errorf("allowed %v, comments: %v", tt.allowed, comments)
+			}
+			if denied && (len(repo.Assignees[9]) != 0 || len(repo.Reviews[9]) != 0 || len(repo.RequestedReviewers[9]) != 0) {
+				t.Errorf("denied command ran: %v, %v, %v", repo.Assignees[9], repo.Reviews[9], repo.RequestedReviewers[9])
+			}
+		})
+	}
+}
+
+func TestIssueActionTeamPermission(t *testing.T) {
+	repo := githubtest.NewRepo()
+	repo.AddPullRequest(9, "alice", "main", "a1")
+	repo.Teams["datafuselabs/reviewers"] = []string{"bob"}
+	cfg := testConfig()
+	cfg.Commands.Approve = "team:datafuselabs/reviewers"
+	action := NewIssueAction(cfg, testStore(), repo)
+
+	for _, sender := range []string{"carol", "bob"} {
+		if err := action.DoAction(context.Background(), issueComment(t, 9, sender, "/approve", "need-review")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	comments := repo.Comments[9]
+	if len(comments) != 2 || comments[0] != "Sorry @carol, `/approve` needs you to be a member of the datafuselabs/reviewers team. A maintainer can run it for you." ||
+		comments[1] != "Approved by bob!" {
+		t.Errorf("comments of #9: %v", comments)
+	}
+}
+
+func TestIssueActionCommandRetry(t *testing.T) {
+	repo := githubtest.NewRepo()
+	repo.AddPullRequest(9, "alice", "main", "a1")
+	repo.Permissions["bob"] = "write"
+	repo.Errors["PullRequestReview"] = errors.New("server error")
+	action := NewIssueAction(testConfig(), testStore(), repo)
+
+	// The failing /lgtm neither stops /assign nor gets it run twice.
+	event := issueComment(t, 9, "bob", "/review @carol\n/lgtm\n/assign @dave")
+	if err := action.DoAction(context.Background(), event); err == nil || !strings.Contains(err.Error(), "/lgtm: server error") {
+		t.Fatalf("error: %v", err)
+	}
+	if !equalStrings(repo.RequestedReviewers[9], "carol") || !equalStrings(repo.Assignees[9], "dave") {
+		t.Errorf("reviewers %v, assignees %v of #9", repo.RequestedReviewers[9], repo.Assignees[9])
+	}
+
+	// The retry of the event only runs /lgtm again.
+	delete(repo.Errors, "PullRequestReview")
+	if err := action.DoAction(context.Background(), event); err != nil {
+		t.Fatal(err)
+	}
+	if len(repo.Reviews[9]) != 1 {
+		t.Errorf("reviews of #9: %v", repo.Reviews[9])
+	}
+	if !equalStrings(repo.Comments[9], "Take the reviewer to carol", "Approved by bob!") {
+		t.Errorf("comments of #9: %v", repo.Comments[9])
+	}
+	if calls := repo.Calls["PullRequestRequestReviewer"]; calls != 1 {
+		t.Errorf("reviewers requested %v times", calls)
+	}
+}
+
+func TestIssueActionCommentEdited(t *testing.T) {
+	repo := githubtest.NewRepo()
+	repo.Permissions["bob"] = "write"
+	action := NewIssueAction(testConfig(), testStore(), repo)
+
+	// Only a created comment runs its commands.
+	event := issueComment(t, 9, "bob", "/assign @dave")
+	for _, act := range []string{"edited", "deleted"} {
+		event.Action = act
+		if err := action.DoAction(context.Background(), event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(repo.Assignees[9]) != 0 || len(repo.Comments[9]) != 0 {
+		t.Errorf("assignees %v, comments %v of #9", repo.Assignees[9], repo.Comments[9])
+	}
+}
+
+func TestIssueActionCommands(t *testing.T) {
+	repo := githubtest.NewRepo()
+	repo.AddPullRequest(9, "alice", "main", "a1")
+	repo.Permissions["bob"] = "write"
+	action := NewIssueAction(testConfig(), testStore(), repo)
+
+	body := "Thanks, a few commands:\n" +
+		"> /merge rebase\n" +
+		"```\n/assign @mallory\n```\n" +
+		"/Review @Carol dave\n" +
+		"/lgtm\n" +
+		"see /usr/bin and /unknown"
+	if err := action.DoAction(context.Background(), issueComment(t, 9, "bob", body, "need-review")); err != nil {
+		t.Fatal(err)
+	}
+	if !equalStrings(repo.RequestedReviewers[9], "Carol", "dave") {
+		t.Errorf("requested reviewers of #9: %v", repo.RequestedReviewers[9])
+	}
+	if len(repo.Reviews[9]) != 1 || len(repo.Assignees[9]) != 0 {
+		t.Errorf("reviews %v, assignees %v of #9", repo.Reviews[9], repo.Assignees[9])
+	}
+	if !equalStrings(repo.Comments[9], "Take the reviewer to Carol, dave", "Approved by bob!") {
+		t.Errorf("comments of #9: %v", repo.Comments[9])
+	}
+}
+
+func TestIssueActionCommandUsage(t *testing.T) {
+	repo := githubtest.NewRepo()
+	action := NewIssueAction(testConfig(), testStore(), repo)
+
+	for _, body := range []string{"/review", "/assign @alice --label", "/help me"} {
+		if err := action.DoAction(context.Background(), issueComment(t, 9, "alice", body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !equalStrings(repo.Comments[9],
+		"Missing user. Usage: `/review @user...`",
+		"Unknown flag --label. Usage: `/assign [@user...] [--no-label]`",
+		"Unexpected me. Usage: `/help`") {
+		t.Errorf("comments of #9: %v", repo.Comments[9])
+	}
+}
+
+func TestIssueActionHelp(t *testing.T) {
+	repo := githubtest.NewRepo()
+	action := NewIssueAction(testConfig(), testStore(), repo)
+
+	if err := action.DoAction(context.Background(), issueComment(t, 9, "carol", "/help")); err != nil {
+		t.Fatal(err)
+	}
+	help := strings.Join([]string{
+		"/assignme [--no-label] -- assign the issue to you, --no-label skips the community-take label",
+		"/assign [@user...] [--no-label] -- assign the issue to the users, you when none, --no-label skips the community-take label",
+		"/review @user... -- request the reviews of the users",
+		"/approve, /lgtm -- approve the pull request",
+		"/merge merge|squash|rebase -- choose how the pull request is merged",
+		"/help -- show help",
+	}, "\n")
+	if !equalStrings(repo.Comments[9], help) {
+		t.Errorf("comments of #9: %v", repo.Comments[9])
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright 2020-2021 The Datafuse Authors.
+//
+// SPDX-License-Identifier: Apache-2.0.
+
+package actions
+
+import (
+	"bots/policy"
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/go-playground/webhooks/v6/github"
+)
+
+// newCommands registers the slash commands of the issue action, /help lists
+// them in this order.
+func (s *IssueAction) newCommands() commands {
+	return commands{
+		{
+			name:  "assignme",
+			help:  "assign the issue to you",
+			flags: []commandFlag{{name: "no-label", help: "skips the community-take label"}},
+			permission: func(event github.IssueCommentPayload, inv *invocation) string {
+				return s.cfg.Commands.AssignMe
+			},
+			run: s.assign,
+		},
+		{
+			name:  "assign",
+			args:  []commandArg{{name: "user", kind: argUser, optional: true, variadic: true}},
+			flags: []commandFlag{{name: "no-label", help: "skips the community-take label"}},
+			help:  "assign the issue to the users, you when none",
+			permission: func(event github.IssueCommentPayload, inv *invocation) string {
+				for _, user := range inv.args["user"] {
+					if !strings.EqualFold(user, event.Sender.Login) {
+						return s.cfg.Commands.Assign
+					}
+				}
+				return s.cfg.Commands.AssignMe
+			},
+			run: s.assign,
+		},
+		{
+			name: "review",
+			args: []commandArg{{name: "user", kind: argUser, variadic: true}},
+			help: "request the reviews of the users",
+			permission: func(event github.IssueCommentPayload, inv *invocation) string {
+				return s.cfg.Commands.Review
+			},
+			run: s.review,
+		},
+		{
+			name:    "approve",
+			aliases: []string{"lgtm"},
+			help:    "approve the pull request",
+			permission: func(event github.IssueCommentPayload, inv *invocation) string {
+				return s.cfg.Commands.Approve
+			},
+			run: s.approve,
+		},
+		{
+			name: "merge",
+			args: []commandArg{{
+				name:    "merge method",
+				kind:    argChoice,
+				choices: []string{policy.MergeMethodMerge, policy.MergeMethodSquash, policy.MergeMethodRebase},
+			}},
+			help: "choose how the pull request is merged",
+			permission: func(event github.IssueCommentPayload, inv *invocation) string {
+				return s.cfg.Commands.Merge
+			},
+			run: s.mergeMethod,
+		},
+		{
+			name: "help",
+			help: "show help",
+			permission: func(event github.IssueCommentPayload, inv *invocation) string {
+				return s.cfg.Commands.Help
+			},
+			run: func(ctx context.Context, event github.IssueCommentPayload, inv *invocation) error {
+				help := s.commands.help()
+				return s.client.CreateComment(ctx, int(event.Issue.Number), &help)
+			},
+		},
+	}
+}
+
+func (s *IssueAction) assign(ctx context.Context, event github.IssueCommentPayload, inv *invocation) error {
+	number := int(event.Issue.Number)
+	users := inv.args["user"]
+	if len(users) == 0 {
+		users = []string{event.Sender.Login}
+	}
+	for _, user := range users {
+		if err := s.client.IssueAssignTo(ctx, number, user); err != nil {
+			return err
+		}
+	}
+	if inv.flag("no-label") {
+		return nil
+	}
+	return s.client.AddLabelToIssue(ctx, number, "community-take")
+}
+
+func (s *IssueAction) review(ctx context.Context, event github.IssueCommentPayload, inv *invocation) error {
+	number := int(event.Issue.Number)
+	users := inv.args["user"]
+	for _, user := range users {
+		if err := s.client.PullRequestRequestReviewer(ctx, number, user); err != nil {
+			return err
+		}
+	}
+	msg := "Take the reviewer to " + strings.Join(users, ", ")
+	return s.client.CreateComment(ctx, number, &msg)
+}
+
+func (s *IssueAction) approve(ctx context.Context, event github.IssueCommentPayload, inv *invocation) error {
+	number := int(event.Issue.Number)
+	if err := s.client.PullRequestReview(ctx, number, "APPROVE"); err != nil {
+		return err
+	}
+	labels := make([]string, 0, len(event.Issue.Labels))
+	for _, l := range event.Issue.Labels {
+		labels = append(labels, l.Name)
+	}
+	if err := s.prMergeStateChange(ctx, number, labels); err != nil {
+		return err
+	}
+
+	msg := fmt.Sprintf("Approved by %s!", event.Comment.User.Login)
+	return s.client.CreateComment(ctx, number, &msg)
+}
+
+func (s *IssueAction) mergeMethod(ctx context.Context, event github.IssueCommentPayload, inv *invocation) error {
+	number := int(event.Issue.Number)
+	method := inv.arg("merge method")
+	// Only the other merge-<method> labels, not e.g. merge-conflict.
+	for _, l := range event.Issue.Labels {
+		if other := strings.TrimPrefix(l.Name, policy.MergeMethodLabelPrefix); other != l.Name && policy.ValidMergeMethod(other) && other != method {
+			if err := s.client.RemoveLabelFromIssue(ctx, number, l.Name); err != nil {
+				return err
+			}
+		}
+	}
+	if err := s.client.AddLabelToIssue(ctx, number, policy.MergeMethodLabelPrefix+method); err != nil {
+		return err
+	}
+	msg := fmt.Sprintf("Merge method set to %s", method)
+	return s.client.CreateComment(ctx, number, &msg)
+}
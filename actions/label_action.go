@@ -5,49 +5,131 @@
 package actions
 
 import (
+	"bots/audit"
+	"bots/common"
 	"bots/config"
-	"encoding/json"
+	"bots/logging"
+	"bots/store"
+	"context"
+	"fmt"
+	"sort"
 
 	"github.com/go-playground/webhooks/v6/github"
-	"github.com/jimschubert/labeler"
+	"github.com/jimschubert/labeler/model"
 	log "github.com/sirupsen/logrus"
 )
 
+const labelerConfigPath = ".github/labeler.yml"
+
+// LabelerAction labels the pull requests by the patterns of labeler.yml
+// matching their title and body, in the labeler's format.
 type LabelerAction struct {
-	cfg *config.Config
+	cfg       *config.Config
+	client    common.GitHubAPI
+	decisions *store.Decisions
 }
 
-func NewLabelerAction(cfg *config.Config) *LabelerAction {
+func NewLabelerAction(cfg *config.Config, st store.Store, client common.GitHubAPI) *LabelerAction {
 	return &LabelerAction{
-		cfg: cfg,
+		cfg:       cfg,
+		client:    client,
+		decisions: store.NewDecisions(st, cfg.Github.FullName()),
 	}
 }
 
+func (s *LabelerAction) Name() string {
+	return "labeler"
+}
+
 func (s *LabelerAction) Start() {
-	log.Infof("Labeler action start...")
+	log.WithField("repo", s.cfg.Github.FullName()).Infof("Labeler action start...")
 }
 
-func (s *LabelerAction) Stop() {
+func (s *LabelerAction) Stop(ctx context.Context) {
 }
 
-func (s *LabelerAction) DoAction(event interface{}) error {
+func (s *LabelerAction) DoAction(ctx context.Context, event interface{}) error {
 	switch event.(type) {
 	case github.PullRequestPayload:
 		pr := event.(github.PullRequestPayload)
-		log.Infof("Pull reqeust: %+v coming", pr.Number)
-		body, _ := json.Marshal(pr)
-		data := string(body)
-		l, err := labeler.New(s.cfg.Github.RepoOwner, s.cfg.Github.RepoName, "pull_request", int(pr.Number), &data)
-		if err != nil {
+		logging.From(ctx).Infof("Pull reqeust: %+v coming", pr.Number)
+		// Title and body edits may change the labels, others only matter once per head.
+		sha := pr.PullRequest.Head.Sha
+		if pr.Action != "edited" {
+			done, err := s.decisions.Done(store.Labeled, int(pr.Number), "", sha)
+			if err != nil {
+				return err
+			}
+			if done {
+				logging.From(ctx).Infof("Pull request: %v already labeled at %v", pr.Number, sha)
+				return nil
+			}
+		}
+		if err := s.label(ctx, pr); err != nil {
+			return err
+		}
+		if err := s.decisions.Record(store.Labeled, int(pr.Number), "", sha); err != nil {
 			return err
 		}
+	}
+	return nil
+}
 
-		log.Infof("Labeling prepare...")
-		err = l.Execute()
-		if err != nil {
+// label adds the missing labels matching the pull request, with the comment
+// of the config once any was added.
+func (s *LabelerAction) label(ctx context.Context, pr github.PullRequestPayload) error {
+	labelerConfig, comment, err := s.loadConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	existing := make(map[string]bool)
+	for _, l := range pr.PullRequest.Labels {
+		existing[l.Name] = true
+	}
+	labels := labelerConfig.LabelsFor(pr.PullRequest.Title, pr.PullRequest.Body)
+	sort.Strings(labels)
+
+	ctx = audit.WithRule(ctx, "labeler.yml")
+	added := 0
+	for _, label := range labels {
+		if existing[label] {
+			continue
+		}
+		existing[label] = true
+		if err := s.client.AddLabelToIssue(ctx, int(pr.Number), label); err != nil {
 			return err
 		}
-		log.Infof("Labeling done...")
+		added++
+	}
+	logging.From(ctx).Infof("Labeling done, %v labels added", added)
+
+	if added > 0 && comment != "" {
+		body := "<!-- Labeler (https://github.com/jimschubert/labeler) -->\n" + comment
+		return s.client.CreateComment(ctx, int(pr.Number), &body)
 	}
 	return nil
 }
+
+// loadConfig reads labeler.yml of the repository, either in the full or the
+// simple format, and its pull request comment.
+func (s *LabelerAction) loadConfig(ctx context.Context) (model.Config, string, error) {
+	data, err := s.client.GetFile(ctx, labelerConfigPath)
+	if err != nil {
+		return nil, "", err
+	}
+
+	full := &model.FullConfig{}
+	if err := full.FromBytes(data); err == nil {
+		comment := ""
+		if full.Comments != nil && full.Comments.PullRequests != nil {
+			comment = *full.Comments.PullRequests
+		}
+		return full, comment, nil
+	}
+	simple := &model.SimpleConfig{}
+	if err := simple.FromBytes(data); err != nil {
+		return nil, "", fmt.Errorf("could not parse %v: %w", labelerConfigPath, err)
+	}
+	return simple, simple.Comment, nil
+}
@@ -0,0 +1,85 @@
+// Copyright 2020-2021 The Datafuse Authors.
+//
+// SPDX-License-Identifier: Apache-2.0.
+
+package actions
+
+import (
+	"bots/common/githubtest"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/go-playground/webhooks/v6/github"
+)
+
+const testLabelerConfig = `
+comments:
+  prs: Thanks, labels applied.
+labels:
+  pr-feature:
+    include: ['\bfeat\b']
+  pr-bugfix:
+    include: ['\bfix\b']
+  pr-doc:
+    include: ['\bdocs\b']
+`
+
+func labelEvent(t *testing.T, action string, title string, labels ...string) github.PullRequestPayload {
+	var existing []map[string]interface{}
+	for _, label := range labels {
+		existing = append(existing, map[string]interface{}{"name": label})
+	}
+	var event github.PullRequestPayload
+	payload(t, &event, map[string]interface{}{
+		"action": action,
+		"number": 5,
+		"pull_request": map[string]interface{}{
+			"number": 5,
+			"title":  title,
+			"body":   "fix the docs",
+			"labels": existing,
+			"head":   map[string]interface{}{"sha": "a1"},
+		},
+	})
+	return event
+}
+
+func TestLabelerAction(t *testing.T) {
+	repo := githubtest.NewRepo()
+	repo.Contents[".github/labeler.yml"] = testLabelerConfig
+	action := NewLabelerAction(testConfig(), testStore(), repo)
+
+	for i := 0; i < 2; i++ {
+		if err := action.DoAction(context.Background(), labelEvent(t, "opened", "feat: labels", "pr-doc")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The existing label is kept, the others are added once per head.
+	if !equalStrings(repo.Labels[5], "pr-bugfix", "pr-feature") {
+		t.Errorf("labels of #5: %v", repo.Labels[5])
+	}
+	if len(repo.Comments[5]) != 1 || !strings.HasSuffix(repo.Comments[5][0], "\nThanks, labels applied.") {
+		t.Errorf("comments of #5: %v", repo.Comments[5])
+	}
+
+	// An edit is labeled again, without a comment when nothing is added.
+	if err := action.DoAction(context.Background(), labelEvent(t, "edited", "feat: labels", "pr-bugfix", "pr-doc", "pr-feature")); err != nil {
+		t.Fatal(err)
+	}
+	if repo.Calls["AddLabelToIssue"] != 2 || len(repo.Comments[5]) != 1 {
+		t.Errorf("labels of #5 added %v times, comments: %v", repo.Calls["AddLabelToIssue"], repo.Comments[5])
+	}
+}
+
+func TestLabelerActionMissingConfig(t *testing.T) {
+	repo := githubtest.NewRepo()
+	action := NewLabelerAction(testConfig(), testStore(), repo)
+
+	if err := action.DoAction(context.Background(), labelEvent(t, "opened", "feat: labels")); err == nil {
+		t.Error("labeled without labeler.yml")
+	}
+	if len(repo.Labels[5]) != 0 {
+		t.Errorf("labels of #5: %v", repo.Labels[5])
+	}
+}
@@ -6,152 +6,591 @@
 package actions
 
 import (
+	"bots/audit"
 	"bots/common"
 	"bots/config"
+	"bots/logging"
+	"bots/metrics"
+	"bots/policy"
+	"bots/store"
+	"context"
+	"errors"
 	"fmt"
+	"strings"
+	"sync"
+	"time"
 
+	gh "github.com/go-playground/webhooks/v6/github"
 	"github.com/google/go-github/v35/github"
 	"github.com/robfig/cron/v3"
 	log "github.com/sirupsen/logrus"
 )
 
+const (
+	mergeQueueContext = "Merge queue"
+)
+
 type AutoMergeAction struct {
-	cfg    *config.Config
-	cron   *cron.Cron
-	client *common.Client
+	cfg       *config.Config
+	cron      *cron.Cron
+	client    common.GitHubAPI
+	decisions *store.Decisions
+	policy    *policy.Engine
+	queue     *MergeQueue
+	required  requiredChecksCache
+	// Serializes the cron runs, the queue is processed one step at a time.
+	mu sync.Mutex
+	// ctx of the cron runs, cancelled by Stop.
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
-func NewAutoMergeAction(cfg *config.Config) *AutoMergeAction {
-	client := common.NewClient(cfg)
+func NewAutoMergeAction(cfg *config.Config, st store.Store, client common.GitHubAPI) *AutoMergeAction {
+	engine, err := policy.New(cfg)
+	if err != nil {
+		log.Fatalf("Can not load merge policy:%+v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
 	return &AutoMergeAction{
-		cfg:    cfg,
-		cron:   cron.New(),
-		client: client,
+		cfg:       cfg,
+		cron:      cron.New(),
+		client:    client,
+		decisions: store.NewDecisions(st, cfg.Github.FullName()),
+		policy:    engine,
+		queue:     NewMergeQueue(st, cfg.Github.FullName()),
+		ctx:       ctx,
+		cancel:    cancel,
 	}
 }
 
+// autoMergeCron is the slow reconciliation sweep over all the open pull
+// requests, the webhook events drive the merges in between.
 func (s *AutoMergeAction) autoMergeCron() {
-	prs, err := s.client.PullRequestList()
+	ctx := logging.With(s.ctx, log.Fields{
+		"repo": s.cfg.Github.FullName(),
+		"cron": "auto-merge",
+		"run":  logging.NewRunID(),
+	})
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer metrics.CronLastRun.WithLabelValues(s.cfg.Github.FullName(), "auto-merge").SetToCurrentTime()
+
+	// The sweep over every open pull request only catches missed events,
+	// leave the budget to the webhooks when it runs low.
+	if limit := s.client.RateLimit(); limit.Low() {
+		logging.From(ctx).Warnf("Github rate limit low, %d requests left until %v, defer the merge check sweep", limit.Remaining(), limit.Reset())
+		if err := s.processQueue(ctx, make(checkReports)); err != nil {
+			logging.From(ctx).Errorf("Merge queue error:%+v", err)
+		}
+		return
+	}
+
+	prs, err := s.client.PullRequestList(ctx)
 	if err != nil {
-		log.Errorf("List open pull requests error:%v", err)
+		logging.From(ctx).Errorf("List open pull requests error:%v", err)
 	}
 
+	reports := make(checkReports)
 	for _, pr := range prs {
-		approveCount, err := s.shouldMergePR(pr)
+		if err := s.checkPR(logging.With(ctx, log.Fields{"number": pr.GetNumber()}), pr, reports); err != nil {
+			logging.From(ctx).Errorf("Check should merge pr error:%v", err)
+		}
+	}
+
+	if err := s.processQueue(ctx, reports); err != nil {
+		logging.From(ctx).Errorf("Merge queue error:%+v", err)
+	}
+}
+
+// checkPR queues the pull request once it is approved and its CI passed.
+func (s *AutoMergeAction) checkPR(ctx context.Context, pr *github.PullRequest, reports checkReports) error {
+	entry, err := s.queue.Get(pr.GetNumber())
+	if err != nil {
+		return err
+	}
+	if entry != nil && entry.Updating {
+		// The head is checked once the update landed.
+		return nil
+	}
+	decision, err := s.shouldMergePR(ctx, pr, entry.UpdatedFrom(pr.GetHead().GetSHA()), reports)
+	if err != nil || decision == nil {
+		return err
+	}
+
+	ci_passed_comments := fmt.Sprintf("CI Passed\nReviewers Approved\nLet's Merge\nThank you for the PR @%s", *pr.User.Login)
+	number := pr.GetNumber()
+	sha := pr.GetHead().GetSHA()
+	ctx = audit.WithRule(ctx, fmt.Sprintf("%v, %v approvals, CI passed", s.policy.RuleFor(pr.GetBase().GetRef()), decision.Approvals))
+	if !decision.Approved {
+		logging.From(ctx).Infof("PR:%+v not approved: %v", number, decision.Pending)
+		// Only tell once the reviews started.
+		if decision.Approvals > 0 {
+			return s.commentOnce(ctx, number, "approve", sha, strings.Join(decision.Pending, "\n"))
+		}
+		return nil
+	}
+
+	// Check is approved.
+	if err := s.commentOnce(ctx, number, "ci-passed", sha, ci_passed_comments); err != nil {
+		return err
+	}
+	return s.enqueue(ctx, number, sha)
+}
+
+func (s *AutoMergeAction) enqueue(ctx context.Context, number int, sha string) error {
+	// A head evicted untilPush waits for a new push.
+	evicted, err := s.decisions.Done(store.Evicted, number, "", sha)
+	if err != nil || evicted {
+		return err
+	}
+	position, added, err := s.queue.Add(number, sha)
+	if err != nil {
+		return err
+	}
+	if added {
+		logging.From(ctx).Infof("PR:%+v added to the merge queue at %v", number, position)
+	}
+	return nil
+}
+
+// processQueue advances the head of the queue by one step and reports the
+// positions of the others. A head leaving the queue lets the next one advance
+// at once, no event may come for it.
+func (s *AutoMergeAction) processQueue(ctx context.Context, reports checkReports) error {
+	var entries []*MergeQueueEntry
+	for {
+		head, err := s.queue.Entries()
+		if err != nil || len(head) == 0 {
+			return err
+		}
+		if err := s.advance(ctx, head[0], reports); err != nil {
+			return err
+		}
+		entries, err = s.queue.Entries()
 		if err != nil {
-			log.Errorf("Check should merge pr error:%v", err)
+			return err
+		}
+		if len(entries) == 0 || entries[0].Number == head[0].Number {
+			break
+		}
+	}
+
+	for i := 1; i < len(entries); i++ {
+		entry := entries[i]
+		if entry.Position == i+1 {
 			continue
 		}
+		entry.Position = i + 1
+		ctx := audit.WithRule(logging.With(ctx, log.Fields{"number": entry.Number}), fmt.Sprintf("merge queue order, %d ahead", i))
+		s.status(ctx, entry.SHA, state_pending, fmt.Sprintf("Position %d in the merge queue", entry.Position))
+		if err := s.queue.Update(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-		approve_comments := "Wait for another reviewer approval"
-		ci_passed_comments := fmt.Sprintf("CI Passed\nReviewers Approved\nLet's Merge\nThank you for the PR @%s", *pr.User.Login)
-		switch approveCount {
-		case -1, 0:
+// advance brings the head of the queue up to date with the base branch,
+// waits for its CI and merges it, evicting it on failure.
+func (s *AutoMergeAction) advance(ctx context.Context, head *MergeQueueEntry, reports checkReports) error {
+	number := head.Number
+	// The statuses carry no number, the audit takes it from ctx.
+	ctx = logging.With(ctx, log.Fields{"number": number})
+	pr, err := s.client.GetPullRequest(ctx, number)
+	if err != nil {
+		return err
+	}
+	if pr.GetState() != "open" {
+		logging.From(ctx).Infof("PR:%+v closed, leaves the merge queue", number)
+		return s.queue.Remove(number)
+	}
+	if pr.GetDraft() {
+		return s.evict(ctx, head, pr.GetHead().GetSHA(), "it is a draft again", untilReady)
+	}
+	if pr.GetMergeableState() == "dirty" {
+		return s.evict(ctx, head, pr.GetHead().GetSHA(), "it conflicts with the base branch", untilPush)
+	}
 
-		case 1:
-			// Check has approved comment.
-			lastComment, err := s.client.GetLastComment(pr.GetNumber())
-			if err != nil {
-				log.Errorf("Get last comments error:%+v", err)
-				continue
+	sha := pr.GetHead().GetSHA()
+	timeout := s.policy.RuleFor(pr.GetBase().GetRef()).Config().MergeQueueTimeout
+	if head.Updating && head.SHA == sha {
+		if waitedOut(head, timeout) {
+			return s.evict(ctx, head, sha, fmt.Sprintf("its update with the base branch did not land within %v", timeout), untilPush)
+		}
+		logging.From(ctx).Infof("PR:%+v waits for the update of its head", number)
+		return nil
+	}
+	if head.Updating || head.SHA != sha {
+		// A push of the author needs new approvals, the queue's update not.
+		updated := false
+		if head.Updating {
+			if updated, err = s.isQueueUpdate(ctx, head, sha); err != nil {
+				return err
 			}
-			if lastComment != nil && (*lastComment.Body == approve_comments) {
-				log.Warn("PR:%+v has 1 proved", pr.GetNumber())
-			} else {
-				s.client.CreateComment(pr.GetNumber(), &approve_comments)
+		}
+		if !updated {
+			if head.ApprovedSHA != "" {
+				logging.From(ctx).Warnf("PR:%+v head %v is not the merge queue update, its approvals are stale", number, sha)
 			}
-		default:
-			// Check is approved.
-			lastComment, err := s.client.GetLastComment(pr.GetNumber())
-			if err != nil {
-				log.Errorf("Get last comments error:%+v", err)
-				continue
+			head.ApprovedSHA = ""
+		}
+		head.Updating = false
+		head.UpdateBase = ""
+		head.SHA = sha
+		head.Position = 0
+		head.WaitSince = time.Now().UTC()
+		if err := s.queue.Update(head); err != nil {
+			return err
+		}
+	}
+	behind, err := s.client.CommitsBehind(ctx, pr.GetBase().GetRef(), sha)
+	if err != nil {
+		return err
+	}
+	if behind > 0 {
+		logging.From(ctx).Infof("PR:%+v is %v commits behind, update it", number, behind)
+		ctx := audit.WithRule(ctx, fmt.Sprintf("merge queue head %v commits behind", behind))
+		if err := s.client.PullRequestUpdateBranch(ctx, number, sha); err != nil {
+			if common.IsTemporary(err) {
+				return err
 			}
-			log.Infof("%v last comments: %v", pr.GetNumber(), lastComment)
+			return s.evict(ctx, head, sha, fmt.Sprintf("updating with the base branch failed: %v", err), untilPush)
+		}
+		head.Updating = true
+		head.UpdateBase = pr.GetBase().GetSHA()
+		if head.ApprovedSHA == "" {
+			head.ApprovedSHA = sha
+		}
+		head.SHA = sha
+		head.WaitSince = time.Now().UTC()
+		s.status(ctx, sha, state_pending, "Updating with the base branch")
+		return s.queue.Update(head)
+	}
 
-			if lastComment != nil && (*lastComment.Body == ci_passed_comments) {
-				log.Warn("PR:%+v has proved", pr.GetNumber())
-			} else {
-				s.client.CreateComment(pr.GetNumber(), &ci_passed_comments)
+	report, err := s.checkReport(ctx, reports, pr.GetBase().GetRef(), sha)
+	if err != nil {
+		return err
+	}
+	switch report.State {
+	case ciPending:
+		logging.From(ctx).Infof("PR:%+v first in the merge queue, %v", number, report.Summary())
+		if waitedOut(head, timeout) {
+			return s.evict(ctx, head, sha, fmt.Sprintf("CI still %v after %v", report.Summary(), timeout), untilReady)
+		}
+		if head.Position != 1 || head.WaitSince.IsZero() {
+			if head.Position != 1 {
+				ctx := audit.WithRule(ctx, "merge queue head, CI "+report.Summary())
+				s.status(ctx, sha, state_pending, "First in the merge queue, "+report.Summary())
 			}
-
-			log.Warn("PR:%+v try to merge", pr.GetNumber())
-			if err := s.client.PullRequestMerge(pr.GetNumber(), ""); err != nil {
-				log.Errorf("Do merge error:%+v", err)
+			head.Position = 1
+			if head.WaitSince.IsZero() {
+				head.WaitSince = time.Now().UTC()
 			}
-			log.Warn("PR:%+v merge send", pr.GetNumber())
+			return s.queue.Update(head)
+		}
+		return nil
+	case ciFailure:
+		return s.evict(ctx, head, sha, "CI "+report.Summary()+" on the updated head", untilReady)
+	}
+
+	decision, err := s.shouldMergePR(ctx, pr, head.ApprovedSHA, reports)
+	if err != nil {
+		return err
+	}
+	if decision == nil || !decision.Approved {
+		return s.evict(ctx, head, sha, "it is no longer approved", untilReady)
+	}
+
+	rule := s.policy.RuleFor(pr.GetBase().GetRef())
+	var labels []string
+	for _, l := range pr.Labels {
+		labels = append(labels, l.GetName())
+	}
+	method := rule.MergeMethod(labels)
+	var title, message string
+	if method == policy.MergeMethodSquash {
+		title, message = rule.SquashMessage(number, pr.GetTitle(), pr.GetBody())
+	}
+
+	ctx = audit.WithRule(ctx, fmt.Sprintf("%v, %v approvals, %v", rule, decision.Approvals, report.Summary()))
+	logging.From(ctx).Warnf("PR:%+v try to %v", number, method)
+	if err := s.client.PullRequestMerge(ctx, number, sha, method, title, message); err != nil {
+		if common.IsTemporary(err) {
+			return err
 		}
+		return s.evict(ctx, head, sha, fmt.Sprintf("merge failed: %v", err), untilPush)
+	}
+	if !s.cfg.Github.DryRun {
+		metrics.Merges.WithLabelValues(s.cfg.Github.FullName()).Inc()
 	}
+	if err := s.decisions.Record(store.Merged, number, "", sha); err != nil {
+		logging.From(ctx).Errorf("Record merge decision error:%+v", err)
+	}
+	s.status(ctx, sha, state_success, "Merged")
+	logging.From(ctx).Warnf("PR:%+v merge send", number)
+	return s.queue.Remove(number)
+}
+
+// isQueueUpdate tells whether sha is the merge of the base head into the head
+// the queue updated, rather than a push landing during the update.
+func (s *AutoMergeAction) isQueueUpdate(ctx context.Context, head *MergeQueueEntry, sha string) (bool, error) {
+	if head.UpdateBase == "" {
+		return false, nil
+	}
+	parents, err := s.client.CommitParents(ctx, sha)
+	if err != nil {
+		return false, err
+	}
+	return len(parents) == 2 && parents[0] == head.SHA && parents[1] == head.UpdateBase, nil
+}
+
+// waitedOut tells whether the head waits for its update or CI for longer than
+// the timeout.
+func waitedOut(head *MergeQueueEntry, timeout time.Duration) bool {
+	return timeout > 0 && !head.WaitSince.IsZero() && time.Since(head.WaitSince) > timeout
+}
+
+// Whether an evicted head may be queued again.
+const (
+	// untilReady queues it again once its CI and approvals pass, as they no
+	// longer did.
+	untilReady = false
+	// untilPush waits for a new head, the same one would fail again.
+	untilPush = true
+)
+
+func (s *AutoMergeAction) evict(ctx context.Context, entry *MergeQueueEntry, sha string, reason string, push bool) error {
+	logging.From(ctx).Warnf("PR:%+v evicted from the merge queue: %v", entry.Number, reason)
+	ctx = audit.WithRule(ctx, "merge queue eviction: "+reason)
+	if err := s.queue.Remove(entry.Number); err != nil {
+		return err
+	}
+	next := "It will be queued again once it is ready."
+	if push == untilPush {
+		if err := s.decisions.Record(store.Evicted, entry.Number, "", sha); err != nil {
+			return err
+		}
+		next = "It will be queued again after a new push."
+	}
+	s.status(ctx, sha, state_error, "Removed from the merge queue")
+	comment := fmt.Sprintf("Removed from the merge queue: %s.\n%s", reason, next)
+	return s.client.CreateComment(ctx, entry.Number, &comment)
+}
+
+// status reports the merge queue state of the head.
+func (s *AutoMergeAction) status(ctx context.Context, sha string, state string, desc string) {
+	// GitHub limits the description to 140 characters.
+	if len(desc) > 140 {
+		desc = desc[:137] + "..."
+	}
+	if err := s.client.CreateStatus(ctx, sha, mergeQueueContext, desc, state, ""); err != nil {
+		logging.From(ctx).Errorf("Merge queue status error:%+v", err)
+	}
+}
+
+// checkReports memoizes the CI reports by sha for one event or sweep.
+type checkReports map[string]*CheckReport
+
+// checkReport combines the check runs and statuses of the sha with the
+// required checks of the base branch.
+func (s *AutoMergeAction) checkReport(ctx context.Context, reports checkReports, base string, sha string) (*CheckReport, error) {
+	if report, ok := reports[sha]; ok {
+		return report, nil
+	}
+	required, err := s.required.get(base, func(branch string) ([]string, error) {
+		return s.client.RequiredStatusChecks(ctx, branch)
+	})
+	if err != nil {
+		return nil, err
+	}
+	runs, err := s.client.ListCheckRunsForRef(ctx, sha)
+	if err != nil {
+		return nil, err
+	}
+	statuses, err := s.client.ListStatusesForRef(ctx, sha)
+	if err != nil {
+		return nil, err
+	}
+	report := summarizeChecks(runs, statuses, required, mergeQueueContext)
+	reports[sha] = report
+	return report, nil
+}
+
+// commentOnce comments on the pr unless the same comment was already made for
+// this head.
+func (s *AutoMergeAction) commentOnce(ctx context.Context, number int, what string, sha string, comment string) error {
+	done, err := s.decisions.Done(store.Commented, number, what, sha)
+	if err != nil {
+		return err
+	}
+	if done {
+		logging.From(ctx).Infof("PR:%+v %v already commented", number, what)
+		return nil
+	}
+	if err := s.client.CreateComment(ctx, number, &comment); err != nil {
+		return err
+	}
+	return s.decisions.Record(store.Commented, number, what, sha)
+}
+
+func (s *AutoMergeAction) Name() string {
+	return "auto-merge"
+}
+
+// HandlesBotEvents is true, the approvals, labels and statuses of the bot
+// move the merge forward too.
+func (s *AutoMergeAction) HandlesBotEvents() bool {
+	return true
 }
 
 func (s *AutoMergeAction) Start() {
 	s.cron.AddFunc(s.cfg.MergeCheckCron, s.autoMergeCron)
 	s.cron.Start()
-	log.Infof("AutoMerge action start:%v...", s.cfg.MergeCheckCron)
+	log.WithField("repo", s.cfg.Github.FullName()).Infof("AutoMerge action start:%v...", s.cfg.MergeCheckCron)
 }
 
-func (s *AutoMergeAction) Stop() {
-	s.cron.Stop()
+// Stop waits for a running merge check, cancelled at the ctx deadline.
+func (s *AutoMergeAction) Stop(ctx context.Context) {
+	select {
+	case <-s.cron.Stop().Done():
+	case <-ctx.Done():
+		log.WithField("repo", s.cfg.Github.FullName()).Warnf("AutoMerge action stop timeout, cancel the running merge check")
+	}
+	s.cancel()
 }
 
-func (s *AutoMergeAction) shouldMergePR(pr *github.PullRequest) (int, error) {
-	allowedCheckConclusions := map[string]bool{
-		"success": true,
-		"neutral": true,
-		"skipped": true,
+// DoAction re-checks the pull requests affected by a review, CI or pull
+// request event, and advances the merge queue.
+func (s *AutoMergeAction) DoAction(ctx context.Context, event interface{}) error {
+	var numbers []int
+	var sha string
+	switch event := event.(type) {
+	case gh.PullRequestPayload:
+		numbers = append(numbers, int(event.Number))
+	case gh.PullRequestReviewPayload:
+		numbers = append(numbers, int(event.PullRequest.Number))
+	case gh.CheckRunPayload:
+		if event.CheckRun.Status != "completed" {
+			return nil
+		}
+		sha = event.CheckRun.HeadSHA
+		for _, pr := range event.CheckRun.PullRequests {
+			numbers = append(numbers, int(pr.Number))
+		}
+	case gh.CheckSuitePayload:
+		if event.CheckSuite.Status != "completed" {
+			return nil
+		}
+		sha = event.CheckSuite.HeadSHA
+		for _, pr := range event.CheckSuite.PullRequests {
+			numbers = append(numbers, int(pr.Number))
+		}
+	case gh.StatusPayload:
+		// Our own queue statuses must not loop.
+		if event.Context == mergeQueueContext || event.State == "pending" {
+			return nil
+		}
+		sha = event.Sha
+	default:
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var prs []*github.PullRequest
+	if len(numbers) == 0 && sha != "" {
+		// Statuses and fork pull requests checks only carry the sha.
+		found, err := s.client.PullRequestsForCommit(ctx, sha)
+		if err != nil {
+			return err
+		}
+		prs = found
+	}
+	for _, number := range numbers {
+		pr, err := s.client.GetPullRequest(ctx, number)
+		if err != nil {
+			return err
+		}
+		prs = append(prs, pr)
 	}
 
+	reports := make(checkReports)
+	for _, pr := range prs {
+		if pr.GetState() != "open" {
+			continue
+		}
+		if err := s.checkPR(ctx, pr, reports); err != nil {
+			return err
+		}
+	}
+	return s.processQueue(ctx, reports)
+}
+
+// shouldMergePR evaluates the merge policy, nil when the pr is not a merge
+// candidate at all. The approvals of updatedFrom count when the merge queue
+// updated it into the head.
+func (s *AutoMergeAction) shouldMergePR(ctx context.Context, pr *github.PullRequest, updatedFrom string, reports checkReports) (*policy.Decision, error) {
 	if pr.GetMerged() {
-		log.Infof("%v merged...", pr.GetNumber())
-		return -1, nil
+		logging.From(ctx).Infof("%v merged...", pr.GetNumber())
+		return nil, nil
 	}
 
 	// Draft.
 	if pr.GetDraft() {
-		log.Infof("%v in draft...", pr.GetNumber())
-		return -1, nil
+		logging.From(ctx).Infof("%v in draft...", pr.GetNumber())
+		return nil, nil
 	}
 
-	checkRuns, err := s.client.ListCheckRunsForRef(pr.GetHead().GetSHA())
+	report, err := s.checkReport(ctx, reports, pr.GetBase().GetRef(), pr.GetHead().GetSHA())
 	if err != nil {
-		return -1, err
+		return nil, err
 	}
-
-	for _, s := range checkRuns.CheckRuns {
-		if !allowedCheckConclusions[s.GetConclusion()] {
-			log.Infof("Check run:%v, status:%s, %v", pr.GetTitle(), s.GetName(), s.GetConclusion())
-			return -1, nil
-		}
+	if report.State != ciSuccess {
+		logging.From(ctx).Infof("%v checks %v...", pr.GetNumber(), report.Summary())
+		return nil, nil
 	}
 
-	reviews, err := s.client.PullRequestListReviews(pr.GetNumber())
+	reviews, err := s.client.PullRequestListReviews(ctx, pr.GetNumber())
 	if err != nil {
-		return -1, err
+		return nil, err
 	}
 
-	approveCount := 0
-	for _, review := range reviews {
-		if review.GetState() == "APPROVED" {
-			approveCount++
-		}
+	input := &policy.PullRequest{
+		Number:      pr.GetNumber(),
+		Base:        pr.GetBase().GetRef(),
+		HeadSHA:     pr.GetHead().GetSHA(),
+		UpdatedFrom: updatedFrom,
+		Reviews:     reviews,
+	}
+	for _, l := range pr.Labels {
+		input.Labels = append(input.Labels, l.GetName())
+	}
+	for _, u := range pr.RequestedReviewers {
+		input.RequestedReviewers = append(input.RequestedReviewers, u.GetLogin())
 	}
 
-	if approveCount == 2 {
-		for _, l := range pr.Labels {
-			if *l.Name == "need-review" {
-				s.client.RemoveLabelFromIssue(pr.GetNumber(), *l.Name)
-			}
+	rule := s.policy.RuleFor(input.Base)
+	if rule.NeedsFiles() {
+		if input.Files, err = s.client.PullRequestListFiles(ctx, pr.GetNumber()); err != nil {
+			return nil, err
 		}
 	}
+	decision, err := rule.Evaluate(ctx, input, s.client)
+	if err != nil {
+		return nil, err
+	}
 
-	// if bot approve twice, check label
-	if approveCount == 1 {
+	if decision.Approved {
+		ctx := audit.WithRule(ctx, fmt.Sprintf("%v, %v approvals", rule, decision.Approvals))
 		for _, l := range pr.Labels {
-			if *l.Name == "lgtm2" {
-				approveCount = 2
+			if *l.Name == "need-review" {
+				if err := s.client.RemoveLabelFromIssue(ctx, pr.GetNumber(), *l.Name); err != nil && !errors.Is(err, common.ErrNotFound) {
+					return nil, err
+				}
 			}
 		}
 	}
 
-	return approveCount, nil
+	return decision, nil
 }
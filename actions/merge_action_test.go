@@ -0,0 +1,415 @@
+// Copyright 2020-2021 The Datafuse Authors.
+//
+// SPDX-License-Identifier: Apache-2.0.
+
+package actions
+
+import (
+	"bots/common"
+	"bots/common/githubtest"
+	"bots/logging"
+	"bots/store"
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-playground/webhooks/v6/github"
+)
+
+func reviewEvent(t *testing.T, number int) github.PullRequestReviewPayload {
+	var event github.PullRequestReviewPayload
+	payload(t, &event, map[string]interface{}{
+		"action":       "submitted",
+		"pull_request": map[string]interface{}{"number": number},
+	})
+	return event
+}
+
+func checkRunEvent(t *testing.T, sha string) github.CheckRunPayload {
+	var event github.CheckRunPayload
+	payload(t, &event, map[string]interface{}{
+		"action":    "completed",
+		"check_run": map[string]interface{}{"status": "completed", "head_sha": sha},
+	})
+	return event
+}
+
+// readyPR adds a pull request passing its CI with two approvals.
+func readyPR(repo *githubtest.Repo, number int, sha string) {
+	repo.AddPullRequest(number, "alice", "main", sha)
+	repo.AddCheckRun(sha, "build", "success")
+	repo.AddReview(number, "bob", "APPROVED", sha)
+	repo.AddReview(number, "carol", "APPROVED", sha)
+}
+
+func TestAutoMergeMergesReadyPR(t *testing.T) {
+	repo := githubtest.NewRepo()
+	readyPR(repo, 1, "a1")
+	st := testStore()
+	action := NewAutoMergeAction(testConfig(), st, repo)
+
+	if err := action.DoAction(context.Background(), reviewEvent(t, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	if repo.MergeMethods[1] != "merge" {
+		t.Fatalf("#1 not merged: %v", repo.MergeMethods)
+	}
+	// The CI report is fetched once for the queue check and the merge.
+	if calls := repo.Calls["ListCheckRunsForRef"]; calls != 1 {
+		t.Errorf("check runs fetched %v times", calls)
+	}
+	if status := repo.LastStatus("a1", mergeQueueContext); status.GetState() != state_success {
+		t.Errorf("merge queue status: %v", status)
+	}
+	if len(repo.Comments[1]) != 1 || !strings.HasPrefix(repo.Comments[1][0], "CI Passed") {
+		t.Errorf("comments of #1: %v", repo.Comments[1])
+	}
+	merged, err := store.NewDecisions(st, testRepo).Done(store.Merged, 1, "", "a1")
+	if err != nil || !merged {
+		t.Errorf("merge decision: %v, %v", merged, err)
+	}
+	entries, _ := action.queue.Entries()
+	if len(entries) != 0 {
+		t.Errorf("queue: %v", entries)
+	}
+}
+
+func TestAutoMergeWaitsForApprovals(t *testing.T) {
+	repo := githubtest.NewRepo()
+	repo.AddPullRequest(1, "alice", "main", "a1")
+	repo.AddCheckRun("a1", "build", "success")
+	repo.AddReview(1, "bob", "APPROVED", "a1")
+	action := NewAutoMergeAction(testConfig(), testStore(), repo)
+
+	for i := 0; i < 2; i++ {
+		if err := action.DoAction(context.Background(), reviewEvent(t, 1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, ok := repo.MergeMethods[1]; ok {
+		t.Fatal("#1 merged without the approvals")
+	}
+	if !equalStrings(repo.Comments[1], "Wait for 1 more reviewer approval") {
+		t.Errorf("comments of #1: %v", repo.Comments[1])
+	}
+}
+
+func TestAutoMergeSquashLabel(t *testing.T) {
+	repo := githubtest.NewRepo()
+	readyPR(repo, 1, "a1")
+	repo.Labels[1] = []string{"merge-squash"}
+	action := NewAutoMergeAction(testConfig(), testStore(), repo)
+
+	if err := action.DoAction(context.Background(), reviewEvent(t, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if repo.MergeMethods[1] != "squash" {
+		t.Errorf("merge method of #1: %v", repo.MergeMethods[1])
+	}
+}
+
+func TestAutoMergeUpdatesBehindHead(t *testing.T) {
+	repo := githubtest.NewRepo()
+	readyPR(repo, 1, "a1")
+	repo.Behind["a1"] = 2
+	action := NewAutoMergeAction(testConfig(), testStore(), repo)
+
+	if err := action.DoAction(context.Background(), reviewEvent(t, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := repo.MergeMethods[1]; ok {
+		t.Fatal("#1 merged while behind its base")
+	}
+	if head := repo.PullRequests[1].GetHead().GetSHA(); head != "a1-updated" {
+		t.Fatalf("head of #1 not updated: %v", head)
+	}
+
+	// The CI of the updated head passes.
+	repo.AddCheckRun("a1-updated", "build", "success")
+	if err := action.DoAction(context.Background(), checkRunEvent(t, "a1-updated")); err != nil {
+		t.Fatal(err)
+	}
+	if repo.MergeMethods[1] != "merge" {
+		t.Errorf("#1 not merged after the update: %v", repo.MergeMethods)
+	}
+}
+
+func TestAutoMergeEvictsUnmergeable(t *testing.T) {
+	repo := githubtest.NewRepo()
+	readyPR(repo, 1, "a1")
+	repo.Errors["PullRequestMerge"] = &common.APIError{
+		Op:         "merge pull request",
+		StatusCode: http.StatusMethodNotAllowed,
+		Kind:       common.ErrUnmergeable,
+		Err:        errors.New("not mergeable"),
+	}
+	action := NewAutoMergeAction(testConfig(), testStore(), repo)
+
+	for i := 0; i < 2; i++ {
+		if err := action.DoAction(context.Background(), reviewEvent(t, 1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, _ := action.queue.Entries()
+	if len(entries) != 0 {
+		t.Errorf("queue: %v", entries)
+	}
+	if status := repo.LastStatus("a1", mergeQueueContext); status.GetState() != state_error {
+		t.Errorf("merge queue status: %v", status)
+	}
+	// The evicted head is not queued again.
+	var evictions int
+	for _, comment := range repo.Comments[1] {
+		if strings.HasPrefix(comment, "Removed from the merge queue") {
+			evictions++
+		}
+	}
+	if evictions != 1 {
+		t.Errorf("comments of #1: %v", repo.Comments[1])
+	}
+}
+
+func TestAutoMergeKeepsQueuedOnTemporaryError(t *testing.T) {
+	repo := githubtest.NewRepo()
+	readyPR(repo, 1, "a1")
+	repo.Errors["PullRequestMerge"] = &common.APIError{
+		Op:         "merge pull request",
+		StatusCode: http.StatusBadGateway,
+		Err:        errors.New("bad gateway"),
+	}
+	action := NewAutoMergeAction(testConfig(), testStore(), repo)
+
+	if err := action.DoAction(context.Background(), reviewEvent(t, 1)); err == nil {
+		t.Fatal("expected the merge error")
+	}
+	entries, _ := action.queue.Entries()
+	if len(entries) != 1 || entries[0].Number != 1 {
+		t.Fatalf("queue: %v", entries)
+	}
+
+	delete(repo.Errors, "PullRequestMerge")
+	if err := action.DoAction(context.Background(), reviewEvent(t, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if repo.MergeMethods[1] != "merge" {
+		t.Errorf("#1 not merged on retry: %v", repo.MergeMethods)
+	}
+}
+
+func TestAutoMergeUpdateKeepsApprovals(t *testing.T) {
+	repo := githubtest.NewRepo()
+	readyPR(repo, 1, "a1")
+	repo.Behind["a1"] = 2
+	cfg := testConfig()
+	cfg.Rule.DismissStaleApprovals = true
+	action := NewAutoMergeAction(cfg, testStore(), repo)
+
+	if err := action.DoAction(context.Background(), reviewEvent(t, 1)); err != nil {
+		t.Fatal(err)
+	}
+	// The approvals of a1 count for the head the queue updated it into.
+	repo.AddCheckRun("a1-updated", "build", "success")
+	if err := action.DoAction(context.Background(), checkRunEvent(t, "a1-updated")); err != nil {
+		t.Fatal(err)
+	}
+	if repo.MergeMethods[1] != "merge" {
+		t.Fatalf("#1 not merged after the update: %v, comments %v", repo.MergeMethods, repo.Comments[1])
+	}
+
+	// A push of the author after the queue's update needs new approvals.
+	readyPR(repo, 2, "b1")
+	repo.PullRequests[2].Head.SHA = &[]string{"b2"}[0]
+	repo.AddCheckRun("b2", "build", "success")
+	if _, _, err := action.queue.Add(2, "b1-updated"); err != nil {
+		t.Fatal(err)
+	}
+	if err := action.queue.Update(&MergeQueueEntry{Number: 2, SHA: "b1-updated", ApprovedSHA: "b1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := action.DoAction(context.Background(), checkRunEvent(t, "b2")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := repo.MergeMethods[2]; ok {
+		t.Fatal("#2 merged without the approvals of its new head")
+	}
+	if !equalStrings(repo.Comments[2], "Removed from the merge queue: it is no longer approved.\nIt will be queued again once it is ready.") {
+		t.Errorf("comments of #2: %v", repo.Comments[2])
+	}
+}
+
+func TestAutoMergePushDuringUpdate(t *testing.T) {
+	tests := []struct {
+		name    string
+		parents []string
+	}{
+		{name: "push", parents: []string{"a1"}},
+		{name: "merge of another base", parents: []string{"a1", "feature-head"}},
+		{name: "merge of the update", parents: []string{"a1-updated", "main-head"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			repo := githubtest.NewRepo()
+			readyPR(repo, 1, "a1")
+			repo.Behind["a1"] = 2
+			cfg := testConfig()
+			cfg.Rule.DismissStaleApprovals = true
+			action := NewAutoMergeAction(cfg, testStore(), repo)
+
+			if err := action.DoAction(context.Background(), reviewEvent(t, 1)); err != nil {
+				t.Fatal(err)
+			}
+			entry, err := action.queue.Get(1)
+			if err != nil || entry == nil || !entry.Updating {
+				t.Fatalf("entry of #1: %+v, %v", entry, err)
+			}
+
+			// Another head than the update lands while the entry is updating.
+			repo.PullRequests[1].Head.SHA = &[]string{"a2"}[0]
+			repo.Parents["a2"] = test.parents
+			repo.AddCheckRun("a2", "build", "success")
+			if err := action.DoAction(context.Background(), checkRunEvent(t, "a2")); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := repo.MergeMethods[1]; ok {
+				t.Fatal("#1 merged with the approvals of a1")
+			}
+			if len(repo.Comments[1]) != 2 || !strings.HasPrefix(repo.Comments[1][1], "Removed from the merge queue: it is no longer approved.") {
+				t.Errorf("comments of #1: %v", repo.Comments[1])
+			}
+		})
+	}
+}
+
+func TestAutoMergeEvictsWaitingHead(t *testing.T) {
+	tests := []struct {
+		name string
+		// stuck makes the update never land, or the CI of the updated head
+		// never finish.
+		stuck  func(repo *githubtest.Repo)
+		reason string
+		// requeued tells whether the head is queued again once its CI passes.
+		requeued bool
+	}{
+		{
+			name:   "update",
+			stuck:  func(repo *githubtest.Repo) { repo.PullRequests[1].Head.SHA = &[]string{"a1"}[0] },
+			reason: "its update with the base branch did not land within 1h0m0s.\nIt will be queued again after a new push.",
+		},
+		{
+			name: "ci",
+			stuck: func(repo *githubtest.Repo) {
+				repo.AddCheckRun("a1-updated", "build", "")
+				repo.CheckRuns["a1-updated"][0].Status = &[]string{"in_progress"}[0]
+			},
+			reason:   "CI still waiting for build after 1h0m0s.\nIt will be queued again once it is ready.",
+			requeued: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := githubtest.NewRepo()
+			readyPR(repo, 1, "a1")
+			readyPR(repo, 2, "b1")
+			repo.Behind["a1"] = 2
+			action := NewAutoMergeAction(testConfig(), testStore(), repo)
+
+			if err := action.DoAction(context.Background(), reviewEvent(t, 1)); err != nil {
+				t.Fatal(err)
+			}
+			tt.stuck(repo)
+			if err := action.DoAction(context.Background(), reviewEvent(t, 2)); err != nil {
+				t.Fatal(err)
+			}
+			head, err := action.queue.Get(1)
+			if err != nil || head == nil || head.WaitSince.IsZero() {
+				t.Fatalf("head: %+v, %v", head, err)
+			}
+
+			head.WaitSince = head.WaitSince.Add(-2 * time.Hour)
+			if err := action.queue.Update(head); err != nil {
+				t.Fatal(err)
+			}
+			if err := action.DoAction(context.Background(), reviewEvent(t, 1)); err != nil {
+				t.Fatal(err)
+			}
+			comment := "Removed from the merge queue: " + tt.reason
+			if comments := repo.Comments[1]; len(comments) == 0 || comments[len(comments)-1] != comment {
+				t.Errorf("comments of #1: %v", comments)
+			}
+			// The next one does not wait for another event.
+			if repo.MergeMethods[2] != "merge" {
+				t.Errorf("#2 not merged after the eviction: %v", repo.MergeMethods)
+			}
+
+			// The CI of the head finally passes.
+			sha := repo.PullRequests[1].GetHead().GetSHA()
+			repo.CheckRuns[sha] = nil
+			repo.AddCheckRun(sha, "build", "success")
+			if err := action.DoAction(context.Background(), checkRunEvent(t, sha)); err != nil {
+				t.Fatal(err)
+			}
+			if _, merged := repo.MergeMethods[1]; merged != tt.requeued {
+				t.Errorf("#1 merged %v after its CI passed: %v", merged, repo.Comments[1])
+			}
+		})
+	}
+}
+
+// numberedStatuses records the number of ctx of every status, which the audit
+// entries of the statuses take.
+type numberedStatuses struct {
+	*githubtest.Repo
+	numbers map[string][]interface{}
+}
+
+func (r *numberedStatuses) CreateStatus(ctx context.Context, sha string, title string, desc string, state string, target_url string) error {
+	r.numbers[sha] = append(r.numbers[sha], logging.Fields(ctx)["number"])
+	return r.Repo.CreateStatus(ctx, sha, title, desc, state, target_url)
+}
+
+func TestAutoMergeAdvancesNextHead(t *testing.T) {
+	repo := githubtest.NewRepo()
+	statuses := &numberedStatuses{Repo: repo, numbers: make(map[string][]interface{})}
+	readyPR(repo, 1, "a1")
+	readyPR(repo, 2, "b1")
+	readyPR(repo, 3, "c1")
+	repo.Behind["a1"] = 1
+	repo.AddCheckRun("a1-updated", "build", "")
+	repo.CheckRuns["a1-updated"][0].Status = &[]string{"in_progress"}[0]
+	action := NewAutoMergeAction(testConfig(), testStore(), statuses)
+
+	for _, number := range []int{1, 2, 3} {
+		if err := action.DoAction(context.Background(), reviewEvent(t, number)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// #1 waits for the CI of its update, the others for #1.
+	if len(repo.MergeMethods) != 0 {
+		t.Fatalf("merged: %v", repo.MergeMethods)
+	}
+
+	// One check run of the updated head merges the whole queue.
+	repo.CheckRuns["a1-updated"][0].Status = &[]string{"completed"}[0]
+	repo.CheckRuns["a1-updated"][0].Conclusion = &[]string{"success"}[0]
+	if err := action.DoAction(context.Background(), checkRunEvent(t, "a1-updated")); err != nil {
+		t.Fatal(err)
+	}
+	if len(repo.MergeMethods) != 3 {
+		t.Errorf("merged: %v", repo.MergeMethods)
+	}
+	// The statuses of every queued pull request carry its own number.
+	for sha, number := range map[string]int{"a1-updated": 1, "b1": 2, "c1": 3} {
+		for _, n := range statuses.numbers[sha] {
+			if n != number {
+				t.Errorf("statuses of %v: numbers %v", sha, statuses.numbers[sha])
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2020-2021 The Datafuse Authors.
+//
+// SPDX-License-Identifier: Apache-2.0.
+
+package actions
+
+import (
+	"bots/store"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+)
+
+const mergeQueueBucket = "merge-queue"
+
+// MergeQueueEntry is a ready pull request waiting for its turn to merge.
+type MergeQueueEntry struct {
+	Number int `json:"number"`
+	// SHA is the head the entry was last checked or updated at.
+	SHA      string    `json:"sha"`
+	Updating bool      `json:"updating"`
+	Added    time.Time `json:"added"`
+	// ApprovedSHA is the head before the queue updated it with the base
+	// branch, the approvals of it still count for SHA.
+	ApprovedSHA string `json:"approved_sha,omitempty"`
+	// UpdateBase is the base head merged by the pending update, the new head
+	// must be the merge of SHA and it.
+	UpdateBase string `json:"update_base,omitempty"`
+	// Position is the last one reported to the pull request.
+	Position int `json:"position"`
+	// WaitSince is when the head started to wait for its update or its CI.
+	WaitSince time.Time `json:"wait_since,omitempty"`
+}
+
+// MergeQueue is the persisted, ordered merge queue of a repository.
+type MergeQueue struct {
+	mu    sync.Mutex
+	store store.Store
+	key   string
+}
+
+func NewMergeQueue(st store.Store, repo string) *MergeQueue {
+	return &MergeQueue{
+		store: st,
+		key:   strings.ToLower(repo),
+	}
+}
+
+func (q *MergeQueue) Entries() ([]*MergeQueueEntry, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.load()
+}
+
+func (q *MergeQueue) load() ([]*MergeQueueEntry, error) {
+	value, err := q.store.Get(mergeQueueBucket, q.key)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	var entries []*MergeQueueEntry
+	if err := json.Unmarshal(value, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (q *MergeQueue) save(entries []*MergeQueueEntry) error {
+	value, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	return q.store.Put(mergeQueueBucket, q.key, value)
+}
+
+// Add appends the pull request, returns its 1-based position and whether it
+// was newly added. A queued pull request gets its new head, if any.
+func (q *MergeQueue) Add(number int, sha string) (int, bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	entries, err := q.load()
+	if err != nil {
+		return 0, false, err
+	}
+	for i, entry := range entries {
+		if entry.Number == number {
+			if entry.SHA != sha && !entry.Updating {
+				entry.SHA = sha
+				entry.ApprovedSHA = ""
+				entry.Position = 0
+				return i + 1, false, q.save(entries)
+			}
+			return i + 1, false, nil
+		}
+	}
+	entries = append(entries, &MergeQueueEntry{
+		Number: number,
+		SHA:    sha,
+		Added:  time.Now().UTC(),
+	})
+	return len(entries), true, q.save(entries)
+}
+
+// Get returns the entry of the pull request, nil when it is not queued.
+func (q *MergeQueue) Get(number int) (*MergeQueueEntry, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	entries, err := q.load()
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.Number == number {
+			return entry, nil
+		}
+	}
+	return nil, nil
+}
+
+// UpdatedFrom returns the approved head the queue updated into sha, "" when
+// sha is not the checked result of the queue's own update.
+func (e *MergeQueueEntry) UpdatedFrom(sha string) string {
+	if e == nil || e.Updating || e.SHA != sha {
+		return ""
+	}
+	return e.ApprovedSHA
+}
+
+// Update replaces the entry of the same number.
+func (q *MergeQueue) Update(entry *MergeQueueEntry) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	entries, err := q.load()
+	if err != nil {
+		return err
+	}
+	for i, e := range entries {
+		if e.Number == entry.Number {
+			entries[i] = entry
+			return q.save(entries)
+		}
+	}
+	return nil
+}
+
+func (q *MergeQueue) Remove(number int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	entries, err := q.load()
+	if err != nil {
+		return err
+	}
+	for i, e := range entries {
+		if e.Number == number {
+			return q.save(append(entries[:i], entries[i+1:]...))
+		}
+	}
+	return nil
+}
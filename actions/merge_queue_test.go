@@ -0,0 +1,42 @@
+// Copyright 2020-2021 The Datafuse Authors.
+//
+// SPDX-License-Identifier: Apache-2.0.
+
+package actions
+
+import (
+	"testing"
+)
+
+func TestMergeQueue(t *testing.T) {
+	st := testStore()
+	q := NewMergeQueue(st, testRepo)
+
+	for i, number := range []int{3, 1, 2} {
+		position, added, err := q.Add(number, "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if position != i+1 || !added {
+			t.Errorf("add #%v: position %v, added %v", number, position, added)
+		}
+	}
+
+	// A queued pull request keeps its position and gets its new head.
+	position, added, err := q.Add(1, "b")
+	if err != nil || position != 2 || added {
+		t.Errorf("re-add #1: position %v, added %v, error %v", position, added, err)
+	}
+	if err := q.Remove(3); err != nil {
+		t.Fatal(err)
+	}
+
+	// The queue is persisted in the store.
+	entries, err := NewMergeQueue(st, testRepo).Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Number != 1 || entries[0].SHA != "b" || entries[1].Number != 2 {
+		t.Errorf("entries: %+v, %+v", entries[0], entries[1])
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright 2020-2021 The Datafuse Authors.
+//
+// SPDX-License-Identifier: Apache-2.0.
+
+package actions
+
+import (
+	"bots/common"
+	"bots/config"
+	"context"
+	"fmt"
+	"strings"
+)
+
+// roleRanks orders the repository roles, each includes the lower ones.
+var roleRanks = map[string]int{
+	"none":                    0,
+	"read":                    1,
+	config.PermissionTriage:   2,
+	config.PermissionWrite:    3,
+	config.PermissionMaintain: 4,
+	config.PermissionAdmin:    5,
+}
+
+// hasPermission tells whether user meets the command permission level on the
+// issue or pull request of author.
+func hasPermission(ctx context.Context, client common.GitHubAPI, level string, user string, author string) (bool, error) {
+	switch {
+	case level == config.PermissionAnyone:
+		return true, nil
+	case strings.HasPrefix(level, config.PermissionTeam):
+		team := strings.SplitN(strings.TrimPrefix(level, config.PermissionTeam), "/", 2)
+		return client.IsTeamMember(ctx, team[0], team[1], user)
+	case level == config.PermissionAuthor:
+		if strings.EqualFold(user, author) {
+			return true, nil
+		}
+		level = config.PermissionWrite
+	}
+	role, err := client.CollaboratorPermission(ctx, user)
+	if err != nil {
+		return false, err
+	}
+	return roleRanks[role] >= roleRanks[level], nil
+}
+
+// describePermission words the level for the denial comment.
+func describePermission(level string) string {
+	switch {
+	case level == config.PermissionAuthor:
+		return "to be its author or to have write access"
+	case strings.HasPrefix(level, config.PermissionTeam):
+		return "to be a member of the " + strings.TrimPrefix(level, config.PermissionTeam) + " team"
+	}
+	return fmt.Sprintf("to have the %v role on this repository", level)
+}
@@ -6,8 +6,12 @@
 package actions
 
 import (
+	"bots/audit"
 	"bots/common"
 	"bots/config"
+	"bots/logging"
+	"bots/store"
+	"context"
 	"fmt"
 	"regexp"
 	"strings"
@@ -23,39 +27,62 @@ const (
 	state_success = "success"
 )
 
-// inmemory state
-var (
-	reviewerChecked sync.Map
-)
-
 type PullRequestCheckAction struct {
-	cfg    *config.Config
-	client *common.Client
+	cfg       *config.Config
+	client    common.GitHubAPI
+	decisions *store.Decisions
+	// The description checks running in the background, on ctx rather than
+	// the event ctx so they still report once the queue stopped.
+	wg     sync.WaitGroup
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
-func NewPullRequestCheckAction(cfg *config.Config) *PullRequestCheckAction {
-	client := common.NewClient(cfg)
+func NewPullRequestCheckAction(cfg *config.Config, st store.Store, client common.GitHubAPI) *PullRequestCheckAction {
+	ctx, cancel := context.WithCancel(context.Background())
+
 	return &PullRequestCheckAction{
-		cfg:    cfg,
-		client: client,
+		cfg:       cfg,
+		client:    client,
+		decisions: store.NewDecisions(st, cfg.Github.FullName()),
+		ctx:       ctx,
+		cancel:    cancel,
 	}
 }
 
+func (s *PullRequestCheckAction) Name() string {
+	return "pull-request-check"
+}
+
 func (s *PullRequestCheckAction) Start() {
+	log.WithField("repo", s.cfg.Github.FullName()).Infof("Pull request check action start...")
 }
 
-func (s *PullRequestCheckAction) Stop() {
+// Stop waits for the description checks, cancelled at the ctx deadline.
+func (s *PullRequestCheckAction) Stop(ctx context.Context) {
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.WithField("repo", s.cfg.Github.FullName()).Warnf("Pull request check action stop timeout, cancel the running checks")
+	}
+	s.cancel()
 }
 
-func (s *PullRequestCheckAction) DoAction(event interface{}) error {
+func (s *PullRequestCheckAction) DoAction(ctx context.Context, event interface{}) error {
 	switch event := event.(type) {
 	case github.PullRequestPayload:
-		log.Infof("Pull request check: %+v coming", event.Number)
+		logging.From(ctx).Infof("Pull request check: %+v coming", event.Number)
 		user := event.PullRequest.User.Login
 
 		action := strings.ToLower(event.Action)
 		if action == "opened" || action == "reopened" {
-			if err := s.client.AddLabelToIssue(int(event.Number), "need-review"); err != nil {
+			ctx := audit.WithRule(ctx, "pull request "+action+", needs review")
+			if err := s.client.AddLabelToIssue(ctx, int(event.Number), "need-review"); err != nil {
 				return err
 			}
 		}
@@ -65,26 +92,31 @@ func (s *PullRequestCheckAction) DoAction(event interface{}) error {
 			return nil
 		}
 
-		if err := s.descriptionCheck(event); err != nil {
-			log.Errorf("Desciption check error: %+v ", err)
+		if err := s.descriptionCheck(ctx, event); err != nil {
+			logging.From(ctx).Errorf("Desciption check error: %+v ", err)
 		}
 
-		if err := s.reviewerCheck(event); err != nil {
-			log.Errorf("Reviewer check error: %+v ", err)
+		// The request is recorded once it succeeded, the queue retries the rest.
+		if err := s.reviewerCheck(ctx, event); err != nil {
+			return fmt.Errorf("reviewer check: %w", err)
 		}
 
 	}
 	return nil
 }
 
-func (s *PullRequestCheckAction) descriptionCheck(payload github.PullRequestPayload) error {
+func (s *PullRequestCheckAction) descriptionCheck(ctx context.Context, payload github.PullRequestPayload) error {
 	pr := payload.PullRequest
 	sha := pr.Head.Sha
+	// The event ctx ends with the queue, keep only its log fields.
+	ctx = audit.WithRule(logging.With(s.ctx, logging.Fields(ctx)), "pr_description_action checks")
 
+	s.wg.Add(1)
 	go func() {
-		log.Infof("Pull request desc check: %+v coming", pr.Number)
-		if err := s.client.CreateStatus(sha, s.cfg.PRDescriptionAction.Title, s.cfg.PRDescriptionAction.PendingDesc, state_pending, s.cfg.PRDescriptionAction.TargetUrl); err != nil {
-			log.Errorf("Desciption check status create error: %+v ", err)
+		defer s.wg.Done()
+		logging.From(ctx).Infof("Pull request desc check: %+v coming", pr.Number)
+		if err := s.client.CreateStatus(ctx, sha, s.cfg.PRDescriptionAction.Title, s.cfg.PRDescriptionAction.PendingDesc, state_pending, s.cfg.PRDescriptionAction.TargetUrl); err != nil {
+			logging.From(ctx).Errorf("Desciption check status create error: %+v ", err)
 			return
 		}
 
@@ -98,16 +130,16 @@ func (s *PullRequestCheckAction) descriptionCheck(payload github.PullRequestPayl
 			}
 		}
 
-		log.Infof("Pull request desc check: %+v ", check)
+		logging.From(ctx).Infof("Pull request desc check: %+v ", check)
 		if !check {
-			if err := s.client.CreateStatus(sha, s.cfg.PRDescriptionAction.Title, s.cfg.PRDescriptionAction.ErrorDesc, state_error, s.cfg.PRDescriptionAction.TargetUrl); err != nil {
-				log.Errorf("Desciption check status create error: %+v ", err)
+			if err := s.client.CreateStatus(ctx, sha, s.cfg.PRDescriptionAction.Title, s.cfg.PRDescriptionAction.ErrorDesc, state_error, s.cfg.PRDescriptionAction.TargetUrl); err != nil {
+				logging.From(ctx).Errorf("Desciption check status create error: %+v ", err)
 				return
 			}
 
 		} else {
-			if err := s.client.CreateStatus(sha, s.cfg.PRDescriptionAction.Title, s.cfg.PRDescriptionAction.SuccessDesc, state_success, s.cfg.PRDescriptionAction.TargetUrl); err != nil {
-				log.Errorf("Desciption check status create error: %+v ", err)
+			if err := s.client.CreateStatus(ctx, sha, s.cfg.PRDescriptionAction.Title, s.cfg.PRDescriptionAction.SuccessDesc, state_success, s.cfg.PRDescriptionAction.TargetUrl); err != nil {
+				logging.From(ctx).Errorf("Desciption check status create error: %+v ", err)
 				return
 			}
 		}
@@ -127,26 +159,37 @@ func (s *PullRequestCheckAction) allowList(user string) bool {
 
 }
 
-func (s *PullRequestCheckAction) reviewerCheck(payload github.PullRequestPayload) error {
+func (s *PullRequestCheckAction) reviewerCheck(ctx context.Context, payload github.PullRequestPayload) error {
 	pr := payload.PullRequest
+	number := int(pr.Number)
 	// Pr need reviewer.
-	if !pr.Draft && *pr.Mergeable {
-		if _, loaded := reviewerChecked.LoadOrStore(pr.ID, true); !loaded {
-			reviewers, err := s.client.PullRequestListReviewers(int(pr.Number))
-			if err != nil {
+	if !pr.Draft && pr.Mergeable != nil && *pr.Mergeable {
+		done, err := s.decisions.Done(store.Requested, number, "reviewer", "")
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+
+		reviewers, err := s.client.PullRequestListReviewers(ctx, number)
+		if err != nil {
+			return err
+		}
+		if len(reviewers.Users) == 0 {
+			ctx := audit.WithRule(ctx, "mergeable pull request without reviewers")
+			if err = s.client.PullRequestRequestReviewer(ctx, number, "BohuTANG"); err != nil {
 				return err
+
 			}
-			if len(reviewers.Users) == 0 {
-				if err = s.client.PullRequestRequestReviewer(int(pr.ID), "BohuTANG"); err != nil {
+			if s.cfg.Hints.PRNeedReviewComment != "" {
+				comments := fmt.Sprintf(s.cfg.Hints.PRNeedReviewComment, pr.User.Login)
+				if err := s.client.CreateComment(ctx, number, &comments); err != nil {
 					return err
-
-				}
-				if s.cfg.Hints.PRNeedReviewComment != "" {
-					comments := fmt.Sprintf(s.cfg.Hints.PRNeedReviewComment, pr.User.Login)
-					s.client.CreateComment(int(pr.Number), &comments)
 				}
 			}
 		}
+		return s.decisions.Record(store.Requested, number, "reviewer", "")
 	}
 
 	return nil
@@ -0,0 +1,115 @@
+// Copyright 2020-2021 The Datafuse Authors.
+//
+// SPDX-License-Identifier: Apache-2.0.
+
+package actions
+
+import (
+	"bots/common/githubtest"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/go-playground/webhooks/v6/github"
+)
+
+func pullRequestEvent(t *testing.T, action string, number int, user string, sha string, body string) github.PullRequestPayload {
+	var event github.PullRequestPayload
+	payload(t, &event, map[string]interface{}{
+		"action": action,
+		"number": number,
+		"pull_request": map[string]interface{}{
+			"number":    number,
+			"body":      body,
+			"mergeable": true,
+			"user":      map[string]interface{}{"login": user},
+			"head":      map[string]interface{}{"sha": sha},
+		},
+	})
+	return event
+}
+
+func TestPullRequestCheckOpened(t *testing.T) {
+	repo := githubtest.NewRepo()
+	cfg := testConfig()
+	cfg.PRDescriptionAction.Checks = []string{"## Summary"}
+	action := NewPullRequestCheckAction(cfg, testStore(), repo)
+
+	event := pullRequestEvent(t, "opened", 5, "alice", "a1", "no summary")
+	for i := 0; i < 2; i++ {
+		if err := action.DoAction(context.Background(), event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !equalStrings(repo.Labels[5], "need-review") {
+		t.Errorf("labels of #5: %v", repo.Labels[5])
+	}
+	// The reviewer is only requested once.
+	if !equalStrings(repo.RequestedReviewers[5], "BohuTANG") {
+		t.Errorf("reviewers of #5: %v", repo.RequestedReviewers[5])
+	}
+	if !equalStrings(repo.Comments[5], "Hi @alice, a reviewer is on the way") {
+		t.Errorf("comments of #5: %v", repo.Comments[5])
+	}
+	waitFor(t, func() bool {
+		status := repo.LastStatus("a1", "Description check")
+		return status != nil && status.GetState() == state_error
+	})
+}
+
+func TestPullRequestCheckReviewerError(t *testing.T) {
+	repo := githubtest.NewRepo()
+	action := NewPullRequestCheckAction(testConfig(), testStore(), repo)
+	event := pullRequestEvent(t, "opened", 5, "alice", "a1", "## Summary")
+
+	// A failed request is returned for the queue to retry.
+	repo.Errors["PullRequestRequestReviewer"] = errors.New("server error")
+	if err := action.DoAction(context.Background(), event); err == nil {
+		t.Fatal("reviewer error not returned")
+	}
+	delete(repo.Errors, "PullRequestRequestReviewer")
+	if err := action.DoAction(context.Background(), event); err != nil {
+		t.Fatal(err)
+	}
+	if !equalStrings(repo.RequestedReviewers[5], "BohuTANG") {
+		t.Errorf("reviewers of #5: %v", repo.RequestedReviewers[5])
+	}
+	if !equalStrings(repo.Comments[5], "Hi @alice, a reviewer is on the way") {
+		t.Errorf("comments of #5: %v", repo.Comments[5])
+	}
+	action.Stop(context.Background())
+}
+
+func TestPullRequestCheckAllowList(t *testing.T) {
+	repo := githubtest.NewRepo()
+	cfg := testConfig()
+	cfg.PRDescriptionAction.AllowList = []string{"^dependabot"}
+	action := NewPullRequestCheckAction(cfg, testStore(), repo)
+
+	if err := action.DoAction(context.Background(), pullRequestEvent(t, "opened", 5, "dependabot[bot]", "a1", "")); err != nil {
+		t.Fatal(err)
+	}
+	if len(repo.RequestedReviewers[5]) != 0 || len(repo.Statuses["a1"]) != 0 {
+		t.Errorf("allow listed #5 checked: %v, %v", repo.RequestedReviewers[5], repo.Statuses["a1"])
+	}
+}
+
+func TestPullRequestCheckStop(t *testing.T) {
+	repo := githubtest.NewRepo()
+	cfg := testConfig()
+	cfg.PRDescriptionAction.Checks = []string{"## Summary"}
+	action := NewPullRequestCheckAction(cfg, testStore(), repo)
+
+	// The queue cancels the event ctx before the actions are stopped.
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := action.DoAction(ctx, pullRequestEvent(t, "opened", 5, "alice", "a1", "## Summary")); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	action.Stop(context.Background())
+
+	if status := repo.LastStatus("a1", "Description check"); status == nil || status.GetState() != state_success {
+		t.Errorf("status of a1: %v", status)
+	}
+}
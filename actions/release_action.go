@@ -6,9 +6,13 @@
 package actions
 
 import (
+	"bots/audit"
 	"bots/common"
 	"bots/config"
+	"bots/logging"
+	"bots/metrics"
 	"bytes"
+	"context"
 	"fmt"
 	"text/template"
 	"time"
@@ -25,28 +29,43 @@ const (
 type ReleaseAction struct {
 	cfg    *config.Config
 	cron   *cron.Cron
-	client *common.Client
+	client common.GitHubAPI
 	yml    *config.ReleaseConfig
+	// ctx of the cron runs, cancelled by Stop.
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
-func NewReleaseAction(cfg *config.Config) *ReleaseAction {
-	client := common.NewClient(cfg)
+func NewReleaseAction(cfg *config.Config, client common.GitHubAPI) *ReleaseAction {
 	yml := config.NewReleaseConfig(".github/release.yml")
+	ctx, cancel := context.WithCancel(context.Background())
 
 	return &ReleaseAction{
 		cfg:    cfg,
 		cron:   cron.New(),
 		client: client,
 		yml:    yml,
+		ctx:    ctx,
+		cancel: cancel,
 	}
 }
 
 func (s *ReleaseAction) nightReleaseCron() {
-	if err := s.releaseHandle("patch", true); err != nil {
-		log.Errorf("build release log error:%+v", err)
+	defer metrics.CronLastRun.WithLabelValues(s.cfg.Github.FullName(), "nightly-release").SetToCurrentTime()
+	ctx := logging.With(s.ctx, log.Fields{
+		"repo": s.cfg.Github.FullName(),
+		"cron": "nightly-release",
+		"run":  logging.NewRunID(),
+	})
+	if err := s.releaseHandle(ctx, "patch", true); err != nil {
+		logging.From(ctx).Errorf("build release log error:%+v", err)
 	}
 }
 
+func (s *ReleaseAction) Name() string {
+	return "release"
+}
+
 func (s *ReleaseAction) Start() {
 	if err := s.yml.Load(); err != nil {
 		log.Panicf("Can not load release yml:%+v", err)
@@ -54,15 +73,25 @@ func (s *ReleaseAction) Start() {
 
 	s.cron.AddFunc(s.cfg.NightReleaseCron, s.nightReleaseCron)
 	s.cron.Start()
-	log.Infof("Release action start...")
+	log.WithField("repo", s.cfg.Github.FullName()).Infof("Release action start...")
 }
 
-func (s *ReleaseAction) Stop() {
-	s.cron.Stop()
+// Stop waits for a running release, cancelled at the ctx deadline.
+func (s *ReleaseAction) Stop(ctx context.Context) {
+	select {
+	case <-s.cron.Stop().Done():
+	case <-ctx.Done():
+		log.WithField("repo", s.cfg.Github.FullName()).Warnf("Release action stop timeout, cancel the running release")
+	}
+	s.cancel()
 }
 
-func (s *ReleaseAction) releaseHandle(typ string, preRelease bool) error {
-	after, currentTag, err := s.getLastPublishedAndCurrentTag()
+func (s *ReleaseAction) DoAction(ctx context.Context, event interface{}) error {
+	return nil
+}
+
+func (s *ReleaseAction) releaseHandle(ctx context.Context, typ string, preRelease bool) error {
+	after, currentTag, err := s.getLastPublishedAndCurrentTag(ctx)
 	if err != nil {
 		return err
 	}
@@ -70,21 +99,22 @@ func (s *ReleaseAction) releaseHandle(typ string, preRelease bool) error {
 	if err != nil {
 		return err
 	}
-	log.Infof("Latest tag:%v, new tag:%v, type:%v", currentTag, newTagName, typ)
+	logging.From(ctx).Infof("Latest tag:%v, new tag:%v, type:%v", currentTag, newTagName, typ)
 
-	prs, err := s.client.GetMergedPullRequestsAfter(s.cfg.Github.BaseBranch, after)
+	prs, err := s.client.GetMergedPullRequestsAfter(ctx, s.cfg.Github.BaseBranch, after)
 	if err != nil {
 		return err
 	}
 
-	log.Infof("prs:%v", len(prs))
-	if len(prs) > 0 {
+	logging.From(ctx).Infof("prs:%v", len(prs))
+	merged := len(prs)
+	if merged > 0 {
 		var labelPr = make(map[string][]*github.PullRequest)
 		for _, pr := range prs {
 			for _, label := range pr.Labels {
 				// Skip the exclude prs.
 				if s.yml.ExcludeCheck(label.GetName()) {
-					log.Infof("Skip the exclude label: %v", label.GetName())
+					logging.From(ctx).Infof("Skip the exclude label: %v", label.GetName())
 					continue
 				}
 
@@ -110,19 +140,23 @@ func (s *ReleaseAction) releaseHandle(typ string, preRelease bool) error {
 			return err
 		}
 
-		log.Infof("prepare release: %v, %v", newTagName, releaseBody)
-		if _, err := s.client.CreateRelease(newTagName, releaseBody, preRelease); err != nil {
+		logging.From(ctx).Infof("prepare release: %v, %v", newTagName, releaseBody)
+		ctx := audit.WithRule(ctx, fmt.Sprintf("%v release after %v, %v merged pull requests", typ, currentTag, merged))
+		if _, err := s.client.CreateRelease(ctx, newTagName, releaseBody, preRelease); err != nil {
 			return err
 		}
-		log.Infof("release: %v done", newTagName)
+		if !s.cfg.Github.DryRun {
+			metrics.Releases.WithLabelValues(s.cfg.Github.FullName()).Inc()
+		}
+		logging.From(ctx).Infof("release: %v done", newTagName)
 	}
 	return nil
 }
 
-func (s *ReleaseAction) getLastPublishedAndCurrentTag() (time.Time, string, error) {
+func (s *ReleaseAction) getLastPublishedAndCurrentTag(ctx context.Context) (time.Time, string, error) {
 	tag := ""
 	after := time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC)
-	release, err := s.client.GetLatestRelease()
+	release, err := s.client.GetLatestRelease(ctx)
 	if err != nil {
 		return after, "", fmt.Errorf("get latest release: %w", err)
 	}
@@ -0,0 +1,71 @@
+// Copyright 2020-2021 The Datafuse Authors.
+//
+// SPDX-License-Identifier: Apache-2.0.
+
+package actions
+
+import (
+	"bots/common/githubtest"
+	"bots/config"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v35/github"
+)
+
+const testReleaseYml = `
+categories:
+  - title: 'Features'
+    labels:
+      - 'pr-feature'
+excludes:
+  - 'pr-not-for-changelog'
+`
+
+func TestReleaseHandle(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "release.yml")
+	if err := ioutil.WriteFile(file, []byte(testReleaseYml), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	repo := githubtest.NewRepo()
+	published := time.Now().Add(-time.Hour)
+	repo.Releases = append(repo.Releases, &github.RepositoryRelease{
+		TagName:     github.String("v0.1.0"),
+		PublishedAt: &github.Timestamp{Time: published},
+	})
+	merged := time.Now()
+	for number, label := range map[int]string{1: "pr-feature", 2: "pr-not-for-changelog"} {
+		pr := repo.AddPullRequest(number, "alice", "main", "a1")
+		pr.State = github.String("closed")
+		pr.MergedAt = &merged
+		repo.Labels[number] = []string{label}
+	}
+
+	action := NewReleaseAction(testConfig(), repo)
+	action.yml = config.NewReleaseConfig(file)
+	if err := action.yml.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if err := action.releaseHandle(context.Background(), "patch", true); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(repo.Releases) != 2 {
+		t.Fatalf("releases: %v", repo.Releases)
+	}
+	release := repo.Releases[1]
+	if release.GetTagName() != "v0.1.1-nightly" || !release.GetPrerelease() {
+		t.Errorf("release: %v", release)
+	}
+	if !strings.Contains(release.GetBody(), "## Features") || !strings.Contains(release.GetBody(), "PR 1 (#1) by @alice") {
+		t.Errorf("release body: %v", release.GetBody())
+	}
+	if strings.Contains(release.GetBody(), "#2") {
+		t.Errorf("excluded pr in the release body: %v", release.GetBody())
+	}
+}
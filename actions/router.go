@@ -0,0 +1,198 @@
+// Copyright 2020-2021 The Datafuse Authors.
+//
+// SPDX-License-Identifier: Apache-2.0.
+
+package actions
+
+import (
+	"bots/audit"
+	"bots/common"
+	"bots/config"
+	"bots/logging"
+	"bots/store"
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/go-playground/webhooks/v6/github"
+	log "github.com/sirupsen/logrus"
+)
+
+// Router owns one action registry per configured repository and routes
+// webhook events by the payload's repository.full_name.
+type Router struct {
+	app        *common.App
+	registries map[string]*Registry
+	// ignored are the lowercased logins whose events are dropped.
+	ignored map[string]bool
+}
+
+// NewRouter creates the actions of every repository, the writes to GitHub are
+// recorded in auditLog when not nil.
+func NewRouter(cfg *config.Config, st store.Store, auditLog *audit.Log) *Router {
+	app, err := common.AppFor(cfg)
+	if err != nil {
+		log.Fatalf("Github app error: %v", err)
+	}
+	r := &Router{
+		app:        app,
+		registries: make(map[string]*Registry),
+		ignored:    make(map[string]bool),
+	}
+	for _, login := range cfg.Webhook.IgnoreSenders {
+		r.ignored[strings.ToLower(strings.TrimSpace(login))] = true
+	}
+	for _, repoCfg := range cfg.Repos {
+		log.Infof("Repo: %v actions register...", repoCfg.Github.FullName())
+		r.registries[strings.ToLower(repoCfg.Github.FullName())] = NewRegistry(repoCfg, st, common.NewClient(repoCfg, auditLog))
+	}
+	return r
+}
+
+func (r *Router) Start() {
+	for _, registry := range r.registries {
+		registry.Start()
+	}
+}
+
+func (r *Router) Stop(ctx context.Context) {
+	for _, registry := range r.registries {
+		registry.Stop(ctx)
+	}
+}
+
+// Check checks the GitHub credentials of every repository.
+func (r *Router) Check(ctx context.Context) error {
+	for repo, registry := range r.registries {
+		if err := registry.client.CheckAuth(ctx); err != nil {
+			return fmt.Errorf("repo %v: %w", repo, err)
+		}
+	}
+	return nil
+}
+
+// Route returns the actions of the event's repository, none when the sender
+// is ignored, and only the BotEventsHandler ones when the sender is the bot.
+func (r *Router) Route(ctx context.Context, event interface{}) ([]Action, error) {
+	repo := PayloadRepository(event)
+	if repo == "" {
+		return nil, fmt.Errorf("unknown repository for event %T", event)
+	}
+	registry, ok := r.registries[strings.ToLower(repo)]
+	if !ok {
+		return nil, fmt.Errorf("repository %v is not configured", repo)
+	}
+	if r.app != nil {
+		r.app.SetInstallation(repo, PayloadInstallation(event))
+	}
+
+	sender := PayloadSender(event)
+	if r.ignored[strings.ToLower(sender)] {
+		logging.From(ctx).Infof("Event of ignored sender %v dropped", sender)
+		return nil, nil
+	}
+	bot, err := registry.client.BotLogin(ctx)
+	if err != nil {
+		logging.From(ctx).Errorf("Bot login lookup error: %v", err)
+		return registry.Actions(), nil
+	}
+	if !strings.EqualFold(sender, bot) {
+		return registry.Actions(), nil
+	}
+	var actions []Action
+	for _, action := range registry.Actions() {
+		if handler, ok := action.(BotEventsHandler); ok && handler.HandlesBotEvents() {
+			actions = append(actions, action)
+		}
+	}
+	return actions, nil
+}
+
+// PayloadRepository returns the repository full name of a webhook payload.
+func PayloadRepository(event interface{}) string {
+	switch event := event.(type) {
+	case github.ReleasePayload:
+		return event.Repository.FullName
+	case github.PullRequestPayload:
+		return event.Repository.FullName
+	case github.IssueCommentPayload:
+		return event.Repository.FullName
+	case github.IssuesPayload:
+		return event.Repository.FullName
+	case github.PullRequestReviewPayload:
+		return event.Repository.FullName
+	case github.CheckRunPayload:
+		return event.Repository.FullName
+	case github.CheckSuitePayload:
+		return event.Repository.FullName
+	case github.StatusPayload:
+		return event.Repository.FullName
+	}
+	return ""
+}
+
+// PayloadSender returns the login of the user whose activity triggered the
+// webhook payload.
+func PayloadSender(event interface{}) string {
+	switch event := event.(type) {
+	case github.ReleasePayload:
+		return event.Sender.Login
+	case github.PullRequestPayload:
+		return event.Sender.Login
+	case github.IssueCommentPayload:
+		return event.Sender.Login
+	case github.IssuesPayload:
+		return event.Sender.Login
+	case github.PullRequestReviewPayload:
+		return event.Sender.Login
+	case github.CheckRunPayload:
+		return event.Sender.Login
+	case github.CheckSuitePayload:
+		return event.Sender.Login
+	case github.StatusPayload:
+		return event.Sender.Login
+	}
+	return ""
+}
+
+// PayloadNumber returns the issue or pull request number of a webhook payload,
+// 0 when the event is not about one.
+func PayloadNumber(event interface{}) int {
+	switch event := event.(type) {
+	case github.PullRequestPayload:
+		return int(event.Number)
+	case github.IssueCommentPayload:
+		return int(event.Issue.Number)
+	case github.IssuesPayload:
+		return int(event.Issue.Number)
+	case github.PullRequestReviewPayload:
+		return int(event.PullRequest.Number)
+	case github.CheckRunPayload:
+		if len(event.CheckRun.PullRequests) == 1 {
+			return int(event.CheckRun.PullRequests[0].Number)
+		}
+	case github.CheckSuitePayload:
+		if len(event.CheckSuite.PullRequests) == 1 {
+			return int(event.CheckSuite.PullRequests[0].Number)
+		}
+	}
+	return 0
+}
+
+// PayloadInstallation returns the GitHub App installation ID of a webhook
+// payload, 0 when the payload does not carry it.
+func PayloadInstallation(event interface{}) int64 {
+	switch event := event.(type) {
+	case github.ReleasePayload:
+		return int64(event.Installation.ID)
+	case github.PullRequestPayload:
+		return event.Installation.ID
+	case github.PullRequestReviewPayload:
+		return event.Installation.ID
+	case github.CheckRunPayload:
+		return int64(event.Installation.ID)
+	case github.CheckSuitePayload:
+		return int64(event.Installation.ID)
+	}
+	return 0
+}
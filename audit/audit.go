@@ -0,0 +1,161 @@
+// Copyright 2020-2021 The Datafuse Authors.
+//
+// SPDX-License-Identifier: Apache-2.0.
+
+// Package audit keeps an append-only JSON lines record of every write
+// fusebots does on GitHub, with the event or cron run and the rule behind it.
+package audit
+
+import (
+	"bots/logging"
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	ResultOK     = "ok"
+	ResultError  = "error"
+	ResultDryRun = "dry_run"
+)
+
+// Entry is one write to GitHub.
+type Entry struct {
+	Time   time.Time              `json:"time"`
+	Repo   string                 `json:"repo"`
+	Number int                    `json:"number,omitempty"`
+	Op     string                 `json:"op"`
+	Args   map[string]interface{} `json:"args,omitempty"`
+	// The webhook event or the cron run which triggered the write.
+	Delivery string `json:"delivery,omitempty"`
+	Event    string `json:"event,omitempty"`
+	Action   string `json:"action,omitempty"`
+	Cron     string `json:"cron,omitempty"`
+	Run      string `json:"run,omitempty"`
+	// Rule is why the write was decided.
+	Rule   string `json:"rule,omitempty"`
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
+
+type ruleKey struct{}
+
+// WithRule returns a ctx whose writes are audited as decided by rule.
+func WithRule(ctx context.Context, rule string) context.Context {
+	return context.WithValue(ctx, ruleKey{}, rule)
+}
+
+// Log appends the entries to a file, a nil Log records nothing.
+type Log struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// Open opens the audit file for appending, an empty path disables the audit.
+func Open(path string) (*Log, error) {
+	if path == "" {
+		return nil, nil
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Log{file: file}, nil
+}
+
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+	return l.file.Close()
+}
+
+// Record appends the entry, completed with the correlation fields of ctx.
+// Failing to write is logged, the write to GitHub happened anyway.
+func (l *Log) Record(ctx context.Context, entry *Entry) {
+	if l == nil {
+		return
+	}
+	entry.Time = time.Now().UTC()
+	fields := logging.Fields(ctx)
+	if entry.Number == 0 {
+		entry.Number, _ = fields["number"].(int)
+	}
+	entry.Delivery, _ = fields["delivery"].(string)
+	entry.Event, _ = fields["event"].(string)
+	entry.Action, _ = fields["action"].(string)
+	entry.Cron, _ = fields["cron"].(string)
+	entry.Run, _ = fields["run"].(string)
+	entry.Rule, _ = ctx.Value(ruleKey{}).(string)
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		logging.From(ctx).Errorf("Audit %v error: %v", entry.Op, err)
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		logging.From(ctx).Errorf("Audit %v error: %v", entry.Op, err)
+	}
+}
+
+// Read returns the entries of the issue or pull request number of repo, oldest
+// first, repo may be empty when the file is about one repository only.
+func Read(path string, repo string, number int) ([]*Entry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []*Entry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// A torn last line of a crash is not worth failing for.
+			log.Warnf("Audit %v line %v error: %v", path, line, err)
+			continue
+		}
+		if entry.Number != number || (repo != "" && !strings.EqualFold(entry.Repo, repo)) {
+			continue
+		}
+		entries = append(entries, &entry)
+	}
+	return entries, scanner.Err()
+}
+
+// String formats the entry as one line for the audit command.
+func (e *Entry) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%v %v %v", e.Time.Format(time.RFC3339), e.Op, e.Result)
+	if e.Error != "" {
+		fmt.Fprintf(&b, " (%v)", e.Error)
+	}
+	for _, kv := range []struct{ k, v string }{
+		{"delivery", e.Delivery},
+		{"event", e.Event},
+		{"action", e.Action},
+		{"cron", e.Cron},
+		{"run", e.Run},
+		{"rule", e.Rule},
+	} {
+		if kv.v != "" {
+			fmt.Fprintf(&b, " %v=%q", kv.k, kv.v)
+		}
+	}
+	if len(e.Args) > 0 {
+		args, _ := json.Marshal(e.Args)
+		fmt.Fprintf(&b, " args=%s", args)
+	}
+	return b.String()
+}
@@ -0,0 +1,68 @@
+// Copyright 2020-2021 The Datafuse Authors.
+//
+// SPDX-License-Identifier: Apache-2.0.
+
+package audit
+
+import (
+	"bots/logging"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestRecordRead(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := logging.With(context.Background(), log.Fields{"delivery": "d1", "event": "issue_comment", "action": "issue", "number": 5})
+	ctx = WithRule(ctx, "comment of @bob: /lgtm")
+	l.Record(ctx, &Entry{Repo: "datafuselabs/databend", Op: "add labels", Args: map[string]interface{}{"label": "lgtm1"}, Result: ResultOK})
+	l.Record(ctx, &Entry{Repo: "datafuselabs/databend", Number: 6, Op: "create comment", Result: ResultOK})
+	l.Record(ctx, &Entry{Repo: "datafuselabs/docs", Op: "add labels", Result: ResultError, Error: "403"})
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A torn line is skipped.
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"time": "2021`)
+	file.Close()
+
+	entries, err := Read(path, "datafuselabs/databend", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("entries: %v", entries)
+	}
+	entry := entries[0]
+	if entry.Op != "add labels" || entry.Delivery != "d1" || entry.Event != "issue_comment" || entry.Action != "issue" ||
+		entry.Rule != "comment of @bob: /lgtm" || entry.Args["label"] != "lgtm1" || entry.Time.IsZero() {
+		t.Errorf("entry: %+v", entry)
+	}
+
+	if entries, _ := Read(path, "", 5); len(entries) != 2 {
+		t.Errorf("entries of #5 in any repo: %v", entries)
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	l, err := Open("")
+	if err != nil || l != nil {
+		t.Fatalf("open: %v, %v", l, err)
+	}
+	l.Record(context.Background(), &Entry{Op: "add labels"})
+	if err := l.Close(); err != nil {
+		t.Error(err)
+	}
+}
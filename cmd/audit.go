@@ -0,0 +1,66 @@
+// Copyright 2020-2021 The Datafuse Authors.
+//
+// SPDX-License-Identifier: Apache-2.0.
+
+package main
+
+import (
+	"bots/audit"
+	"bots/config"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func auditUsage(fs *flag.FlagSet) func() {
+	return func() {
+		fmt.Println("Usage: " + os.Args[0] + " audit -c fusebots.ini --pr <number> [--repo owner/name] [--json]")
+		fs.PrintDefaults()
+	}
+}
+
+// auditHistory prints the writes fusebots did on one issue or pull request.
+func auditHistory(args []string) {
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	cfgFile := fs.String("c", "", "config file")
+	number := fs.Int("pr", 0, "issue or pull request number")
+	repo := fs.String("repo", "", "repository owner/name, needed when several are configured")
+	asJSON := fs.Bool("json", false, "print the raw JSON lines")
+	fs.Usage = auditUsage(fs)
+	fs.Parse(args)
+
+	if *cfgFile == "" || *number <= 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	cfg, err := config.LoadConfig(*cfgFile)
+	if err != nil {
+		log.Fatalf("Load config error: %v", err)
+	}
+	if cfg.Audit.Path == "" {
+		log.Fatalf("No [audit] path in %v", *cfgFile)
+	}
+	if *repo == "" {
+		if len(cfg.Repos) > 1 {
+			log.Fatalf("Several repositories are configured, set --repo")
+		}
+		*repo = cfg.Repos[0].Github.FullName()
+	}
+
+	entries, err := audit.Read(cfg.Audit.Path, *repo, *number)
+	if err != nil {
+		log.Fatalf("Read audit log error: %v", err)
+	}
+	for _, entry := range entries {
+		if *asJSON {
+			line, _ := json.Marshal(entry)
+			fmt.Println(string(line))
+			continue
+		}
+		fmt.Println(entry)
+	}
+}
@@ -6,34 +6,50 @@ package main
 
 import (
 	"bots/actions"
+	"bots/audit"
 	"bots/config"
+	"bots/logging"
+	"bots/server"
+	"bots/store"
+	"context"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 
-	"github.com/go-playground/webhooks/v6/github"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 )
 
-const (
-	path = "/webhooks"
-)
-
 var (
 	flagConfig string
+	flagDryRun bool
 )
 
 func initFlags() {
 	flag.StringVar(&flagConfig, "c", "", "config file")
+	flag.BoolVar(&flagDryRun, "dry-run", false, "log the writes to GitHub instead of doing them")
 }
 
 func usage() {
 	fmt.Println("Usage: " + os.Args[0] + " -c fusebots.ini")
+	fmt.Println("       " + os.Args[0] + " replay -h")
+	fmt.Println("       " + os.Args[0] + " audit -h")
 	flag.PrintDefaults()
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		replay(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "audit" {
+		auditHistory(os.Args[2:])
+		return
+	}
+
 	initFlags()
 	flag.Usage = func() { usage() }
 	flag.Parse()
@@ -45,52 +61,84 @@ func main() {
 
 	cfg, err := config.LoadConfig(flagConfig)
 	if err != nil {
-		log.Fatal("Load config error: %v", err)
+		log.Fatalf("Load config error: %v", err)
 	}
-	log.Infof("Repo: %v/%v webhooks starts... ", cfg.Github.RepoOwner, cfg.Github.RepoName)
-	os.Setenv("GITHUB_TOKEN", cfg.Github.GithubToken)
-
-	// Actions.
-	labelAction := actions.NewLabelerAction(cfg)
-	if !cfg.Disables.DisableLabel {
-		labelAction.Start()
+	if err := logging.Setup(cfg.Log); err != nil {
+		log.Fatalf("Log config error: %v", err)
+	}
+	if flagDryRun {
+		cfg.SetDryRun()
+	}
+	if cfg.Github.DryRun {
+		log.Warnf("Dry run, nothing is written to GitHub")
+	}
+	log.Infof("Repos: %v webhooks starts... ", len(cfg.Repos))
+	for _, repoCfg := range cfg.Repos {
+		log.WithField("repo", repoCfg.Github.FullName()).Infof("Disables conf:%+v", repoCfg.Disables)
 	}
 
-	releaseAction := actions.NewReleaseAction(cfg)
-	releaseAction.Start()
-
-	autoMergeAction := actions.NewAutoMergeAction(cfg)
-	if !cfg.Disables.DisableAutoMerge {
-		autoMergeAction.Start()
+	st, err := store.Open(cfg)
+	if err != nil {
+		log.Fatalf("Open store error: %v", err)
 	}
+	defer st.Close()
 
-	issueAction := actions.NewIssueAction(cfg)
-	issueAction.Start()
+	auditLog, err := audit.Open(cfg.Audit.Path)
+	if err != nil {
+		log.Fatalf("Open audit log error: %v", err)
+	}
+	defer auditLog.Close()
 
-	hook, _ := github.New(github.Options.Secret(cfg.Github.GithubSecret))
-	http.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
-		payload, err := hook.Parse(r, github.ReleaseEvent, github.PullRequestEvent, github.IssueCommentEvent, github.IssuesEvent)
-		if err != nil {
-			if err == github.ErrEventNotFound {
-				log.Errorf("Unhandle github event: %v", err)
-			}
-		}
+	// Actions.
+	router := actions.NewRouter(cfg, st, auditLog)
+	router.Start()
 
-		if labelAction.DoAction(payload) != nil {
-			log.Errorf("Labeling error: %v", err)
+	srv, err := server.New(cfg, router, st)
+	if err != nil {
+		log.Fatalf("Webhooks server error: %v", err)
+	}
+	srv.Start()
+	mux := http.NewServeMux()
+	mux.Handle(cfg.Server.Path, srv)
+	mux.HandleFunc("/healthz", srv.Healthz)
+	mux.HandleFunc("/readyz", srv.Readyz)
+	mux.HandleFunc("/dead-letters", srv.DeadLetters)
+	mux.Handle("/metrics", promhttp.Handler())
+	httpServer, err := server.NewHTTPServer(cfg.Server, mux)
+	if err != nil {
+		log.Fatalf("Webhooks server error: %v", err)
+	}
+	log.Infof("Webhooks listen on %v%v", cfg.Server.Listen, cfg.Server.Path)
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		if err := server.ListenAndServe(httpServer); err != nil && err != http.ErrServerClosed {
+			log.Errorf("Webhooks server error: %v", err)
+			signals <- syscall.SIGTERM
 		}
+	}()
+
+	sig := <-signals
+	log.Infof("Signal %v, shutdown in %v...", sig, cfg.Server.ShutdownTimeout)
+	go func() {
+		<-signals
+		log.Warnf("Second signal, exit now")
+		os.Exit(1)
+	}()
+	shutdown(cfg, httpServer, srv, router)
+	log.Infof("Shutdown done")
+}
 
-		if issueAction.DoAction(payload) != nil {
-			log.Errorf("Issue error: %v", err)
-		}
-	})
+// shutdown stops taking webhooks, then drains the queued events and the
+// running cron jobs, all within the shutdown timeout.
+func shutdown(cfg *config.Config, httpServer *http.Server, srv *server.Server, router *actions.Router) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancel()
 
-	http.ListenAndServe(":3000", nil)
-	if !cfg.Disables.DisableLabel {
-		labelAction.Stop()
-	}
-	releaseAction.Stop()
-	if !cfg.Disables.DisableAutoMerge {
-		autoMergeAction.Stop()
+	if err := httpServer.Shutdown(ctx); err != nil {
+		log.Errorf("Webhooks server shutdown error: %v", err)
 	}
+	srv.Stop(ctx)
+	router.Stop(ctx)
 }
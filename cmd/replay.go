@@ -0,0 +1,111 @@
+// Copyright 2020-2021 The Datafuse Authors.
+//
+// SPDX-License-Identifier: Apache-2.0.
+
+package main
+
+import (
+	"bots/actions"
+	"bots/audit"
+	"bots/config"
+	"bots/logging"
+	"bots/server"
+	"bots/store"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func replayUsage(fs *flag.FlagSet) func() {
+	return func() {
+		fmt.Println("Usage: " + os.Args[0] + " replay -c fusebots.ini --delivery <id>")
+		fmt.Println("       " + os.Args[0] + " replay -c fusebots.ini --file payload.json [--event pull_request]")
+		fs.PrintDefaults()
+	}
+}
+
+// replay re-runs the dispatch pipeline on a persisted delivery, or on a JSON
+// file being either a persisted delivery or a raw payload of --event.
+func replay(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	cfgFile := fs.String("c", "", "config file")
+	delivery := fs.String("delivery", "", "delivery id to replay")
+	file := fs.String("file", "", "delivery or payload JSON file to replay")
+	event := fs.String("event", "", "event type of a raw payload file")
+	dryRun := fs.Bool("dry-run", false, "log the writes to GitHub instead of doing them")
+	fs.Usage = replayUsage(fs)
+	fs.Parse(args)
+
+	if *cfgFile == "" || (*delivery == "") == (*file == "") {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	cfg, err := config.LoadConfig(*cfgFile)
+	if err != nil {
+		log.Fatalf("Load config error: %v", err)
+	}
+	if err := logging.Setup(cfg.Log); err != nil {
+		log.Fatalf("Log config error: %v", err)
+	}
+	if *dryRun {
+		cfg.SetDryRun()
+	}
+
+	// Without the persisted decisions the replay would post the comments
+	// again, a dry run keeps its state in memory.
+	st, err := store.Open(cfg)
+	if err != nil {
+		log.Fatalf("Open store error: %v, is the server running? Stop it or replay with --dry-run", err)
+	}
+	defer st.Close()
+
+	auditLog, err := audit.Open(cfg.Audit.Path)
+	if err != nil {
+		log.Fatalf("Open audit log error: %v", err)
+	}
+	defer auditLog.Close()
+
+	router := actions.NewRouter(cfg, st, auditLog)
+	srv, err := server.New(cfg, router, st)
+	if err != nil {
+		log.Fatalf("Webhooks server error: %v", err)
+	}
+
+	var d *server.Delivery
+	if *delivery != "" {
+		d, err = srv.Deliveries().Get(*delivery)
+	} else {
+		d, err = loadReplayFile(*file, *event)
+	}
+	if err != nil {
+		log.Fatalf("Load delivery error: %v", err)
+	}
+
+	if err := srv.Replay(d); err != nil {
+		log.Fatalf("Replay error: %v", err)
+	}
+	log.Infof("Replay delivery %v done", d.ID)
+}
+
+func loadReplayFile(file string, event string) (*server.Delivery, error) {
+	if event == "" {
+		return server.LoadDelivery(file)
+	}
+	payload, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return &server.Delivery{
+		ID:       "replay-" + strings.TrimSuffix(filepath.Base(file), filepath.Ext(file)),
+		Event:    event,
+		Received: time.Now().UTC(),
+		Payload:  payload,
+	}, nil
+}
@@ -0,0 +1,64 @@
+// Copyright 2020-2021 The Datafuse Authors.
+//
+// SPDX-License-Identifier: Apache-2.0.
+
+package common
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/go-github/v35/github"
+)
+
+// GitHubAPI is everything the actions do on a repository, Client talks to
+// GitHub and githubtest.Repo fakes it in memory.
+type GitHubAPI interface {
+	RateLimit() *RateLimit
+	// BotLogin returns the login the writes are done as.
+	BotLogin(ctx context.Context) (string, error)
+	// CheckAuth checks the credentials can read the repository.
+	CheckAuth(ctx context.Context) error
+
+	CreateComment(ctx context.Context, number int, comment *string) error
+	GetLastComment(ctx context.Context, number int) (*github.IssueComment, error)
+
+	PullRequestMerge(ctx context.Context, number int, sha string, method string, title string, message string) error
+	PullRequestList(ctx context.Context) ([]*github.PullRequest, error)
+	GetPullRequest(ctx context.Context, number int) (*github.PullRequest, error)
+	PullRequestsForCommit(ctx context.Context, sha string) ([]*github.PullRequest, error)
+	GetMergedPullRequestsAfter(ctx context.Context, branch string, after time.Time) ([]*github.PullRequest, error)
+	PullRequestUpdateBranch(ctx context.Context, number int, expectedHeadSHA string) error
+	CommitsBehind(ctx context.Context, base string, head string) (int, error)
+	CommitParents(ctx context.Context, sha string) ([]string, error)
+	PullRequestListFiles(ctx context.Context, number int) ([]string, error)
+
+	PullRequestReview(ctx context.Context, number int, event string) error
+	PullRequestRequestReviewer(ctx context.Context, number int, reviewer string) error
+	PullRequestListReviewers(ctx context.Context, number int) (*github.Reviewers, error)
+	PullRequestListReviews(ctx context.Context, number int) ([]*github.PullRequestReview, error)
+	IsTeamMember(ctx context.Context, org string, team string, user string) (bool, error)
+	CollaboratorPermission(ctx context.Context, user string) (string, error)
+
+	ListCheckRunsForRef(ctx context.Context, ref string) ([]*github.CheckRun, error)
+	ListStatusesForRef(ctx context.Context, ref string) ([]*github.RepoStatus, error)
+	RequiredStatusChecks(ctx context.Context, branch string) ([]string, error)
+	CreateStatus(ctx context.Context, sha string, title string, desc string, state string, target_url string) error
+
+	CreateRelease(ctx context.Context, tagName, body string, preRelease bool) (*github.RepositoryRelease, error)
+	GetLatestRelease(ctx context.Context) (*github.RepositoryRelease, error)
+
+	IssueAssignTo(ctx context.Context, number int, assignee string) error
+	IssuesForFirstTime(ctx context.Context, user string) (bool, error)
+	AddLabelToIssue(ctx context.Context, number int, label string) error
+	ListLabelsForIssue(ctx context.Context, number int) ([]*github.Label, error)
+	CheckLabelExistsForIssue(ctx context.Context, number int, label string) (bool, error)
+	RemoveLabelFromIssue(ctx context.Context, number int, label string) error
+	ReplaceLabelsForIssue(ctx context.Context, number int, labels []string) error
+
+	RepositoriesDispatch(ctx context.Context, event string) error
+	// GetFile returns the content of a file of the default branch.
+	GetFile(ctx context.Context, path string) ([]byte, error)
+}
+
+var _ GitHubAPI = (*Client)(nil)
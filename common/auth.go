@@ -0,0 +1,257 @@
+// Copyright 2020-2021 The Datafuse Authors.
+//
+// SPDX-License-Identifier: Apache-2.0.
+
+package common
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bots/config"
+
+	"github.com/google/go-github/v35/github"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// GitHub rejects app JWTs living longer than 10 minutes.
+	appJWTLifetime = 9 * time.Minute
+	// Installation tokens live one hour, refresh them well before that.
+	installationTokenRefresh = 5 * time.Minute
+)
+
+// App authenticates as a GitHub App and mints installation tokens.
+type App struct {
+	id  int64
+	key *rsa.PrivateKey
+
+	mu            sync.Mutex
+	installations map[int64]oauth2.TokenSource
+	repos         map[string]int64
+	slug          string
+}
+
+var (
+	appsMu sync.Mutex
+	apps   = map[int64]*App{}
+)
+
+// AppFor returns the shared App of the config, nil when the config uses a
+// personal token.
+func AppFor(cfg *config.Config) (*App, error) {
+	if cfg.Github.AppID == 0 {
+		return nil, nil
+	}
+
+	appsMu.Lock()
+	defer appsMu.Unlock()
+	if app, ok := apps[cfg.Github.AppID]; ok {
+		return app, nil
+	}
+	pemBytes, err := ioutil.ReadFile(cfg.Github.AppPrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("read app private key: %w", err)
+	}
+	key, err := parsePrivateKey(pemBytes)
+	if err != nil {
+		return nil, err
+	}
+	app := &App{
+		id:            cfg.Github.AppID,
+		key:           key,
+		installations: make(map[int64]oauth2.TokenSource),
+		repos:         make(map[string]int64),
+	}
+	apps[cfg.Github.AppID] = app
+	return app, nil
+}
+
+func parsePrivateKey(pemBytes []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, fmt.Errorf("app private key is not PEM encoded")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse app private key: %w", err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("app private key is not a RSA key")
+	}
+	return rsaKey, nil
+}
+
+// JWT returns a RS256 signed token authenticating as the app itself.
+func (a *App) JWT() (string, error) {
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		// Allow some clock drift with GitHub.
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(appJWTLifetime).Unix(),
+		"iss": strconv.FormatInt(a.id, 10),
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	hash := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, a.key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", fmt.Errorf("sign app jwt: %w", err)
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// appClient is a github client authenticated by the app JWT, used for the
+// /app endpoints only.
+func (a *App) appClient(cfg *config.Config) *github.Client {
+	return newGithubClient(cfg, &http.Client{Transport: &jwtTransport{app: a}})
+}
+
+type jwtTransport struct {
+	app *App
+}
+
+func (t *jwtTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.app.JWT()
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// Slug returns the slug of the app, its bot login is "<slug>[bot]".
+func (a *App) Slug(ctx context.Context, cfg *config.Config) (string, error) {
+	a.mu.Lock()
+	slug := a.slug
+	a.mu.Unlock()
+	if slug != "" {
+		return slug, nil
+	}
+
+	app, _, err := a.appClient(cfg).Apps.Get(ctx, "")
+	if err != nil {
+		return "", fmt.Errorf("get app: %w", err)
+	}
+	a.mu.Lock()
+	a.slug = app.GetSlug()
+	a.mu.Unlock()
+	return app.GetSlug(), nil
+}
+
+// SetInstallation records the installation of a repository, as seen in the
+// webhook payloads.
+func (a *App) SetInstallation(fullName string, installationID int64) {
+	if installationID == 0 {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.repos[strings.ToLower(fullName)] = installationID
+}
+
+func (a *App) installationID(cfg *config.Config) (int64, error) {
+	fullName := strings.ToLower(cfg.Github.FullName())
+	a.mu.Lock()
+	id, ok := a.repos[fullName]
+	a.mu.Unlock()
+	if ok {
+		return id, nil
+	}
+	if cfg.Github.AppInstallationID != 0 {
+		a.SetInstallation(fullName, cfg.Github.AppInstallationID)
+		return cfg.Github.AppInstallationID, nil
+	}
+
+	client := a.appClient(cfg)
+	ctx, timeout := context.WithTimeout(context.Background(), 10*time.Second)
+	defer timeout()
+	installation, _, err := client.Apps.FindRepositoryInstallation(ctx, cfg.Github.RepoOwner, cfg.Github.RepoName)
+	if err != nil {
+		return 0, fmt.Errorf("find installation of %v: %w", fullName, err)
+	}
+	a.SetInstallation(fullName, installation.GetID())
+	return installation.GetID(), nil
+}
+
+// TokenSource returns the installation token source of the repository of cfg.
+func (a *App) TokenSource(cfg *config.Config) oauth2.TokenSource {
+	return &repoTokenSource{app: a, cfg: cfg}
+}
+
+type repoTokenSource struct {
+	app *App
+	cfg *config.Config
+}
+
+func (s *repoTokenSource) Token() (*oauth2.Token, error) {
+	id, err := s.app.installationID(s.cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	s.app.mu.Lock()
+	ts, ok := s.app.installations[id]
+	if !ok {
+		ts = oauth2.ReuseTokenSource(nil, &installationTokenSource{app: s.app, cfg: s.cfg, id: id})
+		s.app.installations[id] = ts
+	}
+	s.app.mu.Unlock()
+	return ts.Token()
+}
+
+type installationTokenSource struct {
+	app *App
+	cfg *config.Config
+	id  int64
+}
+
+func (s *installationTokenSource) Token() (*oauth2.Token, error) {
+	client := s.app.appClient(s.cfg)
+	ctx, timeout := context.WithTimeout(context.Background(), 10*time.Second)
+	defer timeout()
+	token, _, err := client.Apps.CreateInstallationToken(ctx, s.id, nil)
+	if err != nil {
+		return nil, fmt.Errorf("create installation %v token: %w", s.id, err)
+	}
+	// Expire early so the reuse source refreshes ahead of GitHub.
+	return &oauth2.Token{
+		AccessToken: token.GetToken(),
+		Expiry:      token.GetExpiresAt().Add(-installationTokenRefresh),
+	}, nil
+}
+
+// TokenSource returns the token source for the repository of cfg, either the
+// static personal token or the app installation token.
+func TokenSource(cfg *config.Config) (oauth2.TokenSource, error) {
+	app, err := AppFor(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if app != nil {
+		return app.TokenSource(cfg), nil
+	}
+	return oauth2.StaticTokenSource(&oauth2.Token{
+		AccessToken: cfg.Github.GithubToken,
+	}), nil
+}
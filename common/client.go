@@ -7,59 +7,254 @@ package common
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
 	"time"
 
+	"bots/audit"
 	"bots/config"
+	"bots/logging"
+	"bots/metrics"
 
 	"github.com/google/go-github/v35/github"
+	log "github.com/sirupsen/logrus"
 	"golang.org/x/oauth2"
 )
 
+const (
+	idempotent = true
+	once       = false
+)
+
 type Client struct {
 	cfg    *config.Config
-	ctx    *context.Context
 	client *github.Client
-}
+	budget budgetSource
+	audit  *audit.Log
+	owner  string
+	repo   string
 
-func NewClient(cfg *config.Config) *Client {
-	ctx := context.Background()
+	botMu    sync.Mutex
+	botLogin string
+}
 
-	ts := oauth2.StaticTokenSource(&oauth2.Token{
-		AccessToken: cfg.Github.GithubToken,
+// NewClient creates the client of the repository of cfg, its writes are
+// recorded in the audit log when not nil.
+func NewClient(cfg *config.Config, auditLog *audit.Log) *Client {
+	ts, err := TokenSource(cfg)
+	if err != nil {
+		log.Fatalf("Github auth error: %v", err)
+	}
+	budget := budgetSourceFor(cfg)
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{
+		Transport: &rateLimitTransport{
+			base:   http.DefaultTransport,
+			budget: budget,
+		},
 	})
 	tc := oauth2.NewClient(ctx, ts)
-	client := github.NewClient(tc)
+	client := newGithubClient(cfg, tc)
 
 	return &Client{
 		cfg:    cfg,
-		ctx:    &ctx,
 		client: client,
+		budget: budget,
+		audit:  auditLog,
+		owner:  cfg.Github.RepoOwner,
+		repo:   cfg.Github.RepoName,
 	}
 }
 
-func (s *Client) CreateComment(number int, comment *string) error {
-	ctx, timeout := context.WithTimeout(*s.ctx, 10*time.Second)
-	defer timeout()
+// newGithubClient talks to api_url when set, e.g. a GitHub Enterprise
+// https://github.example.com/api/v3/, and to api.github.com otherwise.
+func newGithubClient(cfg *config.Config, httpClient *http.Client) *github.Client {
+	client := github.NewClient(httpClient)
+	if apiURL := cfg.Github.APIURL; apiURL != "" {
+		if !strings.HasSuffix(apiURL, "/") {
+			apiURL += "/"
+		}
+		baseURL, err := url.Parse(apiURL)
+		if err != nil {
+			log.Fatalf("Github api url error: %v", err)
+		}
+		client.BaseURL = baseURL
+	}
+	return client
+}
 
-	issueComment := &github.IssueComment{
-		Body: comment,
+// RateLimit returns the API budget shared by the clients of the same
+// credentials, an unknown one until the App installation is looked up.
+func (s *Client) RateLimit() *RateLimit {
+	b, err := s.budget()
+	if err != nil {
+		return &RateLimit{remaining: -1}
+	}
+	return b.limit
+}
+
+// mutation is a write to GitHub, audited once done.
+type mutation struct {
+	client *Client
+	ctx    context.Context
+	entry  *audit.Entry
+	// dryRun is set when the write is only logged.
+	dryRun bool
+}
+
+// mutation starts the write op, args are name and value pairs, logged as
+// fields under dry run.
+func (s *Client) mutation(ctx context.Context, op string, args ...interface{}) *mutation {
+	m := &mutation{
+		client: s,
+		ctx:    ctx,
+		entry: &audit.Entry{
+			Repo: s.owner + "/" + s.repo,
+			Op:   op,
+			Args: make(map[string]interface{}),
+		},
+		dryRun: s.cfg.Github.DryRun,
 	}
-	_, _, err := s.client.Issues.CreateComment(ctx, s.cfg.Github.RepoOwner, s.cfg.Github.RepoName, number, issueComment)
+	for i := 0; i+1 < len(args); i += 2 {
+		m.entry.Args[fmt.Sprint(args[i])] = args[i+1]
+	}
+	if number, ok := m.entry.Args["number"].(int); ok {
+		m.entry.Number = number
+		delete(m.entry.Args, "number")
+	}
+	if m.dryRun {
+		logging.From(ctx).WithFields(log.Fields(m.entry.Args)).WithField("repo", m.entry.Repo).Infof("Dry run, skip %v", op)
+	}
+	return m
+}
+
+// done audits the write and returns its err.
+func (m *mutation) done(err error) error {
+	switch {
+	case m.dryRun:
+		m.entry.Result = audit.ResultDryRun
+	case err != nil:
+		m.entry.Result = audit.ResultError
+		m.entry.Error = err.Error()
+	default:
+		m.entry.Result = audit.ResultOK
+	}
+	m.client.audit.Record(m.ctx, m.entry)
 	return err
 }
 
-func (s *Client) GetLastComment(number int) (*github.IssueComment, error) {
-	ctx, timeout := context.WithTimeout(*s.ctx, 10*time.Second)
-	defer timeout()
+// do runs one API call with the configured timeout, retrying the idempotent
+// ones on server and network errors, and classifies the final error.
+func (s *Client) do(ctx context.Context, op string, retry bool, call func(ctx context.Context) (*github.Response, error)) (err error) {
+	start := time.Now()
+	defer func() {
+		fullName := s.owner + "/" + s.repo
+		metrics.GithubRequestDuration.WithLabelValues(fullName, op, metrics.Outcome(err)).Observe(time.Since(start).Seconds())
+		if remaining := s.RateLimit().Remaining(); remaining >= 0 {
+			metrics.GithubRateLimitRemaining.WithLabelValues(fullName).Set(float64(remaining))
+		}
+	}()
+
+	backoff := s.cfg.Github.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		callCtx, timeout := context.WithTimeout(ctx, s.cfg.Github.Timeout)
+		resp, err := call(callCtx)
+		timeout()
+		err = classify(op, resp, err)
+		if err == nil {
+			return nil
+		}
+
+		var apiErr *APIError
+		errors.As(err, &apiErr)
+		// Rate limits are waited out by the transport already.
+		if !retry || attempt >= s.cfg.Github.Retries || apiErr.Kind == ErrRateLimited || !apiErr.Temporary() || ctx.Err() != nil {
+			return err
+		}
+		logging.From(ctx).Warnf("Github %v attempt %v error: %v, retry in %v", op, attempt+1, err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+		backoff *= 2
+	}
+}
+
+// BotLogin returns the login of the bot, the app bot or the token user,
+// looked up once.
+func (s *Client) BotLogin(ctx context.Context) (string, error) {
+	s.botMu.Lock()
+	defer s.botMu.Unlock()
+	if s.botLogin != "" {
+		return s.botLogin, nil
+	}
+	if s.cfg.Github.BotLogin != "" {
+		s.botLogin = s.cfg.Github.BotLogin
+		return s.botLogin, nil
+	}
 
+	app, err := AppFor(s.cfg)
+	if err != nil {
+		return "", err
+	}
+	if app != nil {
+		slug, err := app.Slug(ctx, s.cfg)
+		if err != nil {
+			return "", err
+		}
+		s.botLogin = slug + "[bot]"
+		return s.botLogin, nil
+	}
+
+	var user *github.User
+	err = s.do(ctx, "get user", idempotent, func(ctx context.Context) (resp *github.Response, err error) {
+		user, resp, err = s.client.Users.Get(ctx, "")
+		return resp, err
+	})
+	if err != nil {
+		return "", err
+	}
+	s.botLogin = user.GetLogin()
+	return s.botLogin, nil
+}
+
+func (s *Client) CheckAuth(ctx context.Context) error {
+	return s.do(ctx, "get repository", idempotent, func(ctx context.Context) (*github.Response, error) {
+		_, resp, err := s.client.Repositories.Get(ctx, s.owner, s.repo)
+		return resp, err
+	})
+}
+
+func (s *Client) CreateComment(ctx context.Context, number int, comment *string) error {
+	m := s.mutation(ctx, "create comment", "number", number, "body", *comment)
+	if m.dryRun {
+		return m.done(nil)
+	}
+	issueComment := &github.IssueComment{
+		Body: comment,
+	}
+	return m.done(s.do(ctx, "create comment", once, func(ctx context.Context) (*github.Response, error) {
+		_, resp, err := s.client.Issues.CreateComment(ctx, s.owner, s.repo, number, issueComment)
+		return resp, err
+	}))
+}
+
+func (s *Client) GetLastComment(ctx context.Context, number int) (*github.IssueComment, error) {
 	var sort string = "created_at"
 	var direction string = "desc"
 	opts := github.IssueListCommentsOptions{
 		Sort:      &sort,
 		Direction: &direction,
 	}
-	list, _, err := s.client.Issues.ListComments(ctx, s.cfg.Github.RepoOwner, s.cfg.Github.RepoName, number, &opts)
+	var list []*github.IssueComment
+	err := s.do(ctx, "list comments", idempotent, func(ctx context.Context) (resp *github.Response, err error) {
+		list, resp, err = s.client.Issues.ListComments(ctx, s.owner, s.repo, number, &opts)
+		return resp, err
+	})
 	if len(list) > 0 {
 		return list[len(list)-1], err
 	} else {
@@ -68,21 +263,25 @@ func (s *Client) GetLastComment(number int) (*github.IssueComment, error) {
 
 }
 
-func (s *Client) PullRequestMerge(number int, comment string) error {
-	ctx, timeout := context.WithTimeout(*s.ctx, 10*time.Second)
-	defer timeout()
-
+// PullRequestMerge merges the pull request if its head is still sha, method is
+// merge, squash or rebase, empty title and message keep the GitHub defaults.
+func (s *Client) PullRequestMerge(ctx context.Context, number int, sha string, method string, title string, message string) error {
+	m := s.mutation(ctx, "merge pull request", "number", number, "sha", sha, "method", method, "title", title, "message", message)
+	if m.dryRun {
+		return m.done(nil)
+	}
 	opts := github.PullRequestOptions{
-		MergeMethod: "merge",
+		CommitTitle: title,
+		SHA:         sha,
+		MergeMethod: method,
 	}
-	_, _, err := s.client.PullRequests.Merge(ctx, s.cfg.Github.RepoOwner, s.cfg.Github.RepoName, number, comment, &opts)
-	return err
+	return m.done(s.do(ctx, "merge pull request", once, func(ctx context.Context) (*github.Response, error) {
+		_, resp, err := s.client.PullRequests.Merge(ctx, s.owner, s.repo, number, message, &opts)
+		return resp, err
+	}))
 }
 
-func (s *Client) PullRequestList() ([]*github.PullRequest, error) {
-	ctx, timeout := context.WithTimeout(*s.ctx, 10*time.Second)
-	defer timeout()
-
+func (s *Client) PullRequestList(ctx context.Context) ([]*github.PullRequest, error) {
 	var results []*github.PullRequest
 	opts := &github.PullRequestListOptions{
 		State: "open",
@@ -92,7 +291,12 @@ func (s *Client) PullRequestList() ([]*github.PullRequest, error) {
 	}
 
 	for {
-		prs, resp, err := s.client.PullRequests.List(ctx, s.cfg.Github.RepoOwner, s.cfg.Github.RepoName, opts)
+		var prs []*github.PullRequest
+		var resp *github.Response
+		err := s.do(ctx, "list pull requests", idempotent, func(ctx context.Context) (r *github.Response, err error) {
+			prs, resp, err = s.client.PullRequests.List(ctx, s.owner, s.repo, opts)
+			return resp, err
+		})
 		if err != nil {
 			return results, err
 		}
@@ -108,60 +312,159 @@ func (s *Client) PullRequestList() ([]*github.PullRequest, error) {
 	return results, nil
 }
 
-func (s *Client) ListCheckRunsForRef(ref string) (*github.ListCheckRunsResults, error) {
-	ctx, timeout := context.WithTimeout(*s.ctx, 10*time.Second)
-	defer timeout()
-
+func (s *Client) ListCheckRunsForRef(ctx context.Context, ref string) ([]*github.CheckRun, error) {
+	var results []*github.CheckRun
 	opts := &github.ListCheckRunsOptions{ListOptions: github.ListOptions{PerPage: 100}}
-	checkRuns, _, err := s.client.Checks.ListCheckRunsForRef(ctx, s.cfg.Github.RepoOwner, s.cfg.Github.RepoName, ref, opts)
+	for {
+		var checkRuns *github.ListCheckRunsResults
+		var resp *github.Response
+		err := s.do(ctx, "list check runs", idempotent, func(ctx context.Context) (r *github.Response, err error) {
+			checkRuns, resp, err = s.client.Checks.ListCheckRunsForRef(ctx, s.owner, s.repo, ref, opts)
+			return resp, err
+		})
+		if err != nil {
+			return results, err
+		}
+		results = append(results, checkRuns.CheckRuns...)
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+	return results, nil
+}
+
+// ListStatusesForRef returns the latest commit status of every context.
+func (s *Client) ListStatusesForRef(ctx context.Context, ref string) ([]*github.RepoStatus, error) {
+	var results []*github.RepoStatus
+	opts := &github.ListOptions{PerPage: 100}
+	for {
+		var combined *github.CombinedStatus
+		var resp *github.Response
+		err := s.do(ctx, "get combined status", idempotent, func(ctx context.Context) (r *github.Response, err error) {
+			combined, resp, err = s.client.Repositories.GetCombinedStatus(ctx, s.owner, s.repo, ref, opts)
+			return resp, err
+		})
+		if err != nil {
+			return results, err
+		}
+		results = append(results, combined.Statuses...)
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+	return results, nil
+}
 
-	return checkRuns, err
+// RequiredStatusChecks returns the contexts required by the branch
+// protection, none when the branch is not protected. The protection API needs
+// the admin permission, without it the summary of the branch is read.
+func (s *Client) RequiredStatusChecks(ctx context.Context, branch string) ([]string, error) {
+	var checks *github.RequiredStatusChecks
+	err := s.do(ctx, "get required status checks", idempotent, func(ctx context.Context) (resp *github.Response, err error) {
+		checks, resp, err = s.client.Repositories.GetRequiredStatusChecks(ctx, s.owner, s.repo, branch)
+		return resp, err
+	})
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return nil, nil
+	case errors.Is(err, ErrForbidden):
+		return s.branchRequiredStatusChecks(ctx, branch)
+	case err != nil:
+		return nil, err
+	}
+	return checks.Contexts, nil
 }
 
-func (s *Client) PullRequestReview(number int, event string) error {
-	ctx, timeout := context.WithTimeout(*s.ctx, 10*time.Second)
-	defer timeout()
+// branchRequiredStatusChecks reads the required contexts from the protection
+// summary of the branch, readable by anyone who can read the repository.
+func (s *Client) branchRequiredStatusChecks(ctx context.Context, branch string) ([]string, error) {
+	var summary struct {
+		Protection struct {
+			RequiredStatusChecks struct {
+				Contexts []string `json:"contexts"`
+			} `json:"required_status_checks"`
+		} `json:"protection"`
+	}
+	err := s.do(ctx, "get branch", idempotent, func(ctx context.Context) (*github.Response, error) {
+		req, err := s.client.NewRequest(http.MethodGet, fmt.Sprintf("repos/%v/%v/branches/%v", s.owner, s.repo, url.PathEscape(branch)), nil)
+		if err != nil {
+			return nil, err
+		}
+		return s.client.Do(ctx, req, &summary)
+	})
+	if errors.Is(err, ErrNotFound) || errors.Is(err, ErrForbidden) {
+		logging.From(ctx).Warnf("Required status checks of %v unreadable, wait for the reported ones: %v", branch, err)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return summary.Protection.RequiredStatusChecks.Contexts, nil
+}
 
+func (s *Client) PullRequestReview(ctx context.Context, number int, event string) error {
+	m := s.mutation(ctx, "create review", "number", number, "event", event)
+	if m.dryRun {
+		return m.done(nil)
+	}
 	opts := github.PullRequestReviewRequest{
 		Event: &event,
 	}
-	_, _, err := s.client.PullRequests.CreateReview(ctx, s.cfg.Github.RepoOwner, s.cfg.Github.RepoName, number, &opts)
-	return err
+	return m.done(s.do(ctx, "create review", once, func(ctx context.Context) (*github.Response, error) {
+		_, resp, err := s.client.PullRequests.CreateReview(ctx, s.owner, s.repo, number, &opts)
+		return resp, err
+	}))
 }
 
-func (s *Client) PullRequestRequestReviewer(number int, reviewer string) error {
-	ctx, timeout := context.WithTimeout(*s.ctx, 10*time.Second)
-	defer timeout()
-
+func (s *Client) PullRequestRequestReviewer(ctx context.Context, number int, reviewer string) error {
+	m := s.mutation(ctx, "request reviewers", "number", number, "reviewer", reviewer)
+	if m.dryRun {
+		return m.done(nil)
+	}
 	opts := github.ReviewersRequest{
 		Reviewers: []string{reviewer},
 	}
-	_, _, err := s.client.PullRequests.RequestReviewers(ctx, s.cfg.Github.RepoOwner, s.cfg.Github.RepoName, number, opts)
-	return err
+	return m.done(s.do(ctx, "request reviewers", idempotent, func(ctx context.Context) (*github.Response, error) {
+		_, resp, err := s.client.PullRequests.RequestReviewers(ctx, s.owner, s.repo, number, opts)
+		return resp, err
+	}))
 }
 
-func (s *Client) PullRequestListReviewers(number int) (*github.Reviewers, error) {
-	ctx, timeout := context.WithTimeout(*s.ctx, 10*time.Second)
-	defer timeout()
-
+func (s *Client) PullRequestListReviewers(ctx context.Context, number int) (*github.Reviewers, error) {
 	opts := &github.ListOptions{PerPage: 100}
-	reviewers, _, err := s.client.PullRequests.ListReviewers(ctx, s.cfg.Github.RepoOwner, s.cfg.Github.RepoName, number, opts)
+	var reviewers *github.Reviewers
+	err := s.do(ctx, "list reviewers", idempotent, func(ctx context.Context) (resp *github.Response, err error) {
+		reviewers, resp, err = s.client.PullRequests.ListReviewers(ctx, s.owner, s.repo, number, opts)
+		return resp, err
+	})
 	return reviewers, err
 }
 
-func (s *Client) PullRequestListReviews(number int) ([]*github.PullRequestReview, error) {
-	ctx, timeout := context.WithTimeout(*s.ctx, 10*time.Second)
-	defer timeout()
-
+func (s *Client) PullRequestListReviews(ctx context.Context, number int) ([]*github.PullRequestReview, error) {
+	var results []*github.PullRequestReview
 	opts := &github.ListOptions{PerPage: 100}
-	reviews, _, err := s.client.PullRequests.ListReviews(ctx, s.cfg.Github.RepoOwner, s.cfg.Github.RepoName, number, opts)
-	return reviews, err
+	for {
+		var reviews []*github.PullRequestReview
+		var resp *github.Response
+		err := s.do(ctx, "list reviews", idempotent, func(ctx context.Context) (r *github.Response, err error) {
+			reviews, resp, err = s.client.PullRequests.ListReviews(ctx, s.owner, s.repo, number, opts)
+			return resp, err
+		})
+		if err != nil {
+			return results, err
+		}
+		results = append(results, reviews...)
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+	return results, nil
 }
 
-func (s *Client) GetMergedPullRequestsAfter(branch string, after time.Time) ([]*github.PullRequest, error) {
-	ctx, timeout := context.WithTimeout(*s.ctx, 10*time.Second)
-	defer timeout()
-
+func (s *Client) GetMergedPullRequestsAfter(ctx context.Context, branch string, after time.Time) ([]*github.PullRequest, error) {
 	opts := &github.PullRequestListOptions{
 		State:       "closed",
 		Base:        branch,
@@ -172,7 +475,12 @@ func (s *Client) GetMergedPullRequestsAfter(branch string, after time.Time) ([]*
 
 	var prList []*github.PullRequest
 	for {
-		prs, resp, err := s.client.PullRequests.List(ctx, s.cfg.Github.RepoOwner, s.cfg.Github.RepoName, opts)
+		var prs []*github.PullRequest
+		var resp *github.Response
+		err := s.do(ctx, "list pull requests", idempotent, func(ctx context.Context) (r *github.Response, err error) {
+			prs, resp, err = s.client.PullRequests.List(ctx, s.owner, s.repo, opts)
+			return resp, err
+		})
 		if err != nil {
 			return nil, fmt.Errorf("call listing pull requests API: %w", err)
 		}
@@ -206,27 +514,39 @@ func extractMergedPRsAfter(prs []*github.PullRequest, after time.Time) ([]*githu
 	return prList, done
 }
 
-func (s *Client) CreateRelease(tagName, body string, preRelease bool) (*github.RepositoryRelease, error) {
-	ctx, timeout := context.WithTimeout(*s.ctx, 10*time.Second)
-	defer timeout()
-
-	release, _, err := s.client.Repositories.CreateRelease(ctx, s.cfg.Github.RepoOwner, s.cfg.Github.RepoName, &github.RepositoryRelease{
-		TagName:    github.String(tagName),
-		Name:       github.String(tagName),
-		Body:       github.String(body),
-		Prerelease: &preRelease,
+func (s *Client) CreateRelease(ctx context.Context, tagName, body string, preRelease bool) (*github.RepositoryRelease, error) {
+	m := s.mutation(ctx, "create release", "tag", tagName, "prerelease", preRelease, "body", body)
+	if m.dryRun {
+		m.done(nil)
+		return &github.RepositoryRelease{
+			TagName:    github.String(tagName),
+			Name:       github.String(tagName),
+			Body:       github.String(body),
+			Prerelease: &preRelease,
+		}, nil
+	}
+	var release *github.RepositoryRelease
+	err := s.do(ctx, "create release", once, func(ctx context.Context) (resp *github.Response, err error) {
+		release, resp, err = s.client.Repositories.CreateRelease(ctx, s.owner, s.repo, &github.RepositoryRelease{
+			TagName:    github.String(tagName),
+			Name:       github.String(tagName),
+			Body:       github.String(body),
+			Prerelease: &preRelease,
+		})
+		return resp, err
 	})
-	if err != nil {
+	if err := m.done(err); err != nil {
 		return nil, fmt.Errorf("call creating release API: %w", err)
 	}
 	return release, nil
 }
 
-func (s *Client) GetLatestRelease() (*github.RepositoryRelease, error) {
-	ctx, timeout := context.WithTimeout(*s.ctx, 10*time.Second)
-	defer timeout()
-
-	releases, _, err := s.client.Repositories.ListReleases(ctx, s.cfg.Github.RepoOwner, s.cfg.Github.RepoName, &github.ListOptions{Page: 1, PerPage: 10})
+func (s *Client) GetLatestRelease(ctx context.Context) (*github.RepositoryRelease, error) {
+	var releases []*github.RepositoryRelease
+	err := s.do(ctx, "list releases", idempotent, func(ctx context.Context) (resp *github.Response, err error) {
+		releases, resp, err = s.client.Repositories.ListReleases(ctx, s.owner, s.repo, &github.ListOptions{Page: 1, PerPage: 10})
+		return resp, err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -236,32 +556,39 @@ func (s *Client) GetLatestRelease() (*github.RepositoryRelease, error) {
 	return nil, nil
 }
 
-func (s *Client) IssueAssignTo(number int, assignee string) error {
-	ctx, timeout := context.WithTimeout(*s.ctx, 10*time.Second)
-	defer timeout()
-
-	_, _, err := s.client.Issues.AddAssignees(ctx, s.cfg.Github.RepoOwner, s.cfg.Github.RepoName, number, []string{assignee})
-	return err
+func (s *Client) IssueAssignTo(ctx context.Context, number int, assignee string) error {
+	m := s.mutation(ctx, "add assignees", "number", number, "assignee", assignee)
+	if m.dryRun {
+		return m.done(nil)
+	}
+	return m.done(s.do(ctx, "add assignees", idempotent, func(ctx context.Context) (*github.Response, error) {
+		_, resp, err := s.client.Issues.AddAssignees(ctx, s.owner, s.repo, number, []string{assignee})
+		return resp, err
+	}))
 }
 
-func (s *Client) AddLabelToIssue(number int, label string) error {
-	ctx, timeout := context.WithTimeout(*s.ctx, 10*time.Second)
-	defer timeout()
-
-	_, _, err := s.client.Issues.AddLabelsToIssue(ctx, s.cfg.Github.RepoOwner, s.cfg.Github.RepoName, number, []string{label})
-	return err
+func (s *Client) AddLabelToIssue(ctx context.Context, number int, label string) error {
+	m := s.mutation(ctx, "add labels", "number", number, "label", label)
+	if m.dryRun {
+		return m.done(nil)
+	}
+	return m.done(s.do(ctx, "add labels", idempotent, func(ctx context.Context) (*github.Response, error) {
+		_, resp, err := s.client.Issues.AddLabelsToIssue(ctx, s.owner, s.repo, number, []string{label})
+		return resp, err
+	}))
 }
 
-func (s *Client) ListLabelsForIssue(number int) ([]*github.Label, error) {
-	ctx, timeout := context.WithTimeout(*s.ctx, 10*time.Second)
-	defer timeout()
-
-	labels, _, err := s.client.Issues.ListLabelsByIssue(ctx, s.cfg.Github.RepoOwner, s.cfg.Github.RepoName, number, nil)
+func (s *Client) ListLabelsForIssue(ctx context.Context, number int) ([]*github.Label, error) {
+	var labels []*github.Label
+	err := s.do(ctx, "list labels", idempotent, func(ctx context.Context) (resp *github.Response, err error) {
+		labels, resp, err = s.client.Issues.ListLabelsByIssue(ctx, s.owner, s.repo, number, nil)
+		return resp, err
+	})
 	return labels, err
 }
 
-func (s *Client) CheckLabelExistsForIssue(number int, label string) (bool, error) {
-	labels, err := s.ListLabelsForIssue(number)
+func (s *Client) CheckLabelExistsForIssue(ctx context.Context, number int, label string) (bool, error) {
+	labels, err := s.ListLabelsForIssue(ctx, number)
 	if err != nil {
 		return false, err
 	}
@@ -273,58 +600,240 @@ func (s *Client) CheckLabelExistsForIssue(number int, label string) (bool, error
 	return false, nil
 }
 
-func (s *Client) RemoveLabelFromIssue(number int, label string) error {
-	ctx, timeout := context.WithTimeout(*s.ctx, 10*time.Second)
-	defer timeout()
-
-	_, err := s.client.Issues.RemoveLabelForIssue(ctx, s.cfg.Github.RepoOwner, s.cfg.Github.RepoName, number, label)
-	return err
+func (s *Client) RemoveLabelFromIssue(ctx context.Context, number int, label string) error {
+	m := s.mutation(ctx, "remove label", "number", number, "label", label)
+	if m.dryRun {
+		return m.done(nil)
+	}
+	return m.done(s.do(ctx, "remove label", idempotent, func(ctx context.Context) (*github.Response, error) {
+		return s.client.Issues.RemoveLabelForIssue(ctx, s.owner, s.repo, number, label)
+	}))
 }
 
-func (s *Client) ReplaceLabelsForIssue(number int, labels []string) error {
-	ctx, timeout := context.WithTimeout(*s.ctx, 10*time.Second)
-	defer timeout()
-
-	_, _, err := s.client.Issues.ReplaceLabelsForIssue(ctx, s.cfg.Github.RepoOwner, s.cfg.Github.RepoName, number, labels)
-	return err
+func (s *Client) ReplaceLabelsForIssue(ctx context.Context, number int, labels []string) error {
+	m := s.mutation(ctx, "replace labels", "number", number, "labels", labels)
+	if m.dryRun {
+		return m.done(nil)
+	}
+	return m.done(s.do(ctx, "replace labels", idempotent, func(ctx context.Context) (*github.Response, error) {
+		_, resp, err := s.client.Issues.ReplaceLabelsForIssue(ctx, s.owner, s.repo, number, labels)
+		return resp, err
+	}))
 }
 
-func (s *Client) RepositoriesDispatch(event string) error {
-	ctx, timeout := context.WithTimeout(*s.ctx, 10*time.Second)
-	defer timeout()
-
+func (s *Client) RepositoriesDispatch(ctx context.Context, event string) error {
+	m := s.mutation(ctx, "dispatch", "event", event)
+	if m.dryRun {
+		return m.done(nil)
+	}
 	opts := github.DispatchRequestOptions{
 		EventType: event,
 	}
-	_, _, err := s.client.Repositories.Dispatch(ctx, s.cfg.Github.RepoOwner, s.cfg.Github.RepoName, opts)
-	return err
+	return m.done(s.do(ctx, "dispatch", once, func(ctx context.Context) (*github.Response, error) {
+		_, resp, err := s.client.Repositories.Dispatch(ctx, s.owner, s.repo, opts)
+		return resp, err
+	}))
 }
 
-func (s *Client) CreateStatus(sha string, title string, desc string, state string, target_url string) error {
-	ctx, timeout := context.WithTimeout(*s.ctx, 10*time.Second)
-	defer timeout()
+func (s *Client) GetFile(ctx context.Context, path string) ([]byte, error) {
+	var file *github.RepositoryContent
+	err := s.do(ctx, "get contents", idempotent, func(ctx context.Context) (resp *github.Response, err error) {
+		file, _, resp, err = s.client.Repositories.GetContents(ctx, s.owner, s.repo, path, nil)
+		return resp, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if file == nil {
+		return nil, fmt.Errorf("%v is a directory", path)
+	}
+	content, err := file.GetContent()
+	if err != nil {
+		return nil, err
+	}
+	return []byte(content), nil
+}
 
+func (s *Client) CreateStatus(ctx context.Context, sha string, title string, desc string, state string, target_url string) error {
+	m := s.mutation(ctx, "create status", "sha", sha, "context", title, "state", state, "description", desc, "target_url", target_url)
+	if m.dryRun {
+		return m.done(nil)
+	}
 	status := &github.RepoStatus{}
 	status.State = &state
 	status.Context = &title
 	status.Description = &desc
 	status.TargetURL = &target_url
 
-	_, _, err := s.client.Repositories.CreateStatus(ctx, s.cfg.Github.RepoOwner, s.cfg.Github.RepoName, sha, status)
-	return err
+	// A status replaces the previous one of its context.
+	return m.done(s.do(ctx, "create status", idempotent, func(ctx context.Context) (*github.Response, error) {
+		_, resp, err := s.client.Repositories.CreateStatus(ctx, s.owner, s.repo, sha, status)
+		return resp, err
+	}))
 }
 
-func (s *Client) IssuesForFirstTime(user string) (bool, error) {
-	ctx, timeout := context.WithTimeout(*s.ctx, 10*time.Second)
-	defer timeout()
-
+func (s *Client) IssuesForFirstTime(ctx context.Context, user string) (bool, error) {
 	opts := &github.IssueListByRepoOptions{
 		Creator: user,
 	}
 
-	if issues, _, err := s.client.Issues.ListByRepo(ctx, s.cfg.Github.RepoOwner, s.cfg.Github.RepoName, opts); err != nil {
+	var issues []*github.Issue
+	err := s.do(ctx, "list issues", idempotent, func(ctx context.Context) (resp *github.Response, err error) {
+		issues, resp, err = s.client.Issues.ListByRepo(ctx, s.owner, s.repo, opts)
+		return resp, err
+	})
+	if err != nil {
 		return false, err
-	} else {
-		return len(issues) == 0, nil
 	}
+	return len(issues) == 0, nil
+}
+
+func (s *Client) PullRequestListFiles(ctx context.Context, number int) ([]string, error) {
+	var files []string
+	opts := &github.ListOptions{PerPage: 100}
+	for {
+		var list []*github.CommitFile
+		var resp *github.Response
+		err := s.do(ctx, "list files", idempotent, func(ctx context.Context) (r *github.Response, err error) {
+			list, resp, err = s.client.PullRequests.ListFiles(ctx, s.owner, s.repo, number, opts)
+			return resp, err
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range list {
+			files = append(files, f.GetFilename())
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+	return files, nil
+}
+
+func (s *Client) IsTeamMember(ctx context.Context, org string, team string, user string) (bool, error) {
+	var membership *github.Membership
+	err := s.do(ctx, "get team membership", idempotent, func(ctx context.Context) (resp *github.Response, err error) {
+		membership, resp, err = s.client.Teams.GetTeamMembershipBySlug(ctx, org, team, user)
+		return resp, err
+	})
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return membership.GetState() == "active", nil
+}
+
+// CollaboratorPermission returns the repository role of user: admin,
+// maintain, write, triage, read or none.
+func (s *Client) CollaboratorPermission(ctx context.Context, user string) (string, error) {
+	// The role_name tells triage and maintain apart, go-github only has the
+	// legacy permission.
+	var level struct {
+		Permission string `json:"permission"`
+		RoleName   string `json:"role_name"`
+	}
+	err := s.do(ctx, "get collaborator permission", idempotent, func(ctx context.Context) (*github.Response, error) {
+		u := fmt.Sprintf("repos/%v/%v/collaborators/%v/permission", s.owner, s.repo, url.PathEscape(user))
+		req, err := s.client.NewRequest(http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		return s.client.Do(ctx, req, &level)
+	})
+	if errors.Is(err, ErrNotFound) {
+		return "none", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	// Custom roles are named after the organization's choice, their base
+	// permission is the legacy one.
+	switch level.RoleName {
+	case "triage", "maintain":
+		return level.RoleName, nil
+	}
+	return level.Permission, nil
+}
+
+func (s *Client) GetPullRequest(ctx context.Context, number int) (*github.PullRequest, error) {
+	var pr *github.PullRequest
+	err := s.do(ctx, "get pull request", idempotent, func(ctx context.Context) (resp *github.Response, err error) {
+		pr, resp, err = s.client.PullRequests.Get(ctx, s.owner, s.repo, number)
+		return resp, err
+	})
+	return pr, err
+}
+
+// PullRequestUpdateBranch merges the base branch into the pull request head,
+// GitHub does it in the background.
+func (s *Client) PullRequestUpdateBranch(ctx context.Context, number int, expectedHeadSHA string) error {
+	m := s.mutation(ctx, "update branch", "number", number, "expected_head_sha", expectedHeadSHA)
+	if m.dryRun {
+		return m.done(nil)
+	}
+	opts := &github.PullRequestBranchUpdateOptions{
+		ExpectedHeadSHA: &expectedHeadSHA,
+	}
+	err := s.do(ctx, "update branch", once, func(ctx context.Context) (*github.Response, error) {
+		_, resp, err := s.client.PullRequests.UpdateBranch(ctx, s.owner, s.repo, number, opts)
+		return resp, err
+	})
+	var accepted *github.AcceptedError
+	if errors.As(err, &accepted) {
+		err = nil
+	}
+	return m.done(err)
+}
+
+// CommitsBehind returns how many commits of base the head misses.
+func (s *Client) CommitsBehind(ctx context.Context, base string, head string) (int, error) {
+	var comparison *github.CommitsComparison
+	err := s.do(ctx, "compare commits", idempotent, func(ctx context.Context) (resp *github.Response, err error) {
+		comparison, resp, err = s.client.Repositories.CompareCommits(ctx, s.owner, s.repo, base, head)
+		return resp, err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return comparison.GetBehindBy(), nil
+}
+
+// CommitParents returns the parent shas of the commit, in order.
+func (s *Client) CommitParents(ctx context.Context, sha string) ([]string, error) {
+	var commit *github.Commit
+	err := s.do(ctx, "get commit", idempotent, func(ctx context.Context) (resp *github.Response, err error) {
+		commit, resp, err = s.client.Git.GetCommit(ctx, s.owner, s.repo, sha)
+		return resp, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	parents := make([]string, 0, len(commit.Parents))
+	for _, parent := range commit.Parents {
+		parents = append(parents, parent.GetSHA())
+	}
+	return parents, nil
+}
+
+// PullRequestsForCommit returns the open pull requests whose head is sha.
+func (s *Client) PullRequestsForCommit(ctx context.Context, sha string) ([]*github.PullRequest, error) {
+	var prs []*github.PullRequest
+	err := s.do(ctx, "list pull requests with commit", idempotent, func(ctx context.Context) (resp *github.Response, err error) {
+		prs, resp, err = s.client.PullRequests.ListPullRequestsWithCommit(ctx, s.owner, s.repo, sha, nil)
+		return resp, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var results []*github.PullRequest
+	for _, pr := range prs {
+		if pr.GetState() == "open" && pr.GetHead().GetSHA() == sha {
+			results = append(results, pr)
+		}
+	}
+	return results, nil
 }
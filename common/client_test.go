@@ -0,0 +1,162 @@
+// Copyright 2020-2021 The Datafuse Authors.
+//
+// SPDX-License-Identifier: Apache-2.0.
+
+package common
+
+import (
+	"bots/config"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v35/github"
+)
+
+func errorResponse(status int) (*github.Response, error) {
+	resp := &github.Response{Response: &http.Response{
+		StatusCode: status,
+		Request:    &http.Request{Method: http.MethodGet},
+	}}
+	return resp, &github.ErrorResponse{Response: resp.Response, Message: http.StatusText(status)}
+}
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		err       error
+		kind      error
+		temporary bool
+	}{
+		{name: "not found", status: http.StatusNotFound, kind: ErrNotFound},
+		{name: "forbidden", status: http.StatusForbidden, kind: ErrForbidden},
+		{name: "conflict", status: http.StatusConflict, kind: ErrConflict},
+		{name: "unmergeable", status: http.StatusMethodNotAllowed, kind: ErrUnmergeable},
+		{name: "invalid", status: http.StatusUnprocessableEntity},
+		{name: "server error", status: http.StatusBadGateway, temporary: true},
+		{name: "network", err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}, temporary: true},
+		{name: "cancelled", err: context.Canceled},
+		{name: "timeout", err: fmt.Errorf("get: %w", context.DeadlineExceeded)},
+		{name: "rate limit", status: http.StatusForbidden, err: &github.RateLimitError{Message: "API rate limit exceeded"}, kind: ErrRateLimited, temporary: true},
+		{name: "abuse", status: http.StatusForbidden, err: &github.AbuseRateLimitError{Message: "secondary rate limit"}, kind: ErrRateLimited, temporary: true},
+		{name: "transport limit", err: fmt.Errorf("get: %w", &RateLimitedError{Until: time.Now().Add(time.Hour)}), kind: ErrRateLimited, temporary: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var resp *github.Response
+			err := test.err
+			if test.status != 0 {
+				var statusErr error
+				resp, statusErr = errorResponse(test.status)
+				if err == nil {
+					err = statusErr
+				}
+			}
+
+			err = classify("get", resp, err)
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("error %T: %v", err, err)
+			}
+			if apiErr.Kind != test.kind || apiErr.StatusCode != test.status {
+				t.Errorf("kind %v, status %v", apiErr.Kind, apiErr.StatusCode)
+			}
+			if test.kind != nil && !errors.Is(err, test.kind) {
+				t.Errorf("errors.Is(%v) false", test.kind)
+			}
+			if IsTemporary(err) != test.temporary {
+				t.Errorf("temporary: %v", IsTemporary(err))
+			}
+		})
+	}
+
+	if classify("get", nil, nil) != nil {
+		t.Error("classify(nil) not nil")
+	}
+}
+
+func testClient() *Client {
+	b := &budget{limit: &RateLimit{remaining: -1}, cache: newEtagCache(etagCacheBytes)}
+	return &Client{
+		cfg: &config.Config{Github: &config.GithubConfig{
+			Timeout:      time.Second,
+			Retries:      2,
+			RetryBackoff: time.Millisecond,
+		}},
+		budget: func() (*budget, error) { return b, nil },
+		owner:  "datafuselabs",
+		repo:   "databend",
+	}
+}
+
+func TestClientDo(t *testing.T) {
+	tests := []struct {
+		name  string
+		retry bool
+		// status or err of each attempt, a 0 status and nil err is a success.
+		statuses []int
+		errs     []error
+		calls    int
+		kind     error
+		ok       bool
+	}{
+		{name: "success", retry: idempotent, statuses: []int{0}, calls: 1, ok: true},
+		{name: "server error retried", retry: idempotent, statuses: []int{502, 0}, calls: 2, ok: true},
+		{name: "retries exhausted", retry: idempotent, statuses: []int{502, 503, 500}, calls: 3},
+		{name: "network error retried", retry: idempotent, errs: []error{&net.OpError{Op: "read", Err: errors.New("reset")}, nil}, calls: 2, ok: true},
+		{name: "not found kept", retry: idempotent, statuses: []int{404}, calls: 1, kind: ErrNotFound},
+		{name: "invalid kept", retry: idempotent, statuses: []int{422}, calls: 1},
+		{name: "rate limit kept", retry: idempotent, errs: []error{&RateLimitedError{Until: time.Now().Add(time.Hour)}}, calls: 1, kind: ErrRateLimited},
+		{name: "write not retried", retry: once, statuses: []int{502}, calls: 1},
+		{name: "write network error not retried", retry: once, errs: []error{&net.OpError{Op: "read", Err: errors.New("reset")}}, calls: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			calls := 0
+			err := testClient().do(context.Background(), "get", test.retry, func(ctx context.Context) (*github.Response, error) {
+				i := calls
+				calls++
+				if _, ok := ctx.Deadline(); !ok {
+					t.Error("call without timeout")
+				}
+				if i < len(test.errs) {
+					return nil, test.errs[i]
+				}
+				if i < len(test.statuses) && test.statuses[i] != 0 {
+					return errorResponse(test.statuses[i])
+				}
+				return &github.Response{Response: &http.Response{StatusCode: http.StatusOK}}, nil
+			})
+
+			if calls != test.calls {
+				t.Errorf("calls: %v", calls)
+			}
+			if (err == nil) != test.ok {
+				t.Fatalf("error: %v", err)
+			}
+			if test.kind != nil && !errors.Is(err, test.kind) {
+				t.Errorf("error %v is not %v", err, test.kind)
+			}
+		})
+	}
+}
+
+func TestClientDoCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	err := testClient().do(ctx, "get", idempotent, func(ctx context.Context) (*github.Response, error) {
+		calls++
+		cancel()
+		return errorResponse(http.StatusBadGateway)
+	})
+	if err == nil || calls != 1 {
+		t.Errorf("%v calls, error: %v", calls, err)
+	}
+}
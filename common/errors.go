@@ -0,0 +1,91 @@
+// Copyright 2020-2021 The Datafuse Authors.
+//
+// SPDX-License-Identifier: Apache-2.0.
+
+package common
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/google/go-github/v35/github"
+)
+
+var (
+	ErrNotFound    = errors.New("not found")
+	ErrForbidden   = errors.New("forbidden")
+	ErrConflict    = errors.New("conflict")
+	ErrRateLimited = errors.New("rate limited")
+	ErrUnmergeable = errors.New("not mergeable")
+)
+
+// APIError is a failed GitHub call, errors.Is matches its kind.
+type APIError struct {
+	Op         string
+	StatusCode int
+	// Kind is one of the Err* above, nil when not classified.
+	Kind error
+	Err  error
+}
+
+func (e *APIError) Error() string {
+	return "github " + e.Op + ": " + e.Err.Error()
+}
+
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+func (e *APIError) Is(target error) bool {
+	return e.Kind != nil && e.Kind == target
+}
+
+// Temporary tells whether the call may succeed later: server and network
+// errors, and the rate limits.
+func (e *APIError) Temporary() bool {
+	if e.Kind == ErrRateLimited {
+		return true
+	}
+	if e.StatusCode == 0 {
+		return !errors.Is(e.Err, context.Canceled) && !errors.Is(e.Err, context.DeadlineExceeded)
+	}
+	return e.StatusCode >= http.StatusInternalServerError
+}
+
+// IsTemporary tells whether err is a GitHub error worth trying again later.
+func IsTemporary(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.Temporary()
+}
+
+func (e *RateLimitedError) Is(target error) bool {
+	return target == ErrRateLimited
+}
+
+func classify(op string, resp *github.Response, err error) error {
+	if err == nil {
+		return nil
+	}
+	apiErr := &APIError{Op: op, Err: err}
+	if resp != nil {
+		apiErr.StatusCode = resp.StatusCode
+	}
+
+	var rateLimit *github.RateLimitError
+	var abuseRateLimit *github.AbuseRateLimitError
+	switch {
+	case errors.As(err, &rateLimit), errors.As(err, &abuseRateLimit), errors.Is(err, ErrRateLimited):
+		apiErr.Kind = ErrRateLimited
+	case apiErr.StatusCode == http.StatusNotFound:
+		apiErr.Kind = ErrNotFound
+	case apiErr.StatusCode == http.StatusForbidden:
+		apiErr.Kind = ErrForbidden
+	case apiErr.StatusCode == http.StatusConflict:
+		apiErr.Kind = ErrConflict
+	case apiErr.StatusCode == http.StatusMethodNotAllowed:
+		// The merge API answers 405 for a pull request which can not be merged.
+		apiErr.Kind = ErrUnmergeable
+	}
+	return apiErr
+}
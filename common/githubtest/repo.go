@@ -0,0 +1,671 @@
+// Copyright 2020-2021 The Datafuse Authors.
+//
+// SPDX-License-Identifier: Apache-2.0.
+
+// Package githubtest fakes a GitHub repository in memory for the tests.
+package githubtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"bots/common"
+
+	"github.com/google/go-github/v35/github"
+)
+
+// BotLogin is the author of the comments and reviews made through the fake.
+const BotLogin = "fusebots"
+
+// Repo is an in-memory repository implementing common.GitHubAPI. The tests
+// set it up and inspect it through the exported fields, they must not be
+// touched while an action runs.
+type Repo struct {
+	mu sync.Mutex
+
+	Issues       map[int]*github.Issue
+	PullRequests map[int]*github.PullRequest
+	// Labels, Assignees and Comments of the issues and pull requests.
+	Labels    map[int][]string
+	Assignees map[int][]string
+	Comments  map[int][]string
+
+	Reviews            map[int][]*github.PullRequestReview
+	RequestedReviewers map[int][]string
+	Files              map[int][]string
+	// Teams members by "org/team".
+	Teams map[string][]string
+	// Permissions are the repository roles by login, none when missing.
+	Permissions map[string]string
+
+	// CheckRuns and Statuses by head sha, Statuses in creation order.
+	CheckRuns map[string][]*github.CheckRun
+	Statuses  map[string][]*github.RepoStatus
+	// Required status check contexts by protected branch.
+	Required map[string][]string
+	// Behind is how many commits of the base a head sha misses.
+	Behind map[string]int
+	// Parents of the commits by sha, the updates of the branches record
+	// theirs.
+	Parents map[string][]string
+	// MergeMethods records the method of the merged pull requests.
+	MergeMethods map[int]string
+
+	Releases   []*github.RepositoryRelease
+	Dispatches []string
+	// Contents of the default branch by path.
+	Contents map[string]string
+
+	// Errors makes the named method, e.g. "CreateComment", fail.
+	Errors map[string]error
+	// Calls counts the calls by method name.
+	Calls map[string]int
+
+	limit *common.RateLimit
+}
+
+var _ common.GitHubAPI = (*Repo)(nil)
+
+func NewRepo() *Repo {
+	return &Repo{
+		Issues:             make(map[int]*github.Issue),
+		PullRequests:       make(map[int]*github.PullRequest),
+		Labels:             make(map[int][]string),
+		Assignees:          make(map[int][]string),
+		Comments:           make(map[int][]string),
+		Reviews:            make(map[int][]*github.PullRequestReview),
+		RequestedReviewers: make(map[int][]string),
+		Files:              make(map[int][]string),
+		Teams:              make(map[string][]string),
+		Permissions:        make(map[string]string),
+		CheckRuns:          make(map[string][]*github.CheckRun),
+		Statuses:           make(map[string][]*github.RepoStatus),
+		Required:           make(map[string][]string),
+		Behind:             make(map[string]int),
+		Parents:            make(map[string][]string),
+		MergeMethods:       make(map[int]string),
+		Contents:           make(map[string]string),
+		Errors:             make(map[string]error),
+		Calls:              make(map[string]int),
+		limit:              &common.RateLimit{},
+	}
+}
+
+// AddPullRequest adds an open pull request of user from head sha into base.
+func (r *Repo) AddPullRequest(number int, user string, base string, sha string) *github.PullRequest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	pr := &github.PullRequest{
+		Number: github.Int(number),
+		State:  github.String("open"),
+		Title:  github.String(fmt.Sprintf("PR %d", number)),
+		Body:   github.String(""),
+		User:   &github.User{Login: github.String(user)},
+		Base:   &github.PullRequestBranch{Ref: github.String(base), SHA: github.String(base + "-head")},
+		Head:   &github.PullRequestBranch{SHA: github.String(sha)},
+	}
+	r.PullRequests[number] = pr
+	return pr
+}
+
+// AddReview adds a review of user on the head sha.
+func (r *Repo) AddReview(number int, user string, state string, sha string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.addReview(number, user, state, sha)
+}
+
+func (r *Repo) addReview(number int, user string, state string, sha string) {
+	reviews := r.Reviews[number]
+	r.Reviews[number] = append(reviews, &github.PullRequestReview{
+		ID:          github.Int64(int64(len(reviews) + 1)),
+		User:        &github.User{Login: github.String(user)},
+		State:       github.String(state),
+		CommitID:    github.String(sha),
+		SubmittedAt: &time.Time{},
+	})
+}
+
+// AddCheckRun adds a completed check run with the conclusion on sha.
+func (r *Repo) AddCheckRun(sha string, name string, conclusion string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	runs := r.CheckRuns[sha]
+	r.CheckRuns[sha] = append(runs, &github.CheckRun{
+		ID:         github.Int64(int64(len(runs) + 1)),
+		Name:       github.String(name),
+		HeadSHA:    github.String(sha),
+		Status:     github.String("completed"),
+		Conclusion: github.String(conclusion),
+	})
+}
+
+// LastStatus returns the latest status of the context on sha.
+func (r *Repo) LastStatus(sha string, context string) *github.RepoStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var last *github.RepoStatus
+	for _, status := range r.Statuses[sha] {
+		if status.GetContext() == context {
+			last = status
+		}
+	}
+	return last
+}
+
+func (r *Repo) fail(method string) error {
+	r.Calls[method]++
+	if err, ok := r.Errors[method]; ok {
+		return err
+	}
+	return nil
+}
+
+func notFound(op string) error {
+	return &common.APIError{Op: op, StatusCode: http.StatusNotFound, Kind: common.ErrNotFound, Err: errors.New("not found")}
+}
+
+// pullRequest returns a copy of the pull request with its current labels.
+func (r *Repo) pullRequest(number int) (*github.PullRequest, error) {
+	pr, ok := r.PullRequests[number]
+	if !ok {
+		return nil, notFound("get pull request")
+	}
+	copied := *pr
+	copied.Labels = nil
+	for _, label := range r.Labels[number] {
+		copied.Labels = append(copied.Labels, &github.Label{Name: github.String(label)})
+	}
+	copied.RequestedReviewers = nil
+	for _, login := range r.RequestedReviewers[number] {
+		copied.RequestedReviewers = append(copied.RequestedReviewers, &github.User{Login: github.String(login)})
+	}
+	return &copied, nil
+}
+
+func (r *Repo) numbers() []int {
+	var numbers []int
+	for number := range r.PullRequests {
+		numbers = append(numbers, number)
+	}
+	sort.Ints(numbers)
+	return numbers
+}
+
+func (r *Repo) RateLimit() *common.RateLimit {
+	return r.limit
+}
+
+func (r *Repo) BotLogin(ctx context.Context) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.fail("BotLogin"); err != nil {
+		return "", err
+	}
+	return BotLogin, nil
+}
+
+func (r *Repo) CheckAuth(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.fail("CheckAuth")
+}
+
+func (r *Repo) CreateComment(ctx context.Context, number int, comment *string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.fail("CreateComment"); err != nil {
+		return err
+	}
+	r.Comments[number] = append(r.Comments[number], *comment)
+	return nil
+}
+
+func (r *Repo) GetLastComment(ctx context.Context, number int) (*github.IssueComment, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.fail("GetLastComment"); err != nil {
+		return nil, err
+	}
+	comments := r.Comments[number]
+	if len(comments) == 0 {
+		return nil, nil
+	}
+	return &github.IssueComment{
+		Body: github.String(comments[len(comments)-1]),
+		User: &github.User{Login: github.String(BotLogin)},
+	}, nil
+}
+
+func (r *Repo) PullRequestMerge(ctx context.Context, number int, sha string, method string, title string, message string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.fail("PullRequestMerge"); err != nil {
+		return err
+	}
+	pr, ok := r.PullRequests[number]
+	if !ok {
+		return notFound("merge pull request")
+	}
+	if pr.GetState() != "open" {
+		return &common.APIError{Op: "merge pull request", StatusCode: http.StatusMethodNotAllowed, Kind: common.ErrUnmergeable, Err: errors.New("pull request is not open")}
+	}
+	if pr.GetHead().GetSHA() != sha {
+		return &common.APIError{Op: "merge pull request", StatusCode: http.StatusConflict, Kind: common.ErrConflict, Err: errors.New("head branch was modified")}
+	}
+	now := time.Now()
+	pr.State = github.String("closed")
+	pr.Merged = github.Bool(true)
+	pr.MergedAt = &now
+	pr.UpdatedAt = &now
+	r.MergeMethods[number] = method
+	return nil
+}
+
+func (r *Repo) PullRequestList(ctx context.Context) ([]*github.PullRequest, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.fail("PullRequestList"); err != nil {
+		return nil, err
+	}
+	var prs []*github.PullRequest
+	for _, number := range r.numbers() {
+		if r.PullRequests[number].GetState() == "open" {
+			pr, _ := r.pullRequest(number)
+			prs = append(prs, pr)
+		}
+	}
+	return prs, nil
+}
+
+func (r *Repo) GetPullRequest(ctx context.Context, number int) (*github.PullRequest, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.fail("GetPullRequest"); err != nil {
+		return nil, err
+	}
+	return r.pullRequest(number)
+}
+
+func (r *Repo) PullRequestsForCommit(ctx context.Context, sha string) ([]*github.PullRequest, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.fail("PullRequestsForCommit"); err != nil {
+		return nil, err
+	}
+	var prs []*github.PullRequest
+	for _, number := range r.numbers() {
+		pr := r.PullRequests[number]
+		if pr.GetState() == "open" && pr.GetHead().GetSHA() == sha {
+			copied, _ := r.pullRequest(number)
+			prs = append(prs, copied)
+		}
+	}
+	return prs, nil
+}
+
+func (r *Repo) GetMergedPullRequestsAfter(ctx context.Context, branch string, after time.Time) ([]*github.PullRequest, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.fail("GetMergedPullRequestsAfter"); err != nil {
+		return nil, err
+	}
+	var prs []*github.PullRequest
+	for _, number := range r.numbers() {
+		pr := r.PullRequests[number]
+		if pr.GetBase().GetRef() == branch && pr.MergedAt != nil && pr.MergedAt.After(after) {
+			copied, _ := r.pullRequest(number)
+			prs = append(prs, copied)
+		}
+	}
+	return prs, nil
+}
+
+// PullRequestUpdateBranch merges the base at once, the head gets the
+// "-updated" suffix.
+func (r *Repo) PullRequestUpdateBranch(ctx context.Context, number int, expectedHeadSHA string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.fail("PullRequestUpdateBranch"); err != nil {
+		return err
+	}
+	pr, ok := r.PullRequests[number]
+	if !ok {
+		return notFound("update branch")
+	}
+	if pr.GetHead().GetSHA() != expectedHeadSHA {
+		return &common.APIError{Op: "update branch", StatusCode: http.StatusUnprocessableEntity, Err: errors.New("expected head sha didn't match")}
+	}
+	pr.Head.SHA = github.String(expectedHeadSHA + "-updated")
+	r.Parents[pr.GetHead().GetSHA()] = []string{expectedHeadSHA, pr.GetBase().GetSHA()}
+	return nil
+}
+
+func (r *Repo) CommitsBehind(ctx context.Context, base string, head string) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.fail("CommitsBehind"); err != nil {
+		return 0, err
+	}
+	return r.Behind[head], nil
+}
+
+func (r *Repo) CommitParents(ctx context.Context, sha string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.fail("CommitParents"); err != nil {
+		return nil, err
+	}
+	return r.Parents[sha], nil
+}
+
+func (r *Repo) PullRequestListFiles(ctx context.Context, number int) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.fail("PullRequestListFiles"); err != nil {
+		return nil, err
+	}
+	return append([]string(nil), r.Files[number]...), nil
+}
+
+// PullRequestReview adds a review of BotLogin, event is APPROVE,
+// REQUEST_CHANGES or COMMENT.
+func (r *Repo) PullRequestReview(ctx context.Context, number int, event string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.fail("PullRequestReview"); err != nil {
+		return err
+	}
+	states := map[string]string{
+		"APPROVE":         "APPROVED",
+		"REQUEST_CHANGES": "CHANGES_REQUESTED",
+		"COMMENT":         "COMMENTED",
+	}
+	sha := ""
+	if pr, ok := r.PullRequests[number]; ok {
+		sha = pr.GetHead().GetSHA()
+	}
+	r.addReview(number, BotLogin, states[event], sha)
+	return nil
+}
+
+func (r *Repo) PullRequestRequestReviewer(ctx context.Context, number int, reviewer string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.fail("PullRequestRequestReviewer"); err != nil {
+		return err
+	}
+	for _, login := range r.RequestedReviewers[number] {
+		if login == reviewer {
+			return nil
+		}
+	}
+	r.RequestedReviewers[number] = append(r.RequestedReviewers[number], reviewer)
+	return nil
+}
+
+func (r *Repo) PullRequestListReviewers(ctx context.Context, number int) (*github.Reviewers, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.fail("PullRequestListReviewers"); err != nil {
+		return nil, err
+	}
+	reviewers := &github.Reviewers{}
+	for _, login := range r.RequestedReviewers[number] {
+		reviewers.Users = append(reviewers.Users, &github.User{Login: github.String(login)})
+	}
+	return reviewers, nil
+}
+
+func (r *Repo) PullRequestListReviews(ctx context.Context, number int) ([]*github.PullRequestReview, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.fail("PullRequestListReviews"); err != nil {
+		return nil, err
+	}
+	return append([]*github.PullRequestReview(nil), r.Reviews[number]...), nil
+}
+
+func (r *Repo) IsTeamMember(ctx context.Context, org string, team string, user string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.fail("IsTeamMember"); err != nil {
+		return false, err
+	}
+	for _, member := range r.Teams[org+"/"+team] {
+		if member == user {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r *Repo) CollaboratorPermission(ctx context.Context, user string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.fail("CollaboratorPermission"); err != nil {
+		return "", err
+	}
+	if permission, ok := r.Permissions[user]; ok {
+		return permission, nil
+	}
+	return "none", nil
+}
+
+func (r *Repo) ListCheckRunsForRef(ctx context.Context, ref string) ([]*github.CheckRun, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.fail("ListCheckRunsForRef"); err != nil {
+		return nil, err
+	}
+	return append([]*github.CheckRun(nil), r.CheckRuns[ref]...), nil
+}
+
+// ListStatusesForRef returns the latest status of every context, like the
+// combined status.
+func (r *Repo) ListStatusesForRef(ctx context.Context, ref string) ([]*github.RepoStatus, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.fail("ListStatusesForRef"); err != nil {
+		return nil, err
+	}
+	latest := map[string]*github.RepoStatus{}
+	var contexts []string
+	for _, status := range r.Statuses[ref] {
+		if _, ok := latest[status.GetContext()]; !ok {
+			contexts = append(contexts, status.GetContext())
+		}
+		latest[status.GetContext()] = status
+	}
+	var statuses []*github.RepoStatus
+	for _, context := range contexts {
+		statuses = append(statuses, latest[context])
+	}
+	return statuses, nil
+}
+
+func (r *Repo) RequiredStatusChecks(ctx context.Context, branch string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.fail("RequiredStatusChecks"); err != nil {
+		return nil, err
+	}
+	return r.Required[branch], nil
+}
+
+func (r *Repo) CreateStatus(ctx context.Context, sha string, title string, desc string, state string, target_url string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.fail("CreateStatus"); err != nil {
+		return err
+	}
+	// Like the client, a cancelled call writes nothing.
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.Statuses[sha] = append(r.Statuses[sha], &github.RepoStatus{
+		Context:     github.String(title),
+		Description: github.String(desc),
+		State:       github.String(state),
+		TargetURL:   github.String(target_url),
+	})
+	return nil
+}
+
+func (r *Repo) CreateRelease(ctx context.Context, tagName, body string, preRelease bool) (*github.RepositoryRelease, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.fail("CreateRelease"); err != nil {
+		return nil, err
+	}
+	release := &github.RepositoryRelease{
+		TagName:     github.String(tagName),
+		Name:        github.String(tagName),
+		Body:        github.String(body),
+		Prerelease:  github.Bool(preRelease),
+		PublishedAt: &github.Timestamp{Time: time.Now()},
+	}
+	r.Releases = append(r.Releases, release)
+	return release, nil
+}
+
+// GetLatestRelease returns the last added release.
+func (r *Repo) GetLatestRelease(ctx context.Context) (*github.RepositoryRelease, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.fail("GetLatestRelease"); err != nil {
+		return nil, err
+	}
+	if len(r.Releases) == 0 {
+		return nil, nil
+	}
+	return r.Releases[len(r.Releases)-1], nil
+}
+
+func (r *Repo) IssueAssignTo(ctx context.Context, number int, assignee string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.fail("IssueAssignTo"); err != nil {
+		return err
+	}
+	r.Assignees[number] = append(r.Assignees[number], assignee)
+	return nil
+}
+
+// IssuesForFirstTime tells whether user opened none of the Issues.
+func (r *Repo) IssuesForFirstTime(ctx context.Context, user string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.fail("IssuesForFirstTime"); err != nil {
+		return false, err
+	}
+	for _, issue := range r.Issues {
+		if issue.GetUser().GetLogin() == user {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (r *Repo) AddLabelToIssue(ctx context.Context, number int, label string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.fail("AddLabelToIssue"); err != nil {
+		return err
+	}
+	for _, l := range r.Labels[number] {
+		if l == label {
+			return nil
+		}
+	}
+	r.Labels[number] = append(r.Labels[number], label)
+	return nil
+}
+
+func (r *Repo) ListLabelsForIssue(ctx context.Context, number int) ([]*github.Label, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.fail("ListLabelsForIssue"); err != nil {
+		return nil, err
+	}
+	var labels []*github.Label
+	for _, l := range r.Labels[number] {
+		labels = append(labels, &github.Label{Name: github.String(l)})
+	}
+	return labels, nil
+}
+
+func (r *Repo) CheckLabelExistsForIssue(ctx context.Context, number int, label string) (bool, error) {
+	labels, err := r.ListLabelsForIssue(ctx, number)
+	if err != nil {
+		return false, err
+	}
+	for _, l := range labels {
+		if l.GetName() == label {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r *Repo) RemoveLabelFromIssue(ctx context.Context, number int, label string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.fail("RemoveLabelFromIssue"); err != nil {
+		return err
+	}
+	labels := r.Labels[number]
+	for i, l := range labels {
+		if l == label {
+			r.Labels[number] = append(labels[:i:i], labels[i+1:]...)
+			return nil
+		}
+	}
+	return notFound("remove label")
+}
+
+func (r *Repo) ReplaceLabelsForIssue(ctx context.Context, number int, labels []string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.fail("ReplaceLabelsForIssue"); err != nil {
+		return err
+	}
+	for _, l := range labels {
+		if l == "" {
+			return &common.APIError{Op: "replace labels", StatusCode: http.StatusUnprocessableEntity, Err: errors.New("empty label name")}
+		}
+	}
+	r.Labels[number] = append([]string(nil), labels...)
+	return nil
+}
+
+func (r *Repo) RepositoriesDispatch(ctx context.Context, event string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.fail("RepositoriesDispatch"); err != nil {
+		return err
+	}
+	r.Dispatches = append(r.Dispatches, event)
+	return nil
+}
+
+func (r *Repo) GetFile(ctx context.Context, path string) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.fail("GetFile"); err != nil {
+		return nil, err
+	}
+	content, ok := r.Contents[path]
+	if !ok {
+		return nil, notFound("get contents")
+	}
+	return []byte(content), nil
+}
@@ -0,0 +1,323 @@
+// Copyright 2020-2021 The Datafuse Authors.
+//
+// SPDX-License-Identifier: Apache-2.0.
+
+package common
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"bots/config"
+	"bots/logging"
+)
+
+const (
+	// The cached bodies of one budget take at most this many bytes, larger
+	// responses are not cached.
+	etagCacheBytes = 32 << 20
+	// Waits longer than this fail the request instead of blocking the caller.
+	maxRateLimitWait = 2 * time.Minute
+)
+
+// RateLimit tracks the API budget of one token, as reported by GitHub.
+type RateLimit struct {
+	mu        sync.Mutex
+	reserve   int
+	limit     int
+	remaining int
+	reset     time.Time
+	// Set by the secondary rate limits and the exhausted budget.
+	blockedUntil time.Time
+}
+
+// budget is the API budget and the ETag cache shared by the clients of the
+// same credentials: a token, or an App installation.
+type budget struct {
+	limit *RateLimit
+	cache *etagCache
+}
+
+var (
+	budgetsMu sync.Mutex
+	budgets   = map[string]*budget{}
+)
+
+func budgetFor(key string, reserve int) *budget {
+	budgetsMu.Lock()
+	defer budgetsMu.Unlock()
+	b, ok := budgets[key]
+	if !ok {
+		b = &budget{
+			limit: &RateLimit{reserve: reserve, remaining: -1},
+			cache: newEtagCache(etagCacheBytes),
+		}
+		budgets[key] = b
+	}
+	return b
+}
+
+// budgetSource returns the budget of the credentials of a repository.
+type budgetSource func() (*budget, error)
+
+// budgetSourceFor keys the budget by token, or by App installation which is
+// only known once looked up, the repositories of one installation share it.
+func budgetSourceFor(cfg *config.Config) budgetSource {
+	reserve := cfg.Github.RateLimitReserve
+	if cfg.Github.AppID == 0 {
+		sum := sha256.Sum256([]byte(cfg.Github.GithubToken))
+		b := budgetFor("token:"+hex.EncodeToString(sum[:]), reserve)
+		return func() (*budget, error) {
+			return b, nil
+		}
+	}
+	return func() (*budget, error) {
+		app, err := AppFor(cfg)
+		if err != nil {
+			return nil, err
+		}
+		id, err := app.installationID(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return budgetFor(fmt.Sprintf("app:%d:installation:%d", cfg.Github.AppID, id), reserve), nil
+	}
+}
+
+// Remaining returns the remaining requests, -1 when not known yet.
+func (r *RateLimit) Remaining() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.remaining >= 0 && time.Now().After(r.reset) {
+		return r.limit
+	}
+	return r.remaining
+}
+
+func (r *RateLimit) Reset() time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.reset
+}
+
+// Low tells whether the budget is under the reserve, low priority work such as
+// the cron sweeps should be deferred.
+func (r *RateLimit) Low() bool {
+	remaining := r.Remaining()
+	return remaining >= 0 && remaining < r.reserve
+}
+
+func (r *RateLimit) update(resp *http.Response) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if v, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Limit")); err == nil {
+		r.limit = v
+	}
+	if v, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Remaining")); err == nil {
+		r.remaining = v
+	}
+	if v, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+		r.reset = time.Unix(v, 0)
+	}
+
+	if resp.StatusCode != http.StatusForbidden && resp.StatusCode != http.StatusTooManyRequests {
+		return
+	}
+	if v, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		r.blockedUntil = time.Now().Add(time.Duration(v) * time.Second)
+	} else if r.remaining == 0 {
+		r.blockedUntil = r.reset
+	}
+}
+
+func (r *RateLimit) wait() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return time.Until(r.blockedUntil)
+}
+
+type etagEntry struct {
+	key    string
+	etag   string
+	header http.Header
+	body   []byte
+}
+
+// etagCache keeps the last GET responses carrying an ETag, a 304 answer to
+// the conditional request does not count against the budget. The least
+// recently used bodies are dropped over maxBytes.
+type etagCache struct {
+	mu       sync.Mutex
+	maxBytes int
+	bytes    int
+	order    *list.List
+	entries  map[string]*list.Element
+}
+
+func newEtagCache(maxBytes int) *etagCache {
+	return &etagCache{
+		maxBytes: maxBytes,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+func (c *etagCache) get(key string) *etagEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.order.MoveToFront(e)
+		return e.Value.(*etagEntry)
+	}
+	return nil
+}
+
+func (c *etagCache) put(entry *etagEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[entry.key]; ok {
+		c.remove(e)
+	}
+	// A body of a quarter of the cache would flush it, do not keep it.
+	if len(entry.body) > c.maxBytes/4 {
+		return
+	}
+	c.entries[entry.key] = c.order.PushFront(entry)
+	c.bytes += len(entry.body)
+	for c.bytes > c.maxBytes {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *etagCache) remove(e *list.Element) {
+	entry := e.Value.(*etagEntry)
+	c.order.Remove(e)
+	delete(c.entries, entry.key)
+	c.bytes -= len(entry.body)
+}
+
+// rateLimitTransport waits out the rate limits, retries once after a
+// secondary rate limit and makes the GET requests conditional.
+type rateLimitTransport struct {
+	base   http.RoundTripper
+	budget budgetSource
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	b, err := t.budget()
+	if err != nil {
+		return nil, err
+	}
+	for attempt := 0; ; attempt++ {
+		if wait := b.limit.wait(); wait > 0 {
+			if wait > maxRateLimitWait {
+				return nil, &RateLimitedError{Until: time.Now().Add(wait)}
+			}
+			logging.From(req.Context()).Warnf("Github rate limited, wait %v", wait)
+			select {
+			case <-time.After(wait):
+			case <-req.Context().Done():
+				return nil, req.Context().Err()
+			}
+		}
+
+		resp, err := t.roundTrip(req, b.cache)
+		if err != nil {
+			return nil, err
+		}
+		b.limit.update(resp)
+
+		limited := resp.StatusCode == http.StatusTooManyRequests ||
+			(resp.StatusCode == http.StatusForbidden && resp.Header.Get("Retry-After") != "")
+		if !limited || attempt > 0 {
+			return resp, nil
+		}
+		if req.Body != nil && req.GetBody == nil {
+			return resp, nil
+		}
+		resp.Body.Close()
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
+
+func (t *rateLimitTransport) roundTrip(req *http.Request, cache *etagCache) (*http.Response, error) {
+	if req.Method != http.MethodGet {
+		return t.base.RoundTrip(req)
+	}
+
+	key := req.URL.String() + "|" + req.Header.Get("Accept") + "|" + req.Header.Get("Authorization")
+	sum := sha256.Sum256([]byte(key))
+	key = hex.EncodeToString(sum[:])
+	cached := cache.get(key)
+	if cached != nil {
+		req = req.Clone(req.Context())
+		req.Header.Set("If-None-Match", cached.etag)
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && cached != nil:
+		resp.Body.Close()
+		header := cached.header.Clone()
+		// Keep the fresh rate limit headers.
+		for _, h := range []string{"X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset"} {
+			if v := resp.Header.Get(h); v != "" {
+				header.Set(h, v)
+			}
+		}
+		return &http.Response{
+			Status:        "200 OK",
+			StatusCode:    http.StatusOK,
+			Proto:         resp.Proto,
+			ProtoMajor:    resp.ProtoMajor,
+			ProtoMinor:    resp.ProtoMinor,
+			Header:        header,
+			Body:          ioutil.NopCloser(bytes.NewReader(cached.body)),
+			ContentLength: int64(len(cached.body)),
+			Request:       req,
+		}, nil
+	case resp.StatusCode == http.StatusOK && resp.Header.Get("ETag") != "":
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		cache.put(&etagEntry{
+			key:    key,
+			etag:   resp.Header.Get("ETag"),
+			header: resp.Header.Clone(),
+			body:   body,
+		})
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	return resp, nil
+}
+
+// RateLimitedError is returned instead of waiting for a long rate limit.
+type RateLimitedError struct {
+	Until time.Time
+}
+
+func (e *RateLimitedError) Error() string {
+	return "github rate limited until " + e.Until.Format(time.RFC3339)
+}
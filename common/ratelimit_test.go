@@ -0,0 +1,234 @@
+// Copyright 2020-2021 The Datafuse Authors.
+//
+// SPDX-License-Identifier: Apache-2.0.
+
+package common
+
+import (
+	"bots/config"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeAPI answers the requests with the handler and records them.
+type fakeAPI struct {
+	mu       sync.Mutex
+	requests []*http.Request
+	handler  func(w http.ResponseWriter, r *http.Request, n int)
+}
+
+func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.requests = append(f.requests, r)
+	n := len(f.requests)
+	f.mu.Unlock()
+	f.handler(w, r, n)
+}
+
+func (f *fakeAPI) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.requests)
+}
+
+// newTestTransport returns a transport with its own budget against the fake.
+func newTestTransport(t *testing.T, f *fakeAPI) (*http.Client, *budget, string) {
+	t.Helper()
+	api := httptest.NewServer(f)
+	t.Cleanup(api.Close)
+	b := &budget{
+		limit: &RateLimit{reserve: 100, remaining: -1},
+		cache: newEtagCache(1 << 20),
+	}
+	client := &http.Client{Transport: &rateLimitTransport{
+		base:   http.DefaultTransport,
+		budget: func() (*budget, error) { return b, nil },
+	}}
+	return client, b, api.URL
+}
+
+func get(t *testing.T, client *http.Client, url string) (int, string, error) {
+	t.Helper()
+	resp, err := client.Get(url)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(body), nil
+}
+
+func TestTransportConditionalGet(t *testing.T) {
+	reset := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	f := &fakeAPI{handler: func(w http.ResponseWriter, r *http.Request, n int) {
+		w.Header().Set("X-RateLimit-Limit", "5000")
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(5000-n))
+		w.Header().Set("X-RateLimit-Reset", reset)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		fmt.Fprint(w, `{"number": 1}`)
+	}}
+	client, b, url := newTestTransport(t, f)
+
+	for i := 0; i < 2; i++ {
+		code, body, err := get(t, client, url+"/repos/o/r/pulls/1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The 304 is replayed as the cached 200.
+		if code != http.StatusOK || body != `{"number": 1}` {
+			t.Errorf("get %v: %v %v", i, code, body)
+		}
+	}
+	if f.requests[0].Header.Get("If-None-Match") != "" || f.requests[1].Header.Get("If-None-Match") != `"v1"` {
+		t.Errorf("If-None-Match: %q, %q", f.requests[0].Header.Get("If-None-Match"), f.requests[1].Header.Get("If-None-Match"))
+	}
+	// The budget follows the fresh headers of the 304.
+	if remaining := b.limit.Remaining(); remaining != 4998 {
+		t.Errorf("remaining: %v", remaining)
+	}
+}
+
+func TestTransportRetryAfter(t *testing.T) {
+	f := &fakeAPI{handler: func(w http.ResponseWriter, r *http.Request, n int) {
+		if n == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, "{}")
+	}}
+	client, _, url := newTestTransport(t, f)
+
+	start := time.Now()
+	code, _, err := get(t, client, url+"/repos/o/r")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK || f.count() != 2 {
+		t.Errorf("status %v after %v requests", code, f.count())
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("retried after %v only", elapsed)
+	}
+}
+
+func TestTransportResetWait(t *testing.T) {
+	reset := time.Now().Add(time.Hour)
+	f := &fakeAPI{handler: func(w http.ResponseWriter, r *http.Request, n int) {
+		w.Header().Set("X-RateLimit-Limit", "5000")
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+		w.WriteHeader(http.StatusForbidden)
+	}}
+	client, b, url := newTestTransport(t, f)
+
+	if code, _, err := get(t, client, url+"/repos/o/r"); err != nil || code != http.StatusForbidden {
+		t.Fatalf("first request: %v, %v", code, err)
+	}
+	// The exhausted budget fails at once rather than waiting an hour.
+	_, _, err := get(t, client, url+"/repos/o/r")
+	var limited *RateLimitedError
+	if !errors.As(err, &limited) || limited.Until.Before(reset.Add(-time.Second)) {
+		t.Errorf("error: %v", err)
+	}
+	if f.count() != 1 {
+		t.Errorf("requests: %v", f.count())
+	}
+	if !b.limit.Low() || b.limit.Reset().Unix() != reset.Unix() {
+		t.Errorf("low %v, reset %v", b.limit.Low(), b.limit.Reset())
+	}
+}
+
+func TestRateLimitBudget(t *testing.T) {
+	limit := &RateLimit{reserve: 100, remaining: -1}
+	if limit.Low() || limit.Remaining() != -1 {
+		t.Errorf("unknown budget: low %v, remaining %v", limit.Low(), limit.Remaining())
+	}
+
+	resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}}
+	resp.Header.Set("X-RateLimit-Limit", "5000")
+	resp.Header.Set("X-RateLimit-Remaining", "50")
+	resp.Header.Set("X-RateLimit-Reset", strconv.FormatInt(time.Now().Add(time.Minute).Unix(), 10))
+	limit.update(resp)
+	if !limit.Low() || limit.Remaining() != 50 {
+		t.Errorf("low %v, remaining %v", limit.Low(), limit.Remaining())
+	}
+
+	// Past the reset the whole limit is available again.
+	resp.Header.Set("X-RateLimit-Reset", strconv.FormatInt(time.Now().Add(-time.Second).Unix(), 10))
+	limit.update(resp)
+	if limit.Low() || limit.Remaining() != 5000 {
+		t.Errorf("after reset: low %v, remaining %v", limit.Low(), limit.Remaining())
+	}
+}
+
+func TestEtagCacheBytes(t *testing.T) {
+	cache := newEtagCache(100)
+	for i := 0; i < 5; i++ {
+		cache.put(&etagEntry{key: strconv.Itoa(i), body: make([]byte, 20)})
+	}
+	cache.get("0")
+	cache.put(&etagEntry{key: "5", body: make([]byte, 20)})
+	// The least recently used 1 made room, 0 was just read.
+	if cache.get("1") != nil || cache.get("0") == nil || cache.get("5") == nil || cache.bytes != 100 {
+		t.Errorf("cache: %v entries, %v bytes", cache.order.Len(), cache.bytes)
+	}
+
+	cache.put(&etagEntry{key: "big", body: make([]byte, 30)})
+	cache.put(&etagEntry{key: "0", body: make([]byte, 10)})
+	if cache.get("big") != nil || cache.bytes != 90 {
+		t.Errorf("cache: %v entries, %v bytes", cache.order.Len(), cache.bytes)
+	}
+}
+
+func TestBudgetPerInstallation(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "app.pem")
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := ioutil.WriteFile(file, pemBytes, 0600); err != nil {
+		t.Fatal(err)
+	}
+	appConfig := func(name string, installation int64) *config.Config {
+		return &config.Config{Github: &config.GithubConfig{
+			RepoOwner:         "datafuselabs",
+			RepoName:          name,
+			AppID:             4242,
+			AppPrivateKey:     file,
+			AppInstallationID: installation,
+		}}
+	}
+
+	budgets := make([]*budget, 0, 3)
+	for _, cfg := range []*config.Config{appConfig("databend", 1), appConfig("docs", 1), appConfig("other", 2)} {
+		b, err := budgetSourceFor(cfg)()
+		if err != nil {
+			t.Fatal(err)
+		}
+		budgets = append(budgets, b)
+	}
+	if budgets[0] != budgets[1] || budgets[0] == budgets[2] {
+		t.Errorf("budgets: %p, %p, %p", budgets[0], budgets[1], budgets[2])
+	}
+}
@@ -128,7 +128,3 @@ func createSemanticVersion(versions []int, typ bumpType) string {
 
 	return sm
 }
-
-func HelpMessage() string {
-	return "/assignme -- assign the issue to you\n/review @[username] -- take a reviewer for you\n/help -- show help"
-}
@@ -5,7 +5,9 @@
 package config
 
 import (
-	"log"
+	"fmt"
+	"strings"
+	"time"
 
 	ini "gopkg.in/ini.v1"
 )
@@ -16,11 +18,34 @@ type HintConfig struct {
 }
 
 type GithubConfig struct {
-	GithubToken  string `ini:"token"`
-	GithubSecret string `ini:"secret"`
-	RepoOwner    string `ini:"owner"`
-	RepoName     string `ini:"name"`
-	BaseBranch   string `ini:"base_branch"`
+	GithubToken  string   `ini:"token"`
+	GithubSecret string   `ini:"secret"`
+	RepoOwner    string   `ini:"owner"`
+	RepoName     string   `ini:"name"`
+	BaseBranch   string   `ini:"base_branch"`
+	Repos        []string `ini:"repos"`
+	// GitHub App mode, used instead of the token when app_id is set.
+	AppID             int64  `ini:"app_id"`
+	AppPrivateKey     string `ini:"app_private_key"`
+	AppInstallationID int64  `ini:"app_installation_id"`
+	// Login of the bot, looked up from the credentials when empty, its own
+	// events are not dispatched to the actions reacting to users.
+	BotLogin string `ini:"bot_login"`
+	// API base url, empty for api.github.com.
+	APIURL string `ini:"api_url"`
+	// DryRun logs the writes to GitHub instead of doing them.
+	DryRun bool `ini:"dry_run"`
+	// The cron sweeps are deferred when fewer API requests remain.
+	RateLimitReserve int `ini:"rate_limit_reserve"`
+	// Every API call attempt times out after Timeout, the idempotent ones are
+	// retried on server and network errors.
+	Timeout      time.Duration `ini:"timeout"`
+	Retries      int           `ini:"retries"`
+	RetryBackoff time.Duration `ini:"retry_backoff"`
+}
+
+func (c *GithubConfig) FullName() string {
+	return c.RepoOwner + "/" + c.RepoName
 }
 
 type PRDescriptionActionConfig struct {
@@ -38,16 +63,142 @@ type DisablesConfig struct {
 	DisableLabel     bool `ini:"disable_label"`
 }
 
+type StoreConfig struct {
+	// memory or bolt.
+	Type string `ini:"type"`
+	Path string `ini:"path"`
+}
+
+type QueueConfig struct {
+	Workers      int           `ini:"workers"`
+	Size         int           `ini:"size"`
+	MaxAttempts  int           `ini:"max_attempts"`
+	RetryBackoff time.Duration `ini:"retry_backoff"`
+}
+
+type WebhookConfig struct {
+	// Raw payloads are kept here for replay, empty disables it.
+	PayloadDir       string        `ini:"payload_dir"`
+	PayloadRetention time.Duration `ini:"payload_retention"`
+	// The events sent by these logins are dropped, e.g. other bots.
+	IgnoreSenders []string `ini:"ignore_senders"`
+}
+
+// CommandsConfig is the permission each slash command needs: anyone, author
+// (of the issue or pull request), triage, write, maintain, admin, or
+// team:<org>/<team>. The repository roles include the higher ones, and a
+// writer may act for the author.
+type CommandsConfig struct {
+	AssignMe string `ini:"assignme"`
+	Assign   string `ini:"assign"`
+	Review   string `ini:"review"`
+	Approve  string `ini:"approve"`
+	Merge    string `ini:"merge"`
+	Help     string `ini:"help"`
+}
+
+// Permission levels of the commands.
+const (
+	PermissionAnyone   = "anyone"
+	PermissionAuthor   = "author"
+	PermissionTriage   = "triage"
+	PermissionWrite    = "write"
+	PermissionMaintain = "maintain"
+	PermissionAdmin    = "admin"
+	PermissionTeam     = "team:"
+)
+
+// ValidPermission tells whether level is a known command permission.
+func ValidPermission(level string) bool {
+	switch level {
+	case PermissionAnyone, PermissionAuthor, PermissionTriage, PermissionWrite, PermissionMaintain, PermissionAdmin:
+		return true
+	}
+	team := strings.Split(strings.TrimPrefix(level, PermissionTeam), "/")
+	return strings.HasPrefix(level, PermissionTeam) && len(team) == 2 && team[0] != "" && team[1] != ""
+}
+
+type AuditConfig struct {
+	// JSON lines file recording every write to GitHub, empty disables it.
+	Path string `ini:"path"`
+}
+
+type LogConfig struct {
+	// panic, fatal, error, warn, info, debug or trace.
+	Level string `ini:"level"`
+	// text or json.
+	Format string `ini:"format"`
+}
+
+type ServerConfig struct {
+	// Listen address and path of the webhooks.
+	Listen string `ini:"listen"`
+	Path   string `ini:"path"`
+	// HTTPS when both are set, the files are reloaded once changed.
+	TLSCert string `ini:"tls_cert"`
+	TLSKey  string `ini:"tls_key"`
+	// Larger webhook bodies are refused.
+	MaxBodySize  int64         `ini:"max_body_size"`
+	ReadTimeout  time.Duration `ini:"read_timeout"`
+	WriteTimeout time.Duration `ini:"write_timeout"`
+	IdleTimeout  time.Duration `ini:"idle_timeout"`
+	// On SIGINT or SIGTERM the queued events and running jobs are drained
+	// for at most ShutdownTimeout, the unfinished ones are cancelled.
+	ShutdownTimeout time.Duration `ini:"shutdown_timeout"`
+}
+
+type RuleConfig struct {
+	// most: required_approvals, the lgtm2 label standing for the last one,
+	// all: required_approvals and every requested reviewer,
+	// any: a single approval.
+	ApprovedRule            string `ini:"approved_rule"`
+	RequiredApprovals       int    `ini:"required_approvals"`
+	BlockOnChangesRequested bool   `ini:"block_on_changes_requested"`
+	DismissStaleApprovals   bool   `ini:"dismiss_stale_approvals"`
+	// CODEOWNERS style file of the reviewers or teams required per path.
+	CodeOwners string `ini:"codeowners"`
+	// merge, squash or rebase, a merge-<method> label or /merge <method>
+	// overrides it per pull request.
+	MergeMethod string `ini:"merge_method"`
+	// Pull request body sections making the squash commit message.
+	SquashSections []string `ini:"squash_sections"`
+	// The merge queue head is evicted when its branch update or its CI takes
+	// longer, 0 waits forever.
+	MergeQueueTimeout time.Duration `ini:"merge_queue_timeout"`
+}
+
+// BranchRuleConfig is a [rule:<base branch glob>] section.
+type BranchRuleConfig struct {
+	Branch string
+	Rule   *RuleConfig
+}
+
 type Config struct {
 	Github              *GithubConfig
 	PRDescriptionAction *PRDescriptionActionConfig
 	Hints               *HintConfig
 	Disables            *DisablesConfig
+	Store               *StoreConfig
+	Queue               *QueueConfig
+	Webhook             *WebhookConfig
+	Server              *ServerConfig
+	Log                 *LogConfig
+	Audit               *AuditConfig
+	Commands            *CommandsConfig
 	NightReleaseCron    string
 	MergeCheckCron      string
-	ApprovedRule        string
+	Rule                *RuleConfig
+	BranchRules         []*BranchRuleConfig
+	// Repos holds one derived config per repository, with the repo section
+	// overrides applied on top of the global sections.
+	Repos []*Config
 }
 
+const (
+	repoSectionPrefix = "repo:"
+	ruleSectionPrefix = "rule:"
+)
+
 func LoadConfig(file string) (*Config, error) {
 	cfg := &Config{}
 	load, err := ini.Load(file)
@@ -56,9 +207,14 @@ func LoadConfig(file string) (*Config, error) {
 	}
 
 	// Github.
-	cfg.Github = new(GithubConfig)
+	cfg.Github = &GithubConfig{
+		RateLimitReserve: 500,
+		Timeout:          10 * time.Second,
+		Retries:          3,
+		RetryBackoff:     500 * time.Millisecond,
+	}
 	if err := load.Section("github").MapTo(cfg.Github); err != nil {
-		log.Fatalf("Can not load gihutb section:%+v", err)
+		return nil, fmt.Errorf("load github section: %w", err)
 	}
 	if cfg.Github.BaseBranch == "" {
 		cfg.Github.BaseBranch = "main"
@@ -67,9 +223,8 @@ func LoadConfig(file string) (*Config, error) {
 	// PR desc action.
 	cfg.PRDescriptionAction = new(PRDescriptionActionConfig)
 	if err := load.Section("pr_description_action").MapTo(cfg.PRDescriptionAction); err != nil {
-		log.Fatalf("Can not load pr description action section:%+v", err)
+		return nil, fmt.Errorf("load pr description action section: %w", err)
 	}
-	log.Printf("Pr desc action action:%+v", cfg.PRDescriptionAction)
 
 	// Schedule.
 	cfg.NightReleaseCron = load.Section("schedule").Key("nightly_release_cron").String()
@@ -78,28 +233,200 @@ func LoadConfig(file string) (*Config, error) {
 	}
 	cfg.MergeCheckCron = load.Section("schedule").Key("merge_check_cron").String()
 	if cfg.MergeCheckCron == "" {
-		cfg.MergeCheckCron = "@every 30s"
+		cfg.MergeCheckCron = "@every 10m"
 	}
 
 	// Rule.
-	cfg.ApprovedRule = load.Section("rule").Key("approved_rule").String()
-	if cfg.ApprovedRule == "" {
-		cfg.ApprovedRule = "most"
+	cfg.Rule = &RuleConfig{
+		ApprovedRule:            "most",
+		RequiredApprovals:       2,
+		BlockOnChangesRequested: true,
+		MergeMethod:             "merge",
+		SquashSections:          []string{"Summary"},
+		MergeQueueTimeout:       2 * time.Hour,
+	}
+	if err := load.Section("rule").MapTo(cfg.Rule); err != nil {
+		return nil, fmt.Errorf("load rule section: %w", err)
 	}
 
 	// Hints.
 	cfg.Hints = new(HintConfig)
 	if err := load.Section("hint").MapTo(cfg.Hints); err != nil {
-		log.Fatalf("Can not load hint section:%+v", err)
+		return nil, fmt.Errorf("load hint section: %w", err)
 	}
-	log.Printf("Hint action:%+v", cfg.Hints)
 
 	// Disables.
 	cfg.Disables = new(DisablesConfig)
 	if err := load.Section("disables").MapTo(cfg.Disables); err != nil {
-		log.Fatalf("Can not load disables section:%+v", err)
+		return nil, fmt.Errorf("load disables section: %w", err)
+	}
+
+	// Store.
+	cfg.Store = new(StoreConfig)
+	if err := load.Section("store").MapTo(cfg.Store); err != nil {
+		return nil, fmt.Errorf("load store section: %w", err)
+	}
+	if cfg.Store.Type == "" {
+		cfg.Store.Type = "memory"
+	}
+
+	// Queue.
+	cfg.Queue = &QueueConfig{
+		Workers:      4,
+		Size:         100,
+		MaxAttempts:  5,
+		RetryBackoff: time.Second,
+	}
+	if err := load.Section("queue").MapTo(cfg.Queue); err != nil {
+		return nil, fmt.Errorf("load queue section: %w", err)
+	}
+
+	// Webhook.
+	cfg.Webhook = &WebhookConfig{
+		PayloadRetention: 72 * time.Hour,
+	}
+	if err := load.Section("webhook").MapTo(cfg.Webhook); err != nil {
+		return nil, fmt.Errorf("load webhook section: %w", err)
+	}
+
+	// Server.
+	cfg.Server = &ServerConfig{
+		Listen: ":3000",
+		Path:   "/webhooks",
+		// GitHub caps the payloads at 25 MB.
+		MaxBodySize:     25 << 20,
+		ReadTimeout:     30 * time.Second,
+		WriteTimeout:    30 * time.Second,
+		IdleTimeout:     2 * time.Minute,
+		ShutdownTimeout: 30 * time.Second,
+	}
+	if err := load.Section("server").MapTo(cfg.Server); err != nil {
+		return nil, fmt.Errorf("load server section: %w", err)
+	}
+	if (cfg.Server.TLSCert == "") != (cfg.Server.TLSKey == "") {
+		return nil, fmt.Errorf("server tls_cert and tls_key must be set together")
+	}
+
+	// Log.
+	cfg.Log = &LogConfig{
+		Level:  "info",
+		Format: "text",
+	}
+	if err := load.Section("log").MapTo(cfg.Log); err != nil {
+		return nil, fmt.Errorf("load log section: %w", err)
+	}
+
+	// Audit.
+	cfg.Audit = new(AuditConfig)
+	if err := load.Section("audit").MapTo(cfg.Audit); err != nil {
+		return nil, fmt.Errorf("load audit section: %w", err)
+	}
+
+	// Commands.
+	cfg.Commands = &CommandsConfig{
+		AssignMe: PermissionAnyone,
+		Assign:   PermissionTriage,
+		Review:   PermissionAuthor,
+		Approve:  PermissionWrite,
+		Merge:    PermissionAuthor,
+		Help:     PermissionAnyone,
+	}
+	if err := load.Section("commands").MapTo(cfg.Commands); err != nil {
+		return nil, fmt.Errorf("load commands section: %w", err)
+	}
+	for _, level := range []string{cfg.Commands.AssignMe, cfg.Commands.Assign, cfg.Commands.Review, cfg.Commands.Approve, cfg.Commands.Merge, cfg.Commands.Help} {
+		if !ValidPermission(level) {
+			return nil, fmt.Errorf("unknown command permission: %v", level)
+		}
+	}
+
+	// Repos.
+	repos := cfg.Github.Repos
+	if len(repos) == 0 {
+		repos = []string{cfg.Github.FullName()}
+	}
+	for _, repo := range repos {
+		repoCfg, err := cfg.repoConfig(load, strings.TrimSpace(repo))
+		if err != nil {
+			return nil, err
+		}
+		cfg.Repos = append(cfg.Repos, repoCfg)
 	}
-	log.Printf("Disables conf:%+v", cfg.Disables)
 
 	return cfg, nil
 }
+
+// SetDryRun turns the dry run on for all the repositories.
+func (c *Config) SetDryRun() {
+	c.Github.DryRun = true
+	for _, repo := range c.Repos {
+		repo.Github.DryRun = true
+	}
+}
+
+// repoConfig derives the config of one repository, the [repo:owner/name]
+// section may override any key of the github, rule, schedule, hint and
+// disables sections.
+func (c *Config) repoConfig(load *ini.File, fullName string) (*Config, error) {
+	parts := strings.Split(fullName, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid repo name: %v, want owner/name", fullName)
+	}
+
+	github := *c.Github
+	github.Repos = nil
+	pr := *c.PRDescriptionAction
+	hints := *c.Hints
+	disables := *c.Disables
+	rule := *c.Rule
+	repoCfg := &Config{
+		Github:              &github,
+		PRDescriptionAction: &pr,
+		Hints:               &hints,
+		Disables:            &disables,
+		Store:               c.Store,
+		Queue:               c.Queue,
+		Webhook:             c.Webhook,
+		Server:              c.Server,
+		Log:                 c.Log,
+		Audit:               c.Audit,
+		Commands:            c.Commands,
+		NightReleaseCron:    c.NightReleaseCron,
+		MergeCheckCron:      c.MergeCheckCron,
+		Rule:                &rule,
+	}
+
+	section, err := load.GetSection(repoSectionPrefix + fullName)
+	if err == nil {
+		for _, to := range []interface{}{repoCfg.Github, repoCfg.PRDescriptionAction, repoCfg.Hints, repoCfg.Disables, repoCfg.Rule} {
+			if err := section.MapTo(to); err != nil {
+				return nil, fmt.Errorf("load repo %v section: %w", fullName, err)
+			}
+		}
+		if section.HasKey("nightly_release_cron") {
+			repoCfg.NightReleaseCron = section.Key("nightly_release_cron").String()
+		}
+		if section.HasKey("merge_check_cron") {
+			repoCfg.MergeCheckCron = section.Key("merge_check_cron").String()
+		}
+	}
+
+	// Base branch rules apply on top of the repo rule.
+	for _, section := range load.Sections() {
+		if !strings.HasPrefix(section.Name(), ruleSectionPrefix) {
+			continue
+		}
+		branchRule := *repoCfg.Rule
+		if err := section.MapTo(&branchRule); err != nil {
+			return nil, fmt.Errorf("load %v section: %w", section.Name(), err)
+		}
+		repoCfg.BranchRules = append(repoCfg.BranchRules, &BranchRuleConfig{
+			Branch: strings.TrimPrefix(section.Name(), ruleSectionPrefix),
+			Rule:   &branchRule,
+		})
+	}
+
+	repoCfg.Github.RepoOwner = parts[0]
+	repoCfg.Github.RepoName = parts[1]
+	return repoCfg, nil
+}
@@ -0,0 +1,74 @@
+// Copyright 2020-2021 The Datafuse Authors.
+//
+// SPDX-License-Identifier: Apache-2.0.
+
+// Package logging sets up logrus from the config and carries the correlation
+// fields of the event or cron run being handled in the context.
+package logging
+
+import (
+	"bots/config"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type fieldsKey struct{}
+
+// Setup applies the level and format of the log section.
+func Setup(cfg *config.LogConfig) error {
+	level, err := log.ParseLevel(cfg.Level)
+	if err != nil {
+		return err
+	}
+	log.SetLevel(level)
+	log.SetOutput(os.Stderr)
+
+	switch cfg.Format {
+	case "text", "":
+		log.SetFormatter(&log.TextFormatter{FullTimestamp: true})
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("unknown log format: %v, want text or json", cfg.Format)
+	}
+	return nil
+}
+
+// With returns a ctx whose logger also carries fields.
+func With(ctx context.Context, fields log.Fields) context.Context {
+	merged := make(log.Fields, len(fields))
+	if parent, ok := ctx.Value(fieldsKey{}).(log.Fields); ok {
+		for k, v := range parent {
+			merged[k] = v
+		}
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return context.WithValue(ctx, fieldsKey{}, merged)
+}
+
+// From returns the logger of ctx, with the fields of the event or cron run.
+func From(ctx context.Context) *log.Entry {
+	return log.WithFields(Fields(ctx))
+}
+
+// Fields returns the fields of ctx, not to be modified.
+func Fields(ctx context.Context) log.Fields {
+	fields, _ := ctx.Value(fieldsKey{}).(log.Fields)
+	return fields
+}
+
+// NewRunID returns a random ID tagging the lines of one cron run.
+func NewRunID() string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
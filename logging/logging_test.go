@@ -0,0 +1,55 @@
+// Copyright 2020-2021 The Datafuse Authors.
+//
+// SPDX-License-Identifier: Apache-2.0.
+
+package logging
+
+import (
+	"bots/config"
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestFields(t *testing.T) {
+	if err := Setup(&config.LogConfig{Level: "info", Format: "json"}); err != nil {
+		t.Fatal(err)
+	}
+	defer Setup(&config.LogConfig{Level: "info", Format: "text"})
+	var out bytes.Buffer
+	log.SetOutput(&out)
+
+	ctx := With(context.Background(), log.Fields{"delivery": "d1", "number": 5})
+	child := With(ctx, log.Fields{"action": "issue", "number": 7})
+	From(child).Infof("Assigned")
+	From(ctx).Debugf("Not logged at info")
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &line); err != nil {
+		t.Fatalf("%v: %s", err, out.String())
+	}
+	want := map[string]interface{}{"delivery": "d1", "action": "issue", "number": 7.0, "msg": "Assigned", "level": "info"}
+	for k, v := range want {
+		if line[k] != v {
+			t.Errorf("%v: %v, want %v", k, line[k], v)
+		}
+	}
+	// The parent fields are left as they were.
+	if fields := ctx.Value(fieldsKey{}).(log.Fields); fields["number"] != 5 || fields["action"] != nil {
+		t.Errorf("parent fields: %v", fields)
+	}
+}
+
+func TestSetupErrors(t *testing.T) {
+	for _, cfg := range []*config.LogConfig{
+		{Level: "loud", Format: "text"},
+		{Level: "info", Format: "xml"},
+	} {
+		if err := Setup(cfg); err == nil {
+			t.Errorf("%+v: no error", cfg)
+		}
+	}
+}
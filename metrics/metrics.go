@@ -0,0 +1,71 @@
+// Copyright 2020-2021 The Datafuse Authors.
+//
+// SPDX-License-Identifier: Apache-2.0.
+
+// Package metrics holds the Prometheus metrics of fusebots, served on /metrics.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "fusebots"
+
+var (
+	// WebhookEvents counts the webhook deliveries by event type and result:
+	// accepted, duplicate, unauthorized, unhandled, rejected or too_large.
+	WebhookEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "webhook_events_total",
+		Help:      "Webhook deliveries by event type and result.",
+	}, []string{"event", "result"})
+
+	// ActionRuns counts the action runs on the events by outcome, ok or error.
+	ActionRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "action_runs_total",
+		Help:      "Action runs on webhook events by event type and outcome.",
+	}, []string{"action", "event", "outcome"})
+
+	GithubRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "github_request_duration_seconds",
+		Help:      "GitHub API call latency, retries included, by operation and outcome.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"repo", "op", "outcome"})
+
+	GithubRateLimitRemaining = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "github_rate_limit_remaining",
+		Help:      "GitHub API requests left in the current rate limit window.",
+	}, []string{"repo"})
+
+	Merges = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "merges_total",
+		Help:      "Pull requests merged.",
+	}, []string{"repo"})
+
+	Releases = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "releases_total",
+		Help:      "Releases created.",
+	}, []string{"repo"})
+
+	// CronLastRun is the end time of the last run of the auto-merge and
+	// nightly-release crons.
+	CronLastRun = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cron_last_run_timestamp_seconds",
+		Help:      "Unix time the cron last finished a run.",
+	}, []string{"repo", "cron"})
+)
+
+// Outcome is the outcome label of err.
+func Outcome(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
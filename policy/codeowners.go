@@ -0,0 +1,110 @@
+// Copyright 2020-2021 The Datafuse Authors.
+//
+// SPDX-License-Identifier: Apache-2.0.
+
+package policy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+// OwnerRule is one CODEOWNERS line.
+type OwnerRule struct {
+	Pattern string
+	// Owners are users (@login) or teams (@org/slug).
+	Owners []string
+	re     *regexp.Regexp
+}
+
+// CodeOwners is a parsed CODEOWNERS file, the last matching rule wins.
+type CodeOwners struct {
+	Rules []*OwnerRule
+}
+
+func LoadCodeOwners(file string) (*CodeOwners, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return ParseCodeOwners(data)
+}
+
+func ParseCodeOwners(data []byte) (*CodeOwners, error) {
+	owners := &CodeOwners{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if i := strings.Index(line, " #"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		re, err := patternRegexp(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("codeowners line %d: %w", lineNo, err)
+		}
+		rule := &OwnerRule{
+			Pattern: fields[0],
+			re:      re,
+		}
+		for _, owner := range fields[1:] {
+			rule.Owners = append(rule.Owners, strings.TrimPrefix(owner, "@"))
+		}
+		owners.Rules = append(owners.Rules, rule)
+	}
+	return owners, scanner.Err()
+}
+
+// Match returns the rule owning the path, nil when none.
+func (c *CodeOwners) Match(path string) *OwnerRule {
+	for i := len(c.Rules) - 1; i >= 0; i-- {
+		if c.Rules[i].re.MatchString(path) {
+			return c.Rules[i]
+		}
+	}
+	return nil
+}
+
+// patternRegexp translates a gitignore style pattern, patterns without an
+// inner slash match at any depth and every pattern matches the files below
+// a matched directory, but a trailing /* only the files directly in it.
+func patternRegexp(pattern string) (*regexp.Regexp, error) {
+	anchored := strings.Contains(strings.TrimSuffix(pattern, "/"), "/")
+	shallow := strings.HasSuffix(pattern, "/*")
+	pattern = strings.TrimPrefix(pattern, "/")
+	pattern = strings.TrimSuffix(pattern, "/")
+
+	var expr strings.Builder
+	expr.WriteString("^")
+	if !anchored {
+		expr.WriteString("(.*/)?")
+	}
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			expr.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			expr.WriteString(".*")
+			i++
+		case c == '*':
+			expr.WriteString("[^/]*")
+		case c == '?':
+			expr.WriteString("[^/]")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	if !shallow {
+		expr.WriteString("(/.*)?")
+	}
+	expr.WriteString("$")
+	return regexp.Compile(expr.String())
+}
@@ -0,0 +1,84 @@
+// Copyright 2020-2021 The Datafuse Authors.
+//
+// SPDX-License-Identifier: Apache-2.0.
+
+package policy
+
+import (
+	"testing"
+)
+
+const testCodeOwners = `
+# Default owners.
+*                  @alice
+*.go               @gophers
+/docs/             @datafuselabs/docs # the docs team
+logs/              @carol
+build/logs/        @bob
+src/**/test        @dave
+**/fixtures        @erin
+/config/*          @frank
+/vendor/
+`
+
+func TestCodeOwnersMatch(t *testing.T) {
+	owners, err := ParseCodeOwners([]byte(testCodeOwners))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path    string
+		pattern string
+		owners  []string
+	}{
+		{path: "README.md", pattern: "*", owners: []string{"alice"}},
+		// The last matching rule wins.
+		{path: "main.go", pattern: "*.go", owners: []string{"gophers"}},
+		{path: "query/planner/plan.go", pattern: "*.go", owners: []string{"gophers"}},
+		// An anchored directory matches below it only.
+		{path: "docs/guide/intro.md", pattern: "/docs/", owners: []string{"datafuselabs/docs"}},
+		{path: "web/docs/intro.md", pattern: "*", owners: []string{"alice"}},
+		// A pattern with an inner slash is anchored, even without the leading one.
+		{path: "build/logs/out.txt", pattern: "build/logs/", owners: []string{"bob"}},
+		{path: "tools/build/logs/out.txt", pattern: "logs/", owners: []string{"carol"}},
+		// A directory without an inner slash matches at any depth.
+		{path: "logs/out.txt", pattern: "logs/", owners: []string{"carol"}},
+		{path: "a/b/logs/out.txt", pattern: "logs/", owners: []string{"carol"}},
+		// ** matches any directories, none included.
+		{path: "src/test/case.rs", pattern: "src/**/test", owners: []string{"dave"}},
+		{path: "src/query/sql/test/case.rs", pattern: "src/**/test", owners: []string{"dave"}},
+		{path: "lib/src/test/case.rs", pattern: "*", owners: []string{"alice"}},
+		{path: "fixtures/a.json", pattern: "**/fixtures", owners: []string{"erin"}},
+		{path: "tests/it/fixtures/a.json", pattern: "**/fixtures", owners: []string{"erin"}},
+		// A trailing /* matches the files of the directory, not the nested ones.
+		{path: "config/bots.ini", pattern: "/config/*", owners: []string{"frank"}},
+		{path: "config/repos/bots.ini", pattern: "*", owners: []string{"alice"}},
+		// A rule without owners takes the path from the previous ones.
+		{path: "vendor/lib/lib.go", pattern: "/vendor/"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			rule := owners.Match(test.path)
+			if rule == nil {
+				t.Fatal("no rule")
+			}
+			if rule.Pattern != test.pattern || !equalStrings(rule.Owners, test.owners...) {
+				t.Errorf("rule %v %v, want %v %v", rule.Pattern, rule.Owners, test.pattern, test.owners)
+			}
+		})
+	}
+}
+
+func TestCodeOwnersNoMatch(t *testing.T) {
+	owners, err := ParseCodeOwners([]byte("/docs/ @alice\n*.md @bob\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"main.go", "docs.go", "web/docs/main.go"} {
+		if rule := owners.Match(path); rule != nil {
+			t.Errorf("%v owned by %v", path, rule.Pattern)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2020-2021 The Datafuse Authors.
+//
+// SPDX-License-Identifier: Apache-2.0.
+
+package policy
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	MergeMethodMerge  = "merge"
+	MergeMethodSquash = "squash"
+	MergeMethodRebase = "rebase"
+
+	// MergeMethodLabelPrefix labels select the method of a pull request,
+	// e.g. merge-squash.
+	MergeMethodLabelPrefix = "merge-"
+)
+
+var (
+	headingReg = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*\s*$`)
+	commentReg = regexp.MustCompile(`(?s)<!--.*?-->`)
+	fenceReg   = regexp.MustCompile("^ {0,3}(```|~~~)")
+)
+
+func ValidMergeMethod(method string) bool {
+	switch method {
+	case MergeMethodMerge, MergeMethodSquash, MergeMethodRebase:
+		return true
+	}
+	return false
+}
+
+// MergeMethod returns the method selected by a merge-<method> label, or the
+// rule one.
+func (r *Rule) MergeMethod(labels []string) string {
+	for _, label := range labels {
+		if method := strings.TrimPrefix(label, MergeMethodLabelPrefix); method != label && ValidMergeMethod(method) {
+			return method
+		}
+	}
+	return r.cfg.MergeMethod
+}
+
+// SquashMessage builds the squash commit title from the pull request title
+// and number, and the message from the configured body sections.
+func (r *Rule) SquashMessage(number int, title string, body string) (string, string) {
+	var parts []string
+	for _, section := range r.cfg.SquashSections {
+		if content := BodySection(body, section); content != "" {
+			parts = append(parts, content)
+		}
+	}
+	title = strings.TrimSpace(title)
+	if suffix := fmt.Sprintf("(#%d)", number); !strings.HasSuffix(title, suffix) {
+		title += " " + suffix
+	}
+	return title, strings.Join(parts, "\n\n")
+}
+
+// BodySection returns the content under the markdown heading named section,
+// up to the next heading of the same or a higher level, without the HTML
+// comments of the templates. The lines of code blocks are no headings.
+func BodySection(body string, section string) string {
+	body = commentReg.ReplaceAllString(strings.ReplaceAll(body, "\r\n", "\n"), "")
+
+	level := 0
+	fenced := false
+	var lines []string
+	for _, line := range strings.Split(body, "\n") {
+		if fenceReg.MatchString(line) {
+			fenced = !fenced
+		}
+		if m := headingReg.FindStringSubmatch(line); m != nil && !fenced {
+			if level > 0 && len(m[1]) <= level {
+				break
+			}
+			if level == 0 && strings.EqualFold(m[2], section) {
+				level = len(m[1])
+				continue
+			}
+		}
+		if level > 0 {
+			lines = append(lines, line)
+		}
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
@@ -0,0 +1,177 @@
+// Copyright 2020-2021 The Datafuse Authors.
+//
+// SPDX-License-Identifier: Apache-2.0.
+
+package policy
+
+import (
+	"bots/config"
+	"testing"
+)
+
+func TestBodySection(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		section string
+		want    string
+	}{
+		{
+			name:    "up to the next heading",
+			body:    "## Summary\n\nFix the planner.\n\n## Changelog\n\n- Bug Fix\n",
+			section: "Summary",
+			want:    "Fix the planner.",
+		},
+		{
+			name:    "last section",
+			body:    "## Summary\nFix the planner.\n\n## Changelog\n- Bug Fix\n- Improvement\n",
+			section: "Changelog",
+			want:    "- Bug Fix\n- Improvement",
+		},
+		{
+			name:    "deeper headings kept",
+			body:    "## Summary\nFix the planner.\n### Notes\nNo migration.\n## Tests\nUnit",
+			section: "Summary",
+			want:    "Fix the planner.\n### Notes\nNo migration.",
+		},
+		{
+			name:    "higher heading ends it",
+			body:    "### Summary\nFix the planner.\n# Tests\nUnit",
+			section: "Summary",
+			want:    "Fix the planner.",
+		},
+		{
+			name:    "nested section",
+			body:    "# Pull request\n## Summary\nFix the planner.\n## Tests\nUnit",
+			section: "Summary",
+			want:    "Fix the planner.",
+		},
+		{
+			name:    "case and closing hashes",
+			body:    "##  summary ##\nFix the planner.\n## Tests ##\nUnit",
+			section: "Summary",
+			want:    "Fix the planner.",
+		},
+		{
+			name:    "no heading without space",
+			body:    "## Summary\nFix #12.\n#13 too.\n## Tests",
+			section: "Summary",
+			want:    "Fix #12.\n#13 too.",
+		},
+		{
+			name:    "HTML comments",
+			body:    "## Summary\n<!-- Describe the change -->\nFix the planner.<!-- inline -->\n## Tests",
+			section: "Summary",
+			want:    "Fix the planner.",
+		},
+		{
+			name:    "commented out heading",
+			body:    "<!--\n## Summary\nTemplate text.\n-->\n## Summary\nFix the planner.",
+			section: "Summary",
+			want:    "Fix the planner.",
+		},
+		{
+			name:    "CRLF",
+			body:    "## Summary\r\nFix the planner.\r\nAnd the parser.\r\n## Tests\r\nUnit\r\n",
+			section: "Summary",
+			want:    "Fix the planner.\nAnd the parser.",
+		},
+		{
+			name:    "code block",
+			body:    "## Summary\nRun:\n```bash\n# build first\nmake build\n```\n## Tests",
+			section: "Summary",
+			want:    "Run:\n```bash\n# build first\nmake build\n```",
+		},
+		{
+			name:    "missing",
+			body:    "## Changelog\n- Bug Fix",
+			section: "Summary",
+		},
+		{
+			name:    "empty",
+			body:    "## Summary\n<!-- Describe the change -->\n## Changelog",
+			section: "Summary",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := BodySection(test.body, test.section); got != test.want {
+				t.Errorf("section: %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSquashMessage(t *testing.T) {
+	rule, err := NewRule(&config.RuleConfig{
+		ApprovedRule:   ApprovedRuleAny,
+		MergeMethod:    MergeMethodSquash,
+		SquashSections: []string{"Summary", "Changelog"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		title   string
+		body    string
+		subject string
+		message string
+	}{
+		{
+			name:    "sections",
+			title:   " fix: planner ",
+			body:    "## Changelog\r\n- Bug Fix\r\n## Summary\r\nFix the planner.\r\n",
+			subject: "fix: planner (#5)",
+			message: "Fix the planner.\n\n- Bug Fix",
+		},
+		{
+			name:    "missing section",
+			title:   "fix: planner",
+			body:    "## Summary\nFix the planner.",
+			subject: "fix: planner (#5)",
+			message: "Fix the planner.",
+		},
+		{
+			name:    "number already in the title",
+			title:   "fix: planner (#5)",
+			subject: "fix: planner (#5)",
+		},
+		{
+			name:    "another number in the title",
+			title:   "fix: planner (#4)",
+			subject: "fix: planner (#4) (#5)",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			subject, message := rule.SquashMessage(5, test.title, test.body)
+			if subject != test.subject || message != test.message {
+				t.Errorf("squash message: %q, %q", subject, message)
+			}
+		})
+	}
+}
+
+func TestMergeMethod(t *testing.T) {
+	rule, err := NewRule(&config.RuleConfig{ApprovedRule: ApprovedRuleAny, MergeMethod: MergeMethodMerge})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		labels []string
+		want   string
+	}{
+		{want: MergeMethodMerge},
+		{labels: []string{"merge-squash"}, want: MergeMethodSquash},
+		{labels: []string{"pr-feature", "merge-rebase"}, want: MergeMethodRebase},
+		{labels: []string{"merge-octopus"}, want: MergeMethodMerge},
+	}
+	for _, test := range tests {
+		if got := rule.MergeMethod(test.labels); got != test.want {
+			t.Errorf("merge method of %v: %v, want %v", test.labels, got, test.want)
+		}
+	}
+}
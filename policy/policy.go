@@ -0,0 +1,249 @@
+// Copyright 2020-2021 The Datafuse Authors.
+//
+// SPDX-License-Identifier: Apache-2.0.
+
+package policy
+
+import (
+	"bots/config"
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/google/go-github/v35/github"
+)
+
+const (
+	ApprovedRuleMost = "most"
+	ApprovedRuleAll  = "all"
+	ApprovedRuleAny  = "any"
+
+	// The label standing for the last approval with the most rule.
+	lgtm2Label = "lgtm2"
+)
+
+// TeamChecker tells whether a user belongs to an org team.
+type TeamChecker interface {
+	IsTeamMember(ctx context.Context, org string, team string, user string) (bool, error)
+}
+
+// PullRequest is what the rules need to know about a pull request.
+type PullRequest struct {
+	Number  int
+	Base    string
+	HeadSHA string
+	// UpdatedFrom is the head the merge queue updated with the base branch
+	// into HeadSHA, its approvals are not stale.
+	UpdatedFrom        string
+	Labels             []string
+	RequestedReviewers []string
+	Reviews            []*github.PullRequestReview
+	// Files is only needed when the rule has code owners.
+	Files []string
+}
+
+// Decision is the outcome of a rule on a pull request.
+type Decision struct {
+	Approved  bool
+	Approvals int
+	// Pending lists what is still missing for the approval.
+	Pending []string
+	// Verdicts are the latest effective review of every reviewer.
+	Verdicts []*Verdict
+}
+
+type Rule struct {
+	cfg    *config.RuleConfig
+	owners *CodeOwners
+}
+
+func NewRule(cfg *config.RuleConfig) (*Rule, error) {
+	switch cfg.ApprovedRule {
+	case ApprovedRuleMost, ApprovedRuleAll, ApprovedRuleAny:
+	default:
+		return nil, fmt.Errorf("unknown approved rule: %v", cfg.ApprovedRule)
+	}
+	if !ValidMergeMethod(cfg.MergeMethod) {
+		return nil, fmt.Errorf("unknown merge method: %v", cfg.MergeMethod)
+	}
+
+	rule := &Rule{cfg: cfg}
+	if cfg.CodeOwners != "" {
+		owners, err := LoadCodeOwners(cfg.CodeOwners)
+		if err != nil {
+			return nil, fmt.Errorf("load code owners: %w", err)
+		}
+		rule.owners = owners
+	}
+	return rule, nil
+}
+
+func (r *Rule) Config() *config.RuleConfig {
+	return r.cfg
+}
+
+// String describes the rule for the audit log.
+func (r *Rule) String() string {
+	s := fmt.Sprintf("approved_rule=%v required_approvals=%v", r.cfg.ApprovedRule, r.cfg.RequiredApprovals)
+	if r.owners != nil {
+		s += " codeowners=" + r.cfg.CodeOwners
+	}
+	return s
+}
+
+// NeedsFiles tells whether the pull request files must be listed.
+func (r *Rule) NeedsFiles() bool {
+	return r.owners != nil
+}
+
+type branchRule struct {
+	pattern string
+	rule    *Rule
+}
+
+// Engine picks the rule of the pull request base branch.
+type Engine struct {
+	rule     *Rule
+	branches []branchRule
+}
+
+func New(cfg *config.Config) (*Engine, error) {
+	rule, err := NewRule(cfg.Rule)
+	if err != nil {
+		return nil, err
+	}
+	engine := &Engine{rule: rule}
+	for _, branch := range cfg.BranchRules {
+		if _, err := path.Match(branch.Branch, ""); err != nil {
+			return nil, fmt.Errorf("invalid branch pattern %v: %w", branch.Branch, err)
+		}
+		rule, err := NewRule(branch.Rule)
+		if err != nil {
+			return nil, fmt.Errorf("rule of branch %v: %w", branch.Branch, err)
+		}
+		engine.branches = append(engine.branches, branchRule{pattern: branch.Branch, rule: rule})
+	}
+	return engine, nil
+}
+
+// RuleFor returns the first branch rule matching the base, or the default one.
+func (e *Engine) RuleFor(base string) *Rule {
+	for _, branch := range e.branches {
+		if ok, _ := path.Match(branch.pattern, base); ok {
+			return branch.rule
+		}
+	}
+	return e.rule
+}
+
+func (r *Rule) Evaluate(ctx context.Context, pr *PullRequest, teams TeamChecker) (*Decision, error) {
+	decision := &Decision{
+		Verdicts: Verdicts(pr.Reviews),
+	}
+
+	approvers := map[string]bool{}
+	var blockers []string
+	for _, verdict := range decision.Verdicts {
+		switch verdict.State {
+		case Approved:
+			if r.cfg.DismissStaleApprovals && verdict.CommitID != pr.HeadSHA && (pr.UpdatedFrom == "" || verdict.CommitID != pr.UpdatedFrom) {
+				continue
+			}
+			decision.Approvals++
+			approvers[strings.ToLower(verdict.Login)] = true
+		case ChangesRequested:
+			blockers = append(blockers, "@"+verdict.Login)
+		}
+	}
+
+	if r.cfg.BlockOnChangesRequested && len(blockers) > 0 {
+		decision.Pending = append(decision.Pending, "Changes requested by "+strings.Join(blockers, ", "))
+	}
+
+	required := r.cfg.RequiredApprovals
+	approvals := decision.Approvals
+	switch r.cfg.ApprovedRule {
+	case ApprovedRuleAny:
+		required = 1
+	case ApprovedRuleMost:
+		if approvals == required-1 && hasLabel(pr.Labels, lgtm2Label) {
+			approvals = required
+		}
+	case ApprovedRuleAll:
+		if len(pr.RequestedReviewers) > 0 {
+			decision.Pending = append(decision.Pending, "Wait for the requested reviewers: @"+strings.Join(pr.RequestedReviewers, ", @"))
+		}
+	}
+	if approvals < required {
+		decision.Pending = append(decision.Pending, fmt.Sprintf("Wait for %d more reviewer approval", required-approvals))
+	}
+
+	if r.owners != nil {
+		pending, err := r.ownersPending(ctx, pr.Files, approvers, teams)
+		if err != nil {
+			return nil, err
+		}
+		decision.Pending = append(decision.Pending, pending...)
+	}
+
+	decision.Approved = len(decision.Pending) == 0
+	return decision, nil
+}
+
+// ownersPending requires one approval of the owners of every changed path.
+func (r *Rule) ownersPending(ctx context.Context, files []string, approvers map[string]bool, teams TeamChecker) ([]string, error) {
+	rules := map[*OwnerRule]bool{}
+	for _, file := range files {
+		if rule := r.owners.Match(file); rule != nil && len(rule.Owners) > 0 {
+			rules[rule] = true
+		}
+	}
+
+	var pending []string
+	for rule := range rules {
+		ok, err := ownersApproved(ctx, rule.Owners, approvers, teams)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			pending = append(pending, fmt.Sprintf("Wait for an approval of @%s for %s", strings.Join(rule.Owners, ", @"), rule.Pattern))
+		}
+	}
+	sort.Strings(pending)
+	return pending, nil
+}
+
+func ownersApproved(ctx context.Context, owners []string, approvers map[string]bool, teams TeamChecker) (bool, error) {
+	for _, owner := range owners {
+		if approvers[strings.ToLower(owner)] {
+			return true, nil
+		}
+	}
+	for _, owner := range owners {
+		parts := strings.SplitN(owner, "/", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		for approver := range approvers {
+			member, err := teams.IsTeamMember(ctx, parts[0], parts[1], approver)
+			if err != nil {
+				return false, err
+			}
+			if member {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func hasLabel(labels []string, label string) bool {
+	for _, l := range labels {
+		if l == label {
+			return true
+		}
+	}
+	return false
+}
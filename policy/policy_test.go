@@ -0,0 +1,337 @@
+// Copyright 2020-2021 The Datafuse Authors.
+//
+// SPDX-License-Identifier: Apache-2.0.
+
+package policy
+
+import (
+	"bots/config"
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-github/v35/github"
+)
+
+// teams maps "org/slug" to the lowercase logins of its members.
+type teams map[string][]string
+
+func (t teams) IsTeamMember(ctx context.Context, org string, team string, user string) (bool, error) {
+	members, ok := t[org+"/"+team]
+	if !ok {
+		return false, errors.New("unknown team " + org + "/" + team)
+	}
+	for _, member := range members {
+		if member == user {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func approvals(logins ...string) []*github.PullRequestReview {
+	var reviews []*github.PullRequestReview
+	for i, login := range logins {
+		reviews = append(reviews, review(login, Approved, "a2", i))
+	}
+	return reviews
+}
+
+func TestEvaluate(t *testing.T) {
+	tests := []struct {
+		name      string
+		rule      config.RuleConfig
+		labels    []string
+		requested []string
+		reviews   []*github.PullRequestReview
+		pending   []string
+	}{
+		{
+			name:    "most",
+			rule:    config.RuleConfig{ApprovedRule: ApprovedRuleMost, RequiredApprovals: 2},
+			reviews: approvals("alice", "bob"),
+		},
+		{
+			name:    "most missing one",
+			rule:    config.RuleConfig{ApprovedRule: ApprovedRuleMost, RequiredApprovals: 2},
+			reviews: approvals("alice"),
+			pending: []string{"Wait for 1 more reviewer approval"},
+		},
+		{
+			name:    "most with lgtm2",
+			rule:    config.RuleConfig{ApprovedRule: ApprovedRuleMost, RequiredApprovals: 2},
+			labels:  []string{"lgtm2"},
+			reviews: approvals("alice"),
+		},
+		{
+			name:    "lgtm2 stands for the last approval only",
+			rule:    config.RuleConfig{ApprovedRule: ApprovedRuleMost, RequiredApprovals: 3},
+			labels:  []string{"lgtm2"},
+			reviews: approvals("alice"),
+			pending: []string{"Wait for 2 more reviewer approval"},
+		},
+		{
+			name:    "lgtm2 of another rule",
+			rule:    config.RuleConfig{ApprovedRule: ApprovedRuleAll, RequiredApprovals: 2},
+			labels:  []string{"lgtm2"},
+			reviews: approvals("alice"),
+			pending: []string{"Wait for 1 more reviewer approval"},
+		},
+		{
+			name:    "all",
+			rule:    config.RuleConfig{ApprovedRule: ApprovedRuleAll, RequiredApprovals: 2},
+			reviews: approvals("alice", "bob"),
+		},
+		{
+			name:      "all with requested reviewers",
+			rule:      config.RuleConfig{ApprovedRule: ApprovedRuleAll, RequiredApprovals: 2},
+			reviews:   approvals("alice", "bob"),
+			requested: []string{"carol", "dave"},
+			pending:   []string{"Wait for the requested reviewers: @carol, @dave"},
+		},
+		{
+			name:    "any",
+			rule:    config.RuleConfig{ApprovedRule: ApprovedRuleAny, RequiredApprovals: 3},
+			reviews: approvals("alice"),
+		},
+		{
+			name:    "any without approval",
+			rule:    config.RuleConfig{ApprovedRule: ApprovedRuleAny, RequiredApprovals: 3},
+			pending: []string{"Wait for 1 more reviewer approval"},
+		},
+		{
+			name:    "block on changes requested",
+			rule:    config.RuleConfig{ApprovedRule: ApprovedRuleAny, BlockOnChangesRequested: true},
+			reviews: append(approvals("alice"), review("bob", ChangesRequested, "a2", 5), review("carol", ChangesRequested, "a1", 6)),
+			pending: []string{"Changes requested by @bob, @carol"},
+		},
+		{
+			name:    "changes requested without blocking",
+			rule:    config.RuleConfig{ApprovedRule: ApprovedRuleAny},
+			reviews: append(approvals("alice"), review("bob", ChangesRequested, "a2", 5)),
+		},
+		{
+			name:    "dismiss stale approvals",
+			rule:    config.RuleConfig{ApprovedRule: ApprovedRuleAny, DismissStaleApprovals: true},
+			reviews: []*github.PullRequestReview{review("alice", Approved, "a1", 1)},
+			pending: []string{"Wait for 1 more reviewer approval"},
+		},
+		{
+			name:    "keep stale approvals",
+			rule:    config.RuleConfig{ApprovedRule: ApprovedRuleAny},
+			reviews: []*github.PullRequestReview{review("alice", Approved, "a1", 1)},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.rule.MergeMethod = MergeMethodMerge
+			rule, err := NewRule(&test.rule)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decision, err := rule.Evaluate(context.Background(), &PullRequest{
+				Number:             5,
+				Base:               "main",
+				HeadSHA:            "a2",
+				Labels:             test.labels,
+				RequestedReviewers: test.requested,
+				Reviews:            test.reviews,
+			}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !equalStrings(decision.Pending, test.pending...) || decision.Approved != (len(test.pending) == 0) {
+				t.Errorf("approved %v, pending %q", decision.Approved, decision.Pending)
+			}
+		})
+	}
+}
+
+func TestEvaluateCodeOwners(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "CODEOWNERS")
+	owners := "* @alice\n/docs/ @datafuselabs/docs\n/query/ @bob @datafuselabs/query\n/vendor/\n"
+	if err := ioutil.WriteFile(file, []byte(owners), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	rule, err := NewRule(&config.RuleConfig{
+		ApprovedRule:          ApprovedRuleAny,
+		RequiredApprovals:     1,
+		DismissStaleApprovals: true,
+		MergeMethod:           MergeMethodMerge,
+		CodeOwners:            file,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rule.NeedsFiles() {
+		t.Error("code owners without files")
+	}
+	members := teams{"datafuselabs/docs": {"carol"}, "datafuselabs/query": {"dave"}}
+
+	tests := []struct {
+		name    string
+		files   []string
+		reviews []*github.PullRequestReview
+		teams   TeamChecker
+		pending []string
+		err     bool
+	}{
+		{
+			name:    "user owner",
+			files:   []string{"README.md"},
+			reviews: approvals("Alice"),
+		},
+		{
+			name:    "team owner",
+			files:   []string{"docs/intro.md"},
+			reviews: approvals("carol"),
+		},
+		{
+			name:    "any owner of the rule",
+			files:   []string{"query/plan.rs"},
+			reviews: approvals("dave"),
+		},
+		{
+			name:    "every owned path",
+			files:   []string{"README.md", "docs/intro.md", "query/plan.rs"},
+			reviews: approvals("carol"),
+			pending: []string{
+				"Wait for an approval of @alice for *",
+				"Wait for an approval of @bob, @datafuselabs/query for /query/",
+			},
+		},
+		{
+			name:    "path without owners",
+			files:   []string{"vendor/lib.rs"},
+			reviews: approvals("erin"),
+		},
+		{
+			name:    "stale owner approval",
+			files:   []string{"README.md"},
+			reviews: append(approvals("erin"), review("alice", Approved, "a1", 5)),
+			pending: []string{"Wait for an approval of @alice for *"},
+		},
+		{
+			name:    "team error",
+			files:   []string{"docs/intro.md"},
+			reviews: approvals("erin"),
+			teams:   teams{},
+			err:     true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			checker := test.teams
+			if checker == nil {
+				checker = members
+			}
+			decision, err := rule.Evaluate(context.Background(), &PullRequest{
+				Number:  5,
+				Base:    "main",
+				HeadSHA: "a2",
+				Reviews: test.reviews,
+				Files:   test.files,
+			}, checker)
+			if test.err {
+				if err == nil {
+					t.Errorf("no error, pending %q", decision.Pending)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !equalStrings(decision.Pending, test.pending...) || decision.Approved != (len(test.pending) == 0) {
+				t.Errorf("approved %v, pending %q", decision.Approved, decision.Pending)
+			}
+		})
+	}
+}
+
+func TestEngineRuleFor(t *testing.T) {
+	cfg := &config.Config{
+		Rule: &config.RuleConfig{ApprovedRule: ApprovedRuleMost, RequiredApprovals: 2, MergeMethod: MergeMethodMerge},
+		BranchRules: []*config.BranchRuleConfig{
+			{Branch: "release/*", Rule: &config.RuleConfig{ApprovedRule: ApprovedRuleAll, RequiredApprovals: 3, MergeMethod: MergeMethodMerge}},
+			{Branch: "release/v1.*", Rule: &config.RuleConfig{ApprovedRule: ApprovedRuleAny, MergeMethod: MergeMethodSquash}},
+			{Branch: "hotfix-?", Rule: &config.RuleConfig{ApprovedRule: ApprovedRuleAny, MergeMethod: MergeMethodRebase}},
+		},
+	}
+	engine, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		base string
+		rule *config.RuleConfig
+	}{
+		{base: "main", rule: cfg.Rule},
+		{base: "release/v2.0", rule: cfg.BranchRules[0].Rule},
+		// The first matching section wins.
+		{base: "release/v1.1", rule: cfg.BranchRules[0].Rule},
+		// * does not match a slash, the deeper branches fall through.
+		{base: "release/v2/rc", rule: cfg.Rule},
+		{base: "hotfix-1", rule: cfg.BranchRules[2].Rule},
+		{base: "hotfix-12", rule: cfg.Rule},
+	}
+	for _, test := range tests {
+		t.Run(test.base, func(t *testing.T) {
+			if rule := engine.RuleFor(test.base); rule.Config() != test.rule {
+				t.Errorf("rule of %v: %v", test.base, rule)
+			}
+		})
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  *config.Config
+		err  string
+	}{
+		{
+			name: "approved rule",
+			cfg:  &config.Config{Rule: &config.RuleConfig{ApprovedRule: "some", MergeMethod: MergeMethodMerge}},
+			err:  "unknown approved rule: some",
+		},
+		{
+			name: "merge method",
+			cfg:  &config.Config{Rule: &config.RuleConfig{ApprovedRule: ApprovedRuleAny, MergeMethod: "fast-forward"}},
+			err:  "unknown merge method: fast-forward",
+		},
+		{
+			name: "branch pattern",
+			cfg: &config.Config{
+				Rule:        &config.RuleConfig{ApprovedRule: ApprovedRuleAny, MergeMethod: MergeMethodMerge},
+				BranchRules: []*config.BranchRuleConfig{{Branch: "release/[", Rule: &config.RuleConfig{ApprovedRule: ApprovedRuleAny, MergeMethod: MergeMethodMerge}}},
+			},
+			err: "invalid branch pattern release/[",
+		},
+		{
+			name: "branch rule",
+			cfg: &config.Config{
+				Rule:        &config.RuleConfig{ApprovedRule: ApprovedRuleAny, MergeMethod: MergeMethodMerge},
+				BranchRules: []*config.BranchRuleConfig{{Branch: "release/*", Rule: &config.RuleConfig{ApprovedRule: "every", MergeMethod: MergeMethodMerge}}},
+			},
+			err: "rule of branch release/*: unknown approved rule: every",
+		},
+		{
+			name: "code owners",
+			cfg:  &config.Config{Rule: &config.RuleConfig{ApprovedRule: ApprovedRuleAny, MergeMethod: MergeMethodMerge, CodeOwners: "missing/CODEOWNERS"}},
+			err:  "load code owners",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := New(test.cfg); err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("error: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2020-2021 The Datafuse Authors.
+//
+// SPDX-License-Identifier: Apache-2.0.
+
+package policy
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v35/github"
+)
+
+// Review states.
+const (
+	Approved         = "APPROVED"
+	ChangesRequested = "CHANGES_REQUESTED"
+	Dismissed        = "DISMISSED"
+	Commented        = "COMMENTED"
+)
+
+// Verdict is the effective review of one reviewer.
+type Verdict struct {
+	Login       string
+	State       string
+	CommitID    string
+	SubmittedAt time.Time
+}
+
+// Verdicts computes the latest effective review per reviewer, sorted by login.
+// A comment does not replace an approval or a change request, a dismissal
+// clears them, pending reviews are ignored.
+func Verdicts(reviews []*github.PullRequestReview) []*Verdict {
+	sorted := make([]*github.PullRequestReview, len(reviews))
+	copy(sorted, reviews)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].GetSubmittedAt().Before(sorted[j].GetSubmittedAt())
+	})
+
+	latest := map[string]*Verdict{}
+	for _, review := range sorted {
+		login := review.GetUser().GetLogin()
+		key := strings.ToLower(login)
+		switch state := review.GetState(); state {
+		case Approved, ChangesRequested, Dismissed:
+			latest[key] = &Verdict{
+				Login:       login,
+				State:       state,
+				CommitID:    review.GetCommitID(),
+				SubmittedAt: review.GetSubmittedAt(),
+			}
+		case Commented:
+			if _, ok := latest[key]; !ok {
+				latest[key] = &Verdict{
+					Login:       login,
+					State:       state,
+					CommitID:    review.GetCommitID(),
+					SubmittedAt: review.GetSubmittedAt(),
+				}
+			}
+		}
+	}
+
+	verdicts := make([]*Verdict, 0, len(latest))
+	for _, verdict := range latest {
+		verdicts = append(verdicts, verdict)
+	}
+	sort.Slice(verdicts, func(i, j int) bool {
+		return strings.ToLower(verdicts[i].Login) < strings.ToLower(verdicts[j].Login)
+	})
+	return verdicts
+}
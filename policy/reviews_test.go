@@ -0,0 +1,204 @@
+// Copyright 2020-2021 The Datafuse Authors.
+//
+// SPDX-License-Identifier: Apache-2.0.
+
+package policy
+
+import (
+	"bots/config"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v35/github"
+)
+
+var reviewTime = time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+
+// review is a review of login on the head sha, submitted at the given minute.
+func review(login string, state string, sha string, minute int) *github.PullRequestReview {
+	submitted := reviewTime.Add(time.Duration(minute) * time.Minute)
+	return &github.PullRequestReview{
+		User:        &github.User{Login: github.String(login)},
+		State:       github.String(state),
+		CommitID:    github.String(sha),
+		SubmittedAt: &submitted,
+	}
+}
+
+func verdictsString(verdicts []*Verdict) string {
+	s := ""
+	for _, verdict := range verdicts {
+		s += fmt.Sprintf("%v:%v@%v ", verdict.Login, verdict.State, verdict.CommitID)
+	}
+	return s
+}
+
+func TestVerdicts(t *testing.T) {
+	tests := []struct {
+		name    string
+		reviews []*github.PullRequestReview
+		want    string
+	}{
+		{
+			name:    "changes requested after approval",
+			reviews: []*github.PullRequestReview{review("alice", Approved, "a1", 1), review("alice", ChangesRequested, "a1", 2)},
+			want:    "alice:CHANGES_REQUESTED@a1 ",
+		},
+		{
+			name:    "approval after changes requested",
+			reviews: []*github.PullRequestReview{review("alice", ChangesRequested, "a1", 1), review("alice", Approved, "a2", 2)},
+			want:    "alice:APPROVED@a2 ",
+		},
+		{
+			name:    "submitted order, not the listed one",
+			reviews: []*github.PullRequestReview{review("alice", Approved, "a2", 2), review("alice", ChangesRequested, "a1", 1)},
+			want:    "alice:APPROVED@a2 ",
+		},
+		{
+			name:    "dismissed",
+			reviews: []*github.PullRequestReview{review("alice", Approved, "a1", 1), review("alice", Dismissed, "a1", 2)},
+			want:    "alice:DISMISSED@a1 ",
+		},
+		{
+			name:    "comment after approval",
+			reviews: []*github.PullRequestReview{review("alice", Approved, "a1", 1), review("alice", Commented, "a2", 2)},
+			want:    "alice:APPROVED@a1 ",
+		},
+		{
+			name:    "comment after changes requested",
+			reviews: []*github.PullRequestReview{review("alice", ChangesRequested, "a1", 1), review("alice", Commented, "a2", 2)},
+			want:    "alice:CHANGES_REQUESTED@a1 ",
+		},
+		{
+			name:    "comment only",
+			reviews: []*github.PullRequestReview{review("alice", Commented, "a1", 1), review("alice", Commented, "a2", 2)},
+			want:    "alice:COMMENTED@a1 ",
+		},
+		{
+			name:    "pending ignored",
+			reviews: []*github.PullRequestReview{review("alice", Approved, "a1", 1), review("alice", "PENDING", "a2", 2)},
+			want:    "alice:APPROVED@a1 ",
+		},
+		{
+			name:    "case insensitive logins",
+			reviews: []*github.PullRequestReview{review("Alice", Approved, "a1", 1), review("alice", ChangesRequested, "a1", 2)},
+			want:    "alice:CHANGES_REQUESTED@a1 ",
+		},
+		{
+			name:    "sorted by login",
+			reviews: []*github.PullRequestReview{review("carol", Approved, "a1", 1), review("Bob", Approved, "a1", 2), review("alice", Approved, "a1", 3)},
+			want:    "alice:APPROVED@a1 Bob:APPROVED@a1 carol:APPROVED@a1 ",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := verdictsString(Verdicts(test.reviews)); got != test.want {
+				t.Errorf("verdicts: %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestEvaluateVerdicts(t *testing.T) {
+	tests := []struct {
+		name        string
+		reviews     []*github.PullRequestReview
+		updatedFrom string
+		approvals   int
+		pending     []string
+	}{
+		{
+			name:      "approved",
+			reviews:   []*github.PullRequestReview{review("alice", Approved, "a2", 1), review("bob", Approved, "a2", 2)},
+			approvals: 2,
+		},
+		{
+			name:      "changes requested after approval",
+			reviews:   []*github.PullRequestReview{review("alice", Approved, "a2", 1), review("bob", Approved, "a2", 2), review("bob", ChangesRequested, "a2", 3)},
+			approvals: 1,
+			pending:   []string{"Changes requested by @bob", "Wait for 1 more reviewer approval"},
+		},
+		{
+			name:      "dismissed",
+			reviews:   []*github.PullRequestReview{review("alice", Approved, "a2", 1), review("bob", Dismissed, "a2", 2)},
+			approvals: 1,
+			pending:   []string{"Wait for 1 more reviewer approval"},
+		},
+		{
+			name:      "comment after approval",
+			reviews:   []*github.PullRequestReview{review("alice", Approved, "a2", 1), review("bob", Approved, "a2", 2), review("bob", Commented, "a2", 3)},
+			approvals: 2,
+		},
+		{
+			name:      "case insensitive logins",
+			reviews:   []*github.PullRequestReview{review("alice", Approved, "a2", 1), review("Alice", Approved, "a2", 2)},
+			approvals: 1,
+			pending:   []string{"Wait for 1 more reviewer approval"},
+		},
+		{
+			name:      "stale approval",
+			reviews:   []*github.PullRequestReview{review("alice", Approved, "a2", 1), review("bob", Approved, "a1", 2)},
+			approvals: 1,
+			pending:   []string{"Wait for 1 more reviewer approval"},
+		},
+		{
+			name:        "approval of the updated head",
+			reviews:     []*github.PullRequestReview{review("alice", Approved, "a2", 1), review("bob", Approved, "a1", 2)},
+			updatedFrom: "a1",
+			approvals:   2,
+		},
+		{
+			name:        "approval of another head",
+			reviews:     []*github.PullRequestReview{review("alice", Approved, "a2", 1), review("bob", Approved, "a0", 2)},
+			updatedFrom: "a1",
+			approvals:   1,
+			pending:     []string{"Wait for 1 more reviewer approval"},
+		},
+	}
+
+	rule, err := NewRule(&config.RuleConfig{
+		ApprovedRule:            ApprovedRuleMost,
+		RequiredApprovals:       2,
+		BlockOnChangesRequested: true,
+		DismissStaleApprovals:   true,
+		MergeMethod:             MergeMethodMerge,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decision, err := rule.Evaluate(context.Background(), &PullRequest{
+				Number:      5,
+				Base:        "main",
+				HeadSHA:     "a2",
+				UpdatedFrom: test.updatedFrom,
+				Reviews:     test.reviews,
+			}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if decision.Approvals != test.approvals || !equalStrings(decision.Pending, test.pending...) {
+				t.Errorf("approvals %v, pending %q", decision.Approvals, decision.Pending)
+			}
+			if decision.Approved != (len(test.pending) == 0) {
+				t.Errorf("approved: %v", decision.Approved)
+			}
+		})
+	}
+}
+
+func equalStrings(got []string, want ...string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
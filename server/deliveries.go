@@ -0,0 +1,146 @@
+// Copyright 2020-2021 The Datafuse Authors.
+//
+// SPDX-License-Identifier: Apache-2.0.
+
+package server
+
+import (
+	"bots/store"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const deliveriesBucket = "deliveries"
+
+// Delivery is a received webhook delivery, as persisted for replay.
+type Delivery struct {
+	ID       string          `json:"id"`
+	Event    string          `json:"event"`
+	Received time.Time       `json:"received"`
+	Payload  json.RawMessage `json:"payload"`
+}
+
+// Deliveries records the delivery IDs in the store to drop GitHub
+// redeliveries, and keeps the raw payloads as files for the retention window
+// so they can be replayed, even while the server holds the store.
+type Deliveries struct {
+	store     store.Store
+	dir       string
+	retention time.Duration
+}
+
+func NewDeliveries(st store.Store, dir string, retention time.Duration) *Deliveries {
+	return &Deliveries{
+		store:     st,
+		dir:       dir,
+		retention: retention,
+	}
+}
+
+// Claim records the delivery ID, false when it was already recorded: two
+// concurrent redeliveries cannot both claim it.
+func (d *Deliveries) Claim(id string) (bool, error) {
+	now := time.Now().UTC()
+	return d.store.PutIfAbsent(deliveriesBucket, id, []byte(now.Format(time.RFC3339)))
+}
+
+// Forget drops a claimed delivery which could not be processed, so its
+// redelivery is.
+func (d *Deliveries) Forget(id string) error {
+	return d.store.Delete(deliveriesBucket, id)
+}
+
+// Save keeps the payload of the delivery for replay.
+func (d *Deliveries) Save(id string, event string, payload []byte) error {
+	if d.dir == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(&Delivery{
+		ID:       id,
+		Event:    event,
+		Received: time.Now().UTC(),
+		Payload:  payload,
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(d.dir, 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(d.path(id), data, 0600)
+}
+
+func (d *Deliveries) path(id string) string {
+	return filepath.Join(d.dir, filepath.Base(id)+".json")
+}
+
+// Get loads a persisted delivery.
+func (d *Deliveries) Get(id string) (*Delivery, error) {
+	if d.dir == "" {
+		return nil, fmt.Errorf("payloads are not persisted, set [webhook] payload_dir")
+	}
+	return LoadDelivery(d.path(id))
+}
+
+// LoadDelivery reads a persisted delivery file.
+func LoadDelivery(file string) (*Delivery, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	delivery := &Delivery{}
+	if err := json.Unmarshal(data, delivery); err != nil {
+		return nil, fmt.Errorf("parse delivery %v: %w", file, err)
+	}
+	return delivery, nil
+}
+
+// Prune forgets the deliveries older than the retention window.
+func (d *Deliveries) Prune() error {
+	if d.retention <= 0 {
+		return nil
+	}
+	deadline := time.Now().UTC().Add(-d.retention)
+
+	var expired []string
+	err := d.store.ForEach(deliveriesBucket, func(key string, value []byte) error {
+		received, err := time.Parse(time.RFC3339, string(value))
+		if err != nil || received.Before(deadline) {
+			expired = append(expired, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, id := range expired {
+		if err := d.store.Delete(deliveriesBucket, id); err != nil {
+			return err
+		}
+	}
+
+	if d.dir == "" {
+		return nil
+	}
+	files, err := ioutil.ReadDir(d.dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), ".json") && file.ModTime().Before(deadline) {
+			if err := os.Remove(filepath.Join(d.dir, file.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	log.Infof("Deliveries pruned: %v", len(expired))
+	return nil
+}
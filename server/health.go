@@ -0,0 +1,81 @@
+// Copyright 2020-2021 The Datafuse Authors.
+//
+// SPDX-License-Identifier: Apache-2.0.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// readyCheckInterval caches the GitHub auth check, as the probes are frequent.
+	readyCheckInterval = time.Minute
+	readyCheckTimeout  = 10 * time.Second
+)
+
+// readiness caches the last successful GitHub auth check.
+type readiness struct {
+	mu      sync.Mutex
+	checked time.Time
+}
+
+// Healthz answers 200 as long as the process serves HTTP.
+func (s *Server) Healthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// DeadLetters lists the jobs which failed all their attempts as JSON, oldest
+// first. Their delivery is replayed with `fusebots replay --delivery <id>`.
+func (s *Server) DeadLetters(w http.ResponseWriter, r *http.Request) {
+	letters, err := s.queue.DeadLetters()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if letters == nil {
+		letters = []DeadLetter{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(letters)
+}
+
+// Readyz answers 200 once the config is loaded and the GitHub credentials of
+// every repository work, 503 otherwise or while shutting down.
+func (s *Server) Readyz(w http.ResponseWriter, r *http.Request) {
+	select {
+	case <-s.quit:
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	default:
+	}
+	if err := s.checkReady(r.Context()); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+func (s *Server) checkReady(ctx context.Context) error {
+	s.ready.mu.Lock()
+	defer s.ready.mu.Unlock()
+	if time.Since(s.ready.checked) < readyCheckInterval {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, readyCheckTimeout)
+	defer cancel()
+	if err := s.router.Check(ctx); err != nil {
+		log.Errorf("Readiness check error: %v", err)
+		return fmt.Errorf("github auth: %w", err)
+	}
+	s.ready.checked = time.Now()
+	return nil
+}
@@ -0,0 +1,121 @@
+// Copyright 2020-2021 The Datafuse Authors.
+//
+// SPDX-License-Identifier: Apache-2.0.
+
+package server
+
+import (
+	"bots/config"
+	"crypto/tls"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// NewHTTPServer creates the HTTP server of the handler as configured in the
+// server section, with HTTPS when a certificate is set.
+func NewHTTPServer(cfg *config.ServerConfig, handler http.Handler) (*http.Server, error) {
+	httpServer := &http.Server{
+		Addr:         cfg.Listen,
+		Handler:      handler,
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+		IdleTimeout:  cfg.IdleTimeout,
+	}
+	if cfg.TLSCert != "" {
+		certs, err := NewCertReloader(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		httpServer.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: certs.GetCertificate,
+		}
+	}
+	return httpServer, nil
+}
+
+// ListenAndServe serves HTTPS when the server has a TLS config, else HTTP.
+func ListenAndServe(httpServer *http.Server) error {
+	if httpServer.TLSConfig != nil {
+		return httpServer.ListenAndServeTLS("", "")
+	}
+	return httpServer.ListenAndServe()
+}
+
+// certCheckInterval throttles the checks of the certificate files.
+const certCheckInterval = 10 * time.Second
+
+// CertReloader serves the certificate of the cert and key files, reloaded once
+// they change so renewed certificates are picked up without a restart.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func NewCertReloader(certFile string, keyFile string) (*CertReloader, error) {
+	c := &CertReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.checked) >= certCheckInterval {
+		// A broken renewal keeps the previous certificate.
+		if err := c.reload(); err != nil {
+			log.Errorf("Reload tls certificate error: %v", err)
+		}
+	}
+	return c.cert, nil
+}
+
+// reload loads the files when modified since the last load.
+func (c *CertReloader) reload() error {
+	c.checked = time.Now()
+	modTime, err := c.lastModified()
+	if err != nil {
+		return err
+	}
+	if c.cert != nil && !modTime.After(c.modTime) {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	if c.cert != nil {
+		log.Infof("Tls certificate %v reloaded", c.certFile)
+	}
+	c.cert = &cert
+	c.modTime = modTime
+	return nil
+}
+
+func (c *CertReloader) lastModified() (time.Time, error) {
+	var last time.Time
+	for _, file := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(last) {
+			last = info.ModTime()
+		}
+	}
+	return last, nil
+}
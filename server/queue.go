@@ -0,0 +1,289 @@
+// Copyright 2020-2021 The Datafuse Authors.
+//
+// SPDX-License-Identifier: Apache-2.0.
+
+package server
+
+import (
+	"bots/actions"
+	"bots/config"
+	"bots/logging"
+	"bots/metrics"
+	"bots/store"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	deadLettersBucket = "dead-letters"
+	// Sortable time prefix of the dead letter keys.
+	deadLetterTimeFormat = "2006-01-02T15:04:05.000000000Z"
+)
+
+var (
+	ErrQueueFull   = errors.New("event queue is full")
+	ErrQueueClosed = errors.New("event queue is closed")
+)
+
+// Job is one webhook event with the actions still left to run on it.
+type Job struct {
+	Delivery string
+	Event    string
+	// Key orders the jobs, jobs with the same key run one after another.
+	Key      string
+	Payload  interface{}
+	Actions  []actions.Action
+	Attempts int
+}
+
+// fields are the log correlation fields of the job.
+func (j *Job) fields() log.Fields {
+	fields := log.Fields{
+		"delivery": j.Delivery,
+		"event":    j.Event,
+		"repo":     actions.PayloadRepository(j.Payload),
+	}
+	if number := actions.PayloadNumber(j.Payload); number != 0 {
+		fields["number"] = number
+	}
+	return fields
+}
+
+// DeadLetter is a job which still failed after all its attempts.
+type DeadLetter struct {
+	Delivery string    `json:"delivery"`
+	Event    string    `json:"event"`
+	Key      string    `json:"key"`
+	Actions  []string  `json:"actions"`
+	Attempts int       `json:"attempts"`
+	Error    string    `json:"error"`
+	Time     time.Time `json:"time"`
+}
+
+// Queue is a bounded worker pool, each worker owns a shard of the keys so the
+// events of one issue or pull request are processed in order.
+type Queue struct {
+	cfg    *config.QueueConfig
+	store  store.Store
+	shards []chan *Job
+	wg     sync.WaitGroup
+	// ctx of the actions, cancelled once the queue is stopped.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+func NewQueue(cfg *config.QueueConfig, st store.Store) *Queue {
+	workers := cfg.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	q := &Queue{
+		cfg:    cfg,
+		store:  st,
+		shards: make([]chan *Job, workers),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	for i := range q.shards {
+		q.shards[i] = make(chan *Job, cfg.Size)
+	}
+	return q
+}
+
+func (q *Queue) Start() {
+	for _, shard := range q.shards {
+		q.wg.Add(1)
+		go q.worker(shard)
+	}
+	log.Infof("Event queue start: %v workers...", len(q.shards))
+}
+
+// Stop refuses new jobs and waits for the queued ones to be processed. At the
+// ctx deadline the running actions are cancelled, the jobs left fail to the
+// dead letters and may be replayed.
+func (q *Queue) Stop(ctx context.Context) {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		for _, shard := range q.shards {
+			close(shard)
+		}
+	}
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Warnf("Event queue drain timeout, cancel the running jobs")
+		q.cancel()
+		<-done
+	}
+	q.cancel()
+}
+
+func (q *Queue) Enqueue(job *Job) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return ErrQueueClosed
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(job.Key))
+	select {
+	case q.shards[h.Sum32()%uint32(len(q.shards))] <- job:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+func (q *Queue) worker(shard chan *Job) {
+	defer q.wg.Done()
+	for job := range shard {
+		q.process(job)
+	}
+}
+
+// process runs the job, retrying only the failed actions with an exponential
+// backoff, the shard is blocked meanwhile to keep the ordering.
+func (q *Queue) process(job *Job) {
+	backoff := q.cfg.RetryBackoff
+	for {
+		job.Attempts++
+		err := q.run(job)
+		if err == nil {
+			return
+		}
+		if job.Attempts >= q.cfg.MaxAttempts {
+			q.deadLetter(job, err)
+			return
+		}
+		log.WithFields(job.fields()).Warnf("Attempt %v error: %v, retry in %v", job.Attempts, err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-q.ctx.Done():
+			q.deadLetter(job, err)
+			return
+		}
+		backoff *= 2
+	}
+}
+
+func (q *Queue) run(job *Job) error {
+	var failed []actions.Action
+	var errs []string
+	ctx := logging.With(q.ctx, job.fields())
+	for _, action := range job.Actions {
+		actionCtx := logging.With(ctx, log.Fields{"action": action.Name()})
+		err := action.DoAction(actionCtx, job.Payload)
+		metrics.ActionRuns.WithLabelValues(action.Name(), job.Event, metrics.Outcome(err)).Inc()
+		if err != nil {
+			logging.From(actionCtx).Errorf("Action error: %v", err)
+			failed = append(failed, action)
+			errs = append(errs, fmt.Sprintf("%v: %v", action.Name(), err))
+		}
+	}
+	job.Actions = failed
+	if len(failed) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (q *Queue) deadLetter(job *Job, err error) {
+	log.WithFields(job.fields()).Errorf("Dead after %v attempts: %v", job.Attempts, err)
+
+	letter := DeadLetter{
+		Delivery: job.Delivery,
+		Event:    job.Event,
+		Key:      job.Key,
+		Attempts: job.Attempts,
+		Error:    err.Error(),
+		Time:     time.Now().UTC(),
+	}
+	for _, action := range job.Actions {
+		letter.Actions = append(letter.Actions, action.Name())
+	}
+	value, _ := json.Marshal(letter)
+	key := letter.Time.Format(deadLetterTimeFormat) + "/" + job.Delivery
+	if err := q.store.Put(deadLettersBucket, key, value); err != nil {
+		log.Errorf("Store dead letter error: %v", err)
+	}
+}
+
+// DeadLetters returns the failed jobs, oldest first.
+func (q *Queue) DeadLetters() ([]DeadLetter, error) {
+	var letters []DeadLetter
+	err := q.store.ForEach(deadLettersBucket, func(key string, value []byte) error {
+		var letter DeadLetter
+		if err := json.Unmarshal(value, &letter); err != nil {
+			return err
+		}
+		letters = append(letters, letter)
+		return nil
+	})
+	return letters, err
+}
+
+// PruneDeadLetters drops the dead letters older than the retention window,
+// their payloads are gone from the deliveries by then.
+func (q *Queue) PruneDeadLetters(retention time.Duration) error {
+	if retention <= 0 {
+		return nil
+	}
+	deadline := time.Now().UTC().Add(-retention).Format(deadLetterTimeFormat)
+	expired, err := q.deadLetterKeys(func(key string) bool { return key < deadline })
+	if err != nil {
+		return err
+	}
+	for _, key := range expired {
+		if err := q.store.Delete(deadLettersBucket, key); err != nil {
+			return err
+		}
+	}
+	log.Infof("Dead letters pruned: %v", len(expired))
+	return nil
+}
+
+// removeDeadLetters drops the dead letters of a replayed delivery.
+func (q *Queue) removeDeadLetters(delivery string) error {
+	keys, err := q.deadLetterKeys(func(key string) bool { return strings.HasSuffix(key, "/"+delivery) })
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := q.store.Delete(deadLettersBucket, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (q *Queue) deadLetterKeys(match func(key string) bool) ([]string, error) {
+	var keys []string
+	err := q.store.ForEach(deadLettersBucket, func(key string, value []byte) error {
+		if match(key) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	return keys, err
+}
@@ -0,0 +1,99 @@
+// Copyright 2020-2021 The Datafuse Authors.
+//
+// SPDX-License-Identifier: Apache-2.0.
+
+package server
+
+import (
+	"bots/actions"
+	"bots/config"
+	"bots/store"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// blockingAction waits for its ctx on every event.
+type blockingAction struct {
+	started chan struct{}
+}
+
+func (s *blockingAction) Name() string             { return "blocking" }
+func (s *blockingAction) Start()                   {}
+func (s *blockingAction) Stop(ctx context.Context) {}
+func (s *blockingAction) DoAction(ctx context.Context, event interface{}) error {
+	s.started <- struct{}{}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestQueueStopDeadline(t *testing.T) {
+	st := store.NewMemoryStore()
+	q := NewQueue(&config.QueueConfig{Workers: 1, Size: 10, MaxAttempts: 3, RetryBackoff: time.Millisecond}, st)
+	q.Start()
+
+	action := &blockingAction{started: make(chan struct{}, 10)}
+	for _, delivery := range []string{"delivery-1", "delivery-2"} {
+		if err := q.Enqueue(&Job{Delivery: delivery, Event: "issues", Key: "7", Actions: []actions.Action{action}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-action.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	stopped := make(chan struct{})
+	go func() {
+		q.Stop(ctx)
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("stop blocked past the deadline")
+	}
+
+	if err := q.Enqueue(&Job{Delivery: "delivery-3", Key: "7"}); err != ErrQueueClosed {
+		t.Errorf("enqueue after stop: %v", err)
+	}
+	// The running and the queued jobs are kept for replay.
+	letters, err := q.DeadLetters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 2 {
+		t.Errorf("dead letters: %+v", letters)
+	}
+}
+
+func TestQueuePruneDeadLetters(t *testing.T) {
+	st := store.NewMemoryStore()
+	q := NewQueue(&config.QueueConfig{Workers: 1}, st)
+
+	old := time.Now().UTC().Add(-2 * time.Hour).Format(deadLetterTimeFormat)
+	if err := st.Put(deadLettersBucket, old+"/delivery-1", []byte(`{"delivery": "delivery-1"}`)); err != nil {
+		t.Fatal(err)
+	}
+	q.deadLetter(&Job{Delivery: "delivery-2", Event: "issues", Key: "7"}, errors.New("server error"))
+	q.deadLetter(&Job{Delivery: "delivery-3", Event: "issues", Key: "8"}, errors.New("server error"))
+
+	// The letters past the retention go, as their payloads.
+	if err := q.PruneDeadLetters(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	letters, err := q.DeadLetters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 2 || letters[0].Delivery != "delivery-2" || letters[1].Delivery != "delivery-3" {
+		t.Errorf("dead letters: %+v", letters)
+	}
+
+	if err := q.removeDeadLetters("delivery-2"); err != nil {
+		t.Fatal(err)
+	}
+	if letters, _ := q.DeadLetters(); len(letters) != 1 || letters[0].Delivery != "delivery-3" {
+		t.Errorf("dead letters: %+v", letters)
+	}
+}
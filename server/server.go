@@ -0,0 +1,276 @@
+// Copyright 2020-2021 The Datafuse Authors.
+//
+// SPDX-License-Identifier: Apache-2.0.
+
+package server
+
+import (
+	"bots/actions"
+	"bots/config"
+	"bots/logging"
+	"bots/metrics"
+	"bots/store"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-playground/webhooks/v6/github"
+	log "github.com/sirupsen/logrus"
+)
+
+// Events are the webhook events fusebots handles.
+var Events = []github.Event{
+	github.ReleaseEvent,
+	github.PullRequestEvent,
+	github.IssueCommentEvent,
+	github.IssuesEvent,
+	github.PullRequestReviewEvent,
+	github.CheckRunEvent,
+	github.CheckSuiteEvent,
+	github.StatusEvent,
+}
+
+// Server is the webhooks handler, it acknowledges the deliveries right away
+// and processes them on the queue.
+type Server struct {
+	// hooks verify the signatures with the secret of the payload's repository,
+	// hook with the [github] one.
+	hook       *github.Webhook
+	hooks      map[string]*github.Webhook
+	router     *actions.Router
+	queue      *Queue
+	deliveries *Deliveries
+	// maxBodySize of the webhook requests, 0 for no limit.
+	maxBodySize int64
+	ready       readiness
+	quit        chan struct{}
+}
+
+const pruneInterval = time.Hour
+
+func New(cfg *config.Config, router *actions.Router, st store.Store) (*Server, error) {
+	hook, err := github.New(github.Options.Secret(cfg.Github.GithubSecret))
+	if err != nil {
+		return nil, err
+	}
+	hooks := make(map[string]*github.Webhook)
+	for _, repoCfg := range cfg.Repos {
+		repoHook, err := github.New(github.Options.Secret(repoCfg.Github.GithubSecret))
+		if err != nil {
+			return nil, fmt.Errorf("repo %v: %w", repoCfg.Github.FullName(), err)
+		}
+		hooks[strings.ToLower(repoCfg.Github.FullName())] = repoHook
+	}
+	return &Server{
+		hook:        hook,
+		hooks:       hooks,
+		router:      router,
+		queue:       NewQueue(cfg.Queue, st),
+		deliveries:  NewDeliveries(st, cfg.Webhook.PayloadDir, cfg.Webhook.PayloadRetention),
+		maxBodySize: cfg.Server.MaxBodySize,
+		quit:        make(chan struct{}),
+	}, nil
+}
+
+func (s *Server) Queue() *Queue {
+	return s.queue
+}
+
+func (s *Server) Deliveries() *Deliveries {
+	return s.deliveries
+}
+
+func (s *Server) Start() {
+	s.queue.Start()
+	go s.pruneLoop()
+}
+
+// Stop drains the event queue until the ctx deadline.
+func (s *Server) Stop(ctx context.Context) {
+	close(s.quit)
+	s.queue.Stop(ctx)
+}
+
+func (s *Server) pruneLoop() {
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+	for {
+		if err := s.deliveries.Prune(); err != nil {
+			log.Errorf("Prune deliveries error: %v", err)
+		}
+		if err := s.queue.PruneDeadLetters(s.deliveries.retention); err != nil {
+			log.Errorf("Prune dead letters error: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	delivery := r.Header.Get("X-GitHub-Delivery")
+	event := r.Header.Get("X-GitHub-Event")
+	logger := log.WithFields(log.Fields{"delivery": delivery, "event": event})
+
+	reader := io.Reader(r.Body)
+	if s.maxBodySize > 0 {
+		reader = io.LimitReader(r.Body, s.maxBodySize+1)
+	}
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if s.maxBodySize > 0 && int64(len(body)) > s.maxBodySize {
+		logger.Errorf("Body over %v bytes refused", s.maxBodySize)
+		metrics.WebhookEvents.WithLabelValues(event, "too_large").Inc()
+		http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	payload, err := s.hookFor(body).Parse(r, Events...)
+	if err != nil {
+		switch err {
+		case github.ErrEventNotFound:
+			logger.Infof("Unhandle github event")
+			metrics.WebhookEvents.WithLabelValues(event, "unhandled").Inc()
+			w.WriteHeader(http.StatusNoContent)
+		case github.ErrHMACVerificationFailed, github.ErrMissingHubSignatureHeader:
+			logger.Errorf("Webhook signature error: %v", err)
+			metrics.WebhookEvents.WithLabelValues(event, "unauthorized").Inc()
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+		default:
+			logger.Errorf("Webhook parse error: %v", err)
+			metrics.WebhookEvents.WithLabelValues(event, "rejected").Inc()
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+
+	// Only the signed deliveries are claimed, so a forged one cannot shadow
+	// a real delivery ID.
+	if delivery != "" {
+		claimed, err := s.deliveries.Claim(delivery)
+		if err != nil {
+			logger.Errorf("Delivery claim error: %v", err)
+		} else if !claimed {
+			logger.Infof("Duplicate delivery dropped")
+			metrics.WebhookEvents.WithLabelValues(event, "duplicate").Inc()
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+	}
+
+	job, err := s.NewJob(r.Context(), delivery, event, payload)
+	if err != nil {
+		s.forget(delivery)
+		logger.Errorf("Dispatch error: %v", err)
+		metrics.WebhookEvents.WithLabelValues(event, "rejected").Inc()
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	// The events of the bot itself or of an ignored sender may have no action.
+	if len(job.Actions) == 0 {
+		metrics.WebhookEvents.WithLabelValues(event, "ignored").Inc()
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if err := s.queue.Enqueue(job); err != nil {
+		s.forget(delivery)
+		log.WithFields(job.fields()).Errorf("Enqueue error: %v", err)
+		metrics.WebhookEvents.WithLabelValues(event, "rejected").Inc()
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if delivery != "" {
+		if err := s.deliveries.Save(delivery, event, body); err != nil {
+			log.WithFields(job.fields()).Errorf("Delivery save error: %v", err)
+		}
+	}
+	metrics.WebhookEvents.WithLabelValues(event, "accepted").Inc()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// forget drops the claim of a delivery which was not queued, GitHub may
+// redeliver it.
+func (s *Server) forget(delivery string) {
+	if delivery == "" {
+		return
+	}
+	if err := s.deliveries.Forget(delivery); err != nil {
+		log.WithField("delivery", delivery).Errorf("Delivery forget error: %v", err)
+	}
+}
+
+// hookFor returns the webhook of the repository the body claims to be about,
+// the signature check then proves it.
+func (s *Server) hookFor(body []byte) *github.Webhook {
+	var payload struct {
+		Repository struct {
+			FullName string `json:"full_name"`
+		} `json:"repository"`
+	}
+	if err := json.Unmarshal(body, &payload); err == nil {
+		if hook, ok := s.hooks[strings.ToLower(payload.Repository.FullName)]; ok {
+			return hook
+		}
+	}
+	return s.hook
+}
+
+// Replay runs the dispatch pipeline synchronously on a recorded payload, the
+// signature is not checked.
+func (s *Server) Replay(delivery *Delivery) error {
+	hook, err := github.New()
+	if err != nil {
+		return err
+	}
+	r, err := http.NewRequest(http.MethodPost, "/", bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("X-GitHub-Event", delivery.Event)
+	payload, err := hook.Parse(r, Events...)
+	if err != nil {
+		return fmt.Errorf("parse %v payload: %w", delivery.Event, err)
+	}
+
+	job, err := s.NewJob(context.Background(), delivery.ID, delivery.Event, payload)
+	if err != nil {
+		return err
+	}
+	log.WithFields(job.fields()).Infof("Replay on %v", job.Key)
+	s.queue.process(job)
+	if len(job.Actions) > 0 {
+		return fmt.Errorf("replay delivery %v failed", delivery.ID)
+	}
+	if err := s.queue.removeDeadLetters(delivery.ID); err != nil {
+		log.WithFields(job.fields()).Errorf("Remove dead letters error: %v", err)
+	}
+	return nil
+}
+
+// NewJob routes the payload to the actions of its repository.
+func (s *Server) NewJob(ctx context.Context, delivery string, event string, payload interface{}) (*Job, error) {
+	job := &Job{
+		Delivery: delivery,
+		Event:    event,
+		Key:      fmt.Sprintf("%s#%d", actions.PayloadRepository(payload), actions.PayloadNumber(payload)),
+		Payload:  payload,
+	}
+	acts, err := s.router.Route(logging.With(ctx, job.fields()), payload)
+	if err != nil {
+		return nil, err
+	}
+	job.Actions = acts
+	return job, nil
+}
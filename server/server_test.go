@@ -0,0 +1,663 @@
+// Copyright 2020-2021 The Datafuse Authors.
+//
+// SPDX-License-Identifier: Apache-2.0.
+
+package server
+
+import (
+	"bots/actions"
+	"bots/audit"
+	"bots/config"
+	"bots/metrics"
+	"bots/store"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const (
+	testSecret = "test-secret"
+	testRepo   = "/repos/datafuselabs/databend"
+)
+
+// fakeGitHub is the GitHub API of the harness, it answers the canned
+// responses and records every call as "METHOD /path".
+type fakeGitHub struct {
+	mu        sync.Mutex
+	calls     []string
+	bodies    map[string]string
+	responses map[string]string
+	// codes are the error statuses answered instead, by call.
+	codes map[string]int
+}
+
+func (f *fakeGitHub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	call := r.Method + " " + r.URL.Path
+
+	f.mu.Lock()
+	f.calls = append(f.calls, call)
+	f.bodies[call] = string(body)
+	response, ok := f.responses[call]
+	code := f.codes[call]
+	f.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case code != 0:
+		w.WriteHeader(code)
+		fmt.Fprintf(w, `{"message": %q}`, http.StatusText(code))
+	case ok:
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, response)
+	case r.Method == http.MethodGet:
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"message": "Not Found"}`)
+	default:
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, "null")
+	}
+}
+
+// mutations returns the non GET calls, sorted.
+func (f *fakeGitHub) mutations() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var calls []string
+	for _, call := range f.calls {
+		if !strings.HasPrefix(call, http.MethodGet+" ") {
+			calls = append(calls, call)
+		}
+	}
+	sort.Strings(calls)
+	return calls
+}
+
+func (f *fakeGitHub) body(call string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.bodies[call]
+}
+
+const testConfigIni = `
+[github]
+token = "test-token"
+secret = "%s"
+owner = "datafuselabs"
+name = "databend"
+api_url = "%s"
+retries = 0
+
+[hint]
+issue_first_time_comment = "Hi @%%s, thanks for the issue"
+pr_need_review_comment = "Hi @%%s, a reviewer is on the way"
+
+[disables]
+disable_label = true
+
+[queue]
+workers = 1
+max_attempts = 1
+
+[webhook]
+payload_dir = "%s"
+`
+
+// newHarness runs the webhook server of a repository against the fake
+// GitHub API answering responses, options adjust the loaded config.
+func newHarness(t *testing.T, responses map[string]string, options ...func(cfg *config.Config)) (*Server, *fakeGitHub) {
+	t.Helper()
+	// The bot is the token user.
+	all := map[string]string{"GET /user": `{"login": "fusebots"}`}
+	for call, response := range responses {
+		all[call] = response
+	}
+	fake := &fakeGitHub{bodies: make(map[string]string), responses: all, codes: make(map[string]int)}
+	api := httptest.NewServer(fake)
+	t.Cleanup(api.Close)
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "fusebots.ini")
+	ini := fmt.Sprintf(testConfigIni, testSecret, api.URL, filepath.Join(dir, "payloads"))
+	if err := ioutil.WriteFile(file, []byte(ini), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.LoadConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, option := range options {
+		option(cfg)
+	}
+
+	auditLog, err := audit.Open(cfg.Audit.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { auditLog.Close() })
+
+	st := store.NewMemoryStore()
+	srv, err := New(cfg, actions.NewRouter(cfg, st, auditLog), st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Start()
+	return srv, fake
+}
+
+func sign(payload []byte, secret string) string {
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write(payload)
+	return "sha1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliver posts the testdata fixture, named <event>.<action>.json, signed
+// with secret.
+func deliver(t *testing.T, srv *Server, fixture string, delivery string, secret string) int {
+	t.Helper()
+	payload, err := ioutil.ReadFile(filepath.Join("testdata", fixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := strings.SplitN(fixture, ".", 2)[0]
+
+	r := httptest.NewRequest(http.MethodPost, "/webhooks", bytes.NewReader(payload))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("X-GitHub-Event", event)
+	r.Header.Set("X-GitHub-Delivery", delivery)
+	r.Header.Set("X-Hub-Signature", sign(payload, secret))
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+	return w.Code
+}
+
+// waitMutations waits for the background calls to settle on the expected count.
+func waitMutations(fake *fakeGitHub, count int) []string {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		calls := fake.mutations()
+		if len(calls) >= count || time.Now().After(deadline) {
+			return calls
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+const (
+	testPR = `{"number": 5, "state": "open", "draft": false, "title": "Add window functions",
+		"body": "## Summary\n\nAdd the window functions.", "user": {"login": "alice"},
+		"head": {"ref": "window", "sha": "a1b2c3"}, "base": {"ref": "main", "sha": "f0f0f0"}, "labels": []}`
+	testChecksPassed  = `{"total_count": 1, "check_runs": [{"id": 1, "name": "build", "status": "completed", "conclusion": "success"}]}`
+	testChecksRunning = `{"total_count": 1, "check_runs": [{"id": 1, "name": "build", "status": "in_progress"}]}`
+	testApproved      = `[{"id": 1, "user": {"login": "bob"}, "state": "APPROVED", "commit_id": "a1b2c3"},
+		{"id": 2, "user": {"login": "carol"}, "state": "APPROVED", "commit_id": "a1b2c3"}]`
+)
+
+// mergeable answers a pull request #5 ready to merge.
+var mergeable = map[string]string{
+	"GET " + testRepo + "/pulls/5":                   testPR,
+	"GET " + testRepo + "/commits/a1b2c3/check-runs": testChecksPassed,
+	"GET " + testRepo + "/commits/a1b2c3/status":     `{"state": "success", "statuses": []}`,
+	"GET " + testRepo + "/pulls/5/reviews":           testApproved,
+	"GET " + testRepo + "/compare/main...a1b2c3":     `{"behind_by": 0}`,
+}
+
+func TestWebhookFixtures(t *testing.T) {
+	tests := []struct {
+		fixture   string
+		responses map[string]string
+		// mutations are the expected non GET calls, sorted.
+		mutations []string
+	}{
+		{
+			fixture: "issue_comment.assign.json",
+			mutations: []string{
+				"POST " + testRepo + "/issues/7/assignees",
+				"POST " + testRepo + "/issues/7/labels",
+			},
+		},
+		{
+			fixture: "issues.opened.json",
+			responses: map[string]string{
+				"GET " + testRepo + "/issues": `[]`,
+			},
+			mutations: []string{
+				"POST " + testRepo + "/issues/3/comments",
+			},
+		},
+		{
+			fixture: "pull_request.opened.json",
+			responses: map[string]string{
+				"GET " + testRepo + "/pulls/5":                     testPR,
+				"GET " + testRepo + "/pulls/5/requested_reviewers": `{"users": [], "teams": []}`,
+				"GET " + testRepo + "/commits/a1b2c3/check-runs":   testChecksRunning,
+				"GET " + testRepo + "/commits/a1b2c3/status":       `{"state": "pending", "statuses": []}`,
+			},
+			mutations: []string{
+				"POST " + testRepo + "/issues/5/comments",
+				"POST " + testRepo + "/issues/5/labels",
+				"POST " + testRepo + "/pulls/5/requested_reviewers",
+				"POST " + testRepo + "/statuses/a1b2c3",
+				"POST " + testRepo + "/statuses/a1b2c3",
+			},
+		},
+		{
+			fixture:   "pull_request_review.submitted.json",
+			responses: mergeable,
+			mutations: []string{
+				"POST " + testRepo + "/issues/5/comments",
+				"POST " + testRepo + "/statuses/a1b2c3",
+				"PUT " + testRepo + "/pulls/5/merge",
+			},
+		},
+		{
+			fixture:   "check_run.completed.json",
+			responses: mergeable,
+			mutations: []string{
+				"POST " + testRepo + "/issues/5/comments",
+				"POST " + testRepo + "/statuses/a1b2c3",
+				"PUT " + testRepo + "/pulls/5/merge",
+			},
+		},
+		{
+			fixture: "check_suite.completed.json",
+			responses: map[string]string{
+				"GET " + testRepo + "/commits/a1b2c3/pulls": `[]`,
+			},
+		},
+		{
+			fixture: "status.success.json",
+			responses: map[string]string{
+				"GET " + testRepo + "/commits/a1b2c3/pulls": `[]`,
+			},
+		},
+		{
+			fixture: "release.published.json",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			srv, fake := newHarness(t, tt.responses)
+			if code := deliver(t, srv, tt.fixture, "delivery-1", testSecret); code != http.StatusAccepted {
+				t.Fatalf("status %v", code)
+			}
+			srv.Stop(context.Background())
+
+			calls := waitMutations(fake, len(tt.mutations))
+			if strings.Join(calls, "\n") != strings.Join(tt.mutations, "\n") {
+				t.Errorf("calls:\n%v\nwant:\n%v", strings.Join(calls, "\n"), strings.Join(tt.mutations, "\n"))
+			}
+		})
+	}
+}
+
+func TestWebhookMergeMethod(t *testing.T) {
+	srv, fake := newHarness(t, mergeable)
+	deliver(t, srv, "pull_request_review.submitted.json", "delivery-1", testSecret)
+	srv.Stop(context.Background())
+
+	body := fake.body("PUT " + testRepo + "/pulls/5/merge")
+	if !strings.Contains(body, `"merge_method":"merge"`) || !strings.Contains(body, `"sha":"a1b2c3"`) {
+		t.Errorf("merge request: %v", body)
+	}
+}
+
+func TestWebhookDryRun(t *testing.T) {
+	srv, fake := newHarness(t, mergeable, (*config.Config).SetDryRun)
+	deliver(t, srv, "pull_request_review.submitted.json", "delivery-1", testSecret)
+	srv.Stop(context.Background())
+
+	if calls := fake.mutations(); len(calls) != 0 {
+		t.Errorf("dry run calls: %v", calls)
+	}
+	// The reads still happen.
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if len(fake.calls) == 0 {
+		t.Error("no reads")
+	}
+}
+
+func TestWebhookRejected(t *testing.T) {
+	srv, fake := newHarness(t, nil)
+
+	if code := deliver(t, srv, "issue_comment.assign.json", "delivery-1", "wrong-secret"); code != http.StatusUnauthorized {
+		t.Errorf("bad signature: status %v", code)
+	}
+	if code := deliver(t, srv, "issue_comment.assign.json", "delivery-2", testSecret); code != http.StatusAccepted {
+		t.Errorf("first delivery: status %v", code)
+	}
+	// The redelivery is acknowledged but not processed again.
+	if code := deliver(t, srv, "issue_comment.assign.json", "delivery-2", testSecret); code != http.StatusOK {
+		t.Errorf("redelivery: status %v", code)
+	}
+	srv.Stop(context.Background())
+
+	if calls := fake.mutations(); len(calls) != 2 {
+		t.Errorf("calls: %v", calls)
+	}
+}
+
+func TestWebhookDeliveryClaim(t *testing.T) {
+	srv, fake := newHarness(t, nil)
+
+	// A forged delivery does not shadow the real one.
+	if code := deliver(t, srv, "issue_comment.assign.json", "delivery-1", "wrong-secret"); code != http.StatusUnauthorized {
+		t.Errorf("forged delivery: status %v", code)
+	}
+	codes := make(chan int, 8)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(codes); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- deliver(t, srv, "issue_comment.assign.json", "delivery-1", testSecret)
+		}()
+	}
+	wg.Wait()
+	close(codes)
+	srv.Stop(context.Background())
+
+	accepted := 0
+	for code := range codes {
+		if code == http.StatusAccepted {
+			accepted++
+		}
+	}
+	if accepted != 1 {
+		t.Errorf("concurrent redeliveries accepted %v times", accepted)
+	}
+	if calls := fake.mutations(); len(calls) != 2 {
+		t.Errorf("calls: %v", calls)
+	}
+}
+
+func TestWebhookRepoSecret(t *testing.T) {
+	srv, fake := newHarness(t, nil, func(cfg *config.Config) {
+		cfg.Repos[0].Github.GithubSecret = "repo-secret"
+	})
+
+	if code := deliver(t, srv, "issue_comment.assign.json", "delivery-1", testSecret); code != http.StatusUnauthorized {
+		t.Errorf("[github] secret: status %v", code)
+	}
+	if code := deliver(t, srv, "issue_comment.assign.json", "delivery-2", "repo-secret"); code != http.StatusAccepted {
+		t.Errorf("repo secret: status %v", code)
+	}
+	srv.Stop(context.Background())
+
+	if calls := fake.mutations(); len(calls) != 2 {
+		t.Errorf("calls: %v", calls)
+	}
+}
+
+func TestWebhookUnhandledEvent(t *testing.T) {
+	srv, fake := newHarness(t, nil)
+	defer srv.Stop(context.Background())
+
+	payload := []byte(`{"ref": "refs/heads/main", "repository": {"full_name": "datafuselabs/databend"}}`)
+	r := httptest.NewRequest(http.MethodPost, "/webhooks", bytes.NewReader(payload))
+	r.Header.Set("X-GitHub-Event", "push")
+	r.Header.Set("X-Hub-Signature", sign(payload, testSecret))
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("status %v", w.Code)
+	}
+	if calls := fake.mutations(); len(calls) != 0 {
+		t.Errorf("calls: %v", calls)
+	}
+}
+
+func TestWebhookBodyTooLarge(t *testing.T) {
+	srv, fake := newHarness(t, nil, func(cfg *config.Config) { cfg.Server.MaxBodySize = 64 })
+	defer srv.Stop(context.Background())
+
+	if code := deliver(t, srv, "issue_comment.assign.json", "delivery-1", testSecret); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status %v", code)
+	}
+	if calls := fake.mutations(); len(calls) != 0 {
+		t.Errorf("calls: %v", calls)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	srv, _ := newHarness(t, map[string]string{
+		"GET " + testRepo: `{"full_name": "datafuselabs/databend"}`,
+	})
+
+	probe := func(handler http.HandlerFunc) int {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		return w.Code
+	}
+	if code := probe(srv.Healthz); code != http.StatusOK {
+		t.Errorf("healthz status %v", code)
+	}
+	if code := probe(srv.Readyz); code != http.StatusOK {
+		t.Errorf("readyz status %v", code)
+	}
+	srv.Stop(context.Background())
+	if code := probe(srv.Readyz); code != http.StatusServiceUnavailable {
+		t.Errorf("readyz status %v while shutting down", code)
+	}
+}
+
+func TestDeadLetters(t *testing.T) {
+	srv, fake := newHarness(t, map[string]string{"GET " + testRepo + "/issues": `[]`})
+	srv.queue.deadLetter(&Job{Delivery: "delivery-1", Event: "issues", Key: "3"}, errors.New("issue: server error"))
+
+	list := func() []DeadLetter {
+		w := httptest.NewRecorder()
+		srv.DeadLetters(w, httptest.NewRequest(http.MethodGet, "/dead-letters", nil))
+		var letters []DeadLetter
+		if err := json.Unmarshal(w.Body.Bytes(), &letters); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("dead letters: %v %s, %v", w.Code, w.Body, err)
+		}
+		return letters
+	}
+	if letters := list(); len(letters) != 1 || letters[0].Delivery != "delivery-1" || letters[0].Error != "issue: server error" {
+		t.Fatalf("dead letters: %+v", letters)
+	}
+
+	// A successful replay of the delivery removes its letter.
+	payload, err := ioutil.ReadFile(filepath.Join("testdata", "issues.opened.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Replay(&Delivery{ID: "delivery-1", Event: "issues", Payload: payload}); err != nil {
+		t.Fatal(err)
+	}
+	if mutations := fake.mutations(); len(mutations) != 1 {
+		t.Errorf("mutations: %v", mutations)
+	}
+	if letters := list(); len(letters) != 0 {
+		t.Errorf("dead letters: %+v", letters)
+	}
+}
+
+func TestHealthGithubAuth(t *testing.T) {
+	// The repository is not found with these credentials.
+	srv, _ := newHarness(t, nil)
+	defer srv.Stop(context.Background())
+
+	w := httptest.NewRecorder()
+	srv.Readyz(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("readyz status %v", w.Code)
+	}
+}
+
+func TestWebhookMetrics(t *testing.T) {
+	accepted := metrics.WebhookEvents.WithLabelValues("issue_comment", "accepted")
+	duplicate := metrics.WebhookEvents.WithLabelValues("issue_comment", "duplicate")
+	runs := metrics.ActionRuns.WithLabelValues("issue", "issue_comment", "ok")
+	before := []float64{testutil.ToFloat64(accepted), testutil.ToFloat64(duplicate), testutil.ToFloat64(runs)}
+
+	srv, _ := newHarness(t, nil)
+	deliver(t, srv, "issue_comment.assign.json", "delivery-1", testSecret)
+	deliver(t, srv, "issue_comment.assign.json", "delivery-1", testSecret)
+	srv.Stop(context.Background())
+
+	after := []float64{testutil.ToFloat64(accepted), testutil.ToFloat64(duplicate), testutil.ToFloat64(runs)}
+	for i, name := range []string{"accepted", "duplicate", "issue action runs"} {
+		if after[i]-before[i] != 1 {
+			t.Errorf("%v: %v, want 1", name, after[i]-before[i])
+		}
+	}
+}
+
+func TestWebhookRequiredChecksForbidden(t *testing.T) {
+	tests := []struct {
+		name   string
+		branch string
+		merged bool
+	}{
+		// The branch summary still tells the required checks.
+		{name: "branch summary", branch: `{"name": "main", "protection": {"required_status_checks": {"contexts": ["build", "lint"]}}}`},
+		{name: "no branch summary", merged: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			responses := map[string]string{}
+			for call, response := range mergeable {
+				responses[call] = response
+			}
+			if tt.branch != "" {
+				responses["GET "+testRepo+"/branches/main"] = tt.branch
+			}
+			srv, fake := newHarness(t, responses)
+			// A GitHub App without the administration permission.
+			fake.codes["GET "+testRepo+"/branches/main/protection/required_status_checks"] = http.StatusForbidden
+			deliver(t, srv, "pull_request_review.submitted.json", "delivery-1", testSecret)
+			srv.Stop(context.Background())
+
+			if merged := fake.body("PUT "+testRepo+"/pulls/5/merge") != ""; merged != tt.merged {
+				t.Errorf("merged %v, calls: %v", merged, fake.mutations())
+			}
+		})
+	}
+}
+
+func TestWebhookAudit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	srv, _ := newHarness(t, mergeable, func(cfg *config.Config) { cfg.Audit.Path = path })
+	deliver(t, srv, "pull_request_review.submitted.json", "delivery-1", testSecret)
+	srv.Stop(context.Background())
+
+	entries, err := audit.Read(path, "datafuselabs/databend", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var merge *audit.Entry
+	for _, entry := range entries {
+		if entry.Op == "merge pull request" {
+			merge = entry
+		}
+	}
+	if merge == nil {
+		t.Fatalf("no merge in %v", entries)
+	}
+	if merge.Result != audit.ResultOK || merge.Delivery != "delivery-1" || merge.Event != "pull_request_review" ||
+		merge.Action != "auto-merge" || !strings.HasPrefix(merge.Rule, "approved_rule=most required_approvals=2") {
+		t.Errorf("merge entry: %v", merge)
+	}
+}
+
+func TestWebhookAuditRules(t *testing.T) {
+	tests := []struct {
+		fixture   string
+		number    int
+		responses map[string]string
+	}{
+		{
+			fixture:   "issues.opened.json",
+			number:    3,
+			responses: map[string]string{"GET " + testRepo + "/issues": `[]`},
+		},
+		{
+			fixture: "pull_request.opened.json",
+			number:  5,
+			responses: map[string]string{
+				"GET " + testRepo + "/pulls/5":                     testPR,
+				"GET " + testRepo + "/pulls/5/requested_reviewers": `{"users": [], "teams": []}`,
+				"GET " + testRepo + "/commits/a1b2c3/check-runs":   testChecksRunning,
+				"GET " + testRepo + "/commits/a1b2c3/status":       `{"state": "pending", "statuses": []}`,
+			},
+		},
+		{
+			fixture:   "pull_request_review.submitted.json",
+			number:    5,
+			responses: mergeable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "audit.jsonl")
+			srv, fake := newHarness(t, tt.responses, func(cfg *config.Config) { cfg.Audit.Path = path })
+			deliver(t, srv, tt.fixture, "delivery-1", testSecret)
+			srv.Stop(context.Background())
+			waitMutations(fake, 1)
+
+			entries, err := audit.Read(path, "datafuselabs/databend", tt.number)
+			if err != nil || len(entries) == 0 {
+				t.Fatalf("entries: %v, %v", entries, err)
+			}
+			// Every write tells the rule which decided it.
+			for _, entry := range entries {
+				if entry.Rule == "" {
+					t.Errorf("no rule: %v", entry)
+				}
+			}
+		})
+	}
+}
+
+func TestWebhookBotEvents(t *testing.T) {
+	// alice is the bot, the issue action does not answer its own comments.
+	srv, fake := newHarness(t, map[string]string{"GET /user": `{"login": "alice"}`})
+	deliver(t, srv, "issue_comment.assign.json", "delivery-1", testSecret)
+	srv.Stop(context.Background())
+	if calls := fake.mutations(); len(calls) != 0 {
+		t.Errorf("calls on the bot comment: %v", calls)
+	}
+
+	// The approvals of the bot still move the merge forward.
+	srv, fake = newHarness(t, mergeable, func(cfg *config.Config) {
+		cfg.Repos[0].Github.BotLogin = "carol"
+	})
+	deliver(t, srv, "pull_request_review.submitted.json", "delivery-1", testSecret)
+	srv.Stop(context.Background())
+	if body := fake.body("PUT " + testRepo + "/pulls/5/merge"); body == "" {
+		t.Errorf("bot review not merged, calls: %v", fake.mutations())
+	}
+}
+
+func TestWebhookIgnoredSender(t *testing.T) {
+	srv, fake := newHarness(t, nil, func(cfg *config.Config) {
+		cfg.Webhook.IgnoreSenders = []string{"Alice"}
+	})
+	defer srv.Stop(context.Background())
+
+	if code := deliver(t, srv, "issue_comment.assign.json", "delivery-1", testSecret); code != http.StatusNoContent {
+		t.Errorf("status %v", code)
+	}
+	if calls := fake.mutations(); len(calls) != 0 {
+		t.Errorf("calls: %v", calls)
+	}
+}
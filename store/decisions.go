@@ -0,0 +1,61 @@
+// Copyright 2020-2021 The Datafuse Authors.
+//
+// SPDX-License-Identifier: Apache-2.0.
+
+package store
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const decisionsBucket = "decisions"
+
+// Decisions kinds.
+const (
+	Commented = "commented"
+	Requested = "requested"
+	Labeled   = "labeled"
+	Merged    = "merged"
+	Evicted   = "evicted"
+	Commanded = "commanded"
+)
+
+// Decisions records what the bot already did for a repository, per issue or
+// pull request number and optionally per head SHA.
+type Decisions struct {
+	store Store
+	repo  string
+}
+
+func NewDecisions(store Store, repo string) *Decisions {
+	return &Decisions{
+		store: store,
+		repo:  strings.ToLower(repo),
+	}
+}
+
+// key is repo#number/kind/what@sha, what and sha may be empty.
+func (d *Decisions) key(kind string, number int, what string, sha string) string {
+	key := fmt.Sprintf("%s#%d/%s", d.repo, number, kind)
+	if what != "" {
+		key += "/" + what
+	}
+	if sha != "" {
+		key += "@" + sha
+	}
+	return key
+}
+
+func (d *Decisions) Done(kind string, number int, what string, sha string) (bool, error) {
+	value, err := d.store.Get(decisionsBucket, d.key(kind, number, what, sha))
+	if err != nil {
+		return false, err
+	}
+	return value != nil, nil
+}
+
+func (d *Decisions) Record(kind string, number int, what string, sha string) error {
+	return d.store.Put(decisionsBucket, d.key(kind, number, what, sha), []byte(time.Now().UTC().Format(time.RFC3339)))
+}
@@ -0,0 +1,40 @@
+// Copyright 2020-2021 The Datafuse Authors.
+//
+// SPDX-License-Identifier: Apache-2.0.
+
+package store
+
+import (
+	"fmt"
+
+	"bots/config"
+)
+
+// Store is a bucketed key/value store for the bot state.
+type Store interface {
+	// Get returns nil when the key does not exist.
+	Get(bucket, key string) ([]byte, error)
+	Put(bucket, key string, value []byte) error
+	// PutIfAbsent stores the value only when the key does not exist, in one
+	// step, and tells whether it did.
+	PutIfAbsent(bucket, key string, value []byte) (bool, error)
+	Delete(bucket, key string) error
+	// ForEach iterates the bucket in key order and stops at the first error,
+	// fn must not write to the store.
+	ForEach(bucket string, fn func(key string, value []byte) error) error
+	Close() error
+}
+
+func Open(cfg *config.Config) (Store, error) {
+	// A dry run must not leave decisions behind for the real runs.
+	if cfg.Github.DryRun {
+		return NewMemoryStore(), nil
+	}
+	switch cfg.Store.Type {
+	case "", "memory":
+		return NewMemoryStore(), nil
+	case "bolt":
+		return NewBoltStore(cfg.Store.Path)
+	}
+	return nil, fmt.Errorf("unknown store type: %v", cfg.Store.Type)
+}